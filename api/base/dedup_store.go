@@ -0,0 +1,328 @@
+package base
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	event2 "github.com/kaiheila/golang-bot/api/base/event"
+)
+
+// DefaultDedupCapacity 默认记录的已处理事件数量
+const DefaultDedupCapacity = 10000
+
+// DedupStore 记录已经处理过的事件标识(sn/msg_id)，用于在分发前过滤服务端重发的事件
+// 多个副本共享同一个DedupStore时，同一个事件只有一个副本能Claim成功
+type DedupStore interface {
+	// Claim 原子地检查并占用key，返回false表示key已经被处理或正在被处理
+	// 占用的key在store的过期时间内有效，redis实现相当于SET key 1 NX EX ttl
+	Claim(key string) (bool, error)
+	// Mark handler处理成功后确认key，持久化的实现在这时才写入，进程在handler执行中退出时重启后会再次处理
+	Mark(key string) error
+	// Release handler处理失败时释放占用的key，服务端重发时可以再次处理
+	Release(key string) error
+}
+
+// DedupKeys 返回frame用于去重的key, msg_id全局唯一，sn只在同一个session(scope)内唯一
+func DedupKeys(scope string, frame *event2.FrameMap) []string {
+	keys := make([]string, 0, 2)
+	if v, ok := frame.DataString("msg_id"); ok && v != "" {
+		keys = append(keys, "msg:"+v)
+	}
+	if frame.SerialNumber > 0 {
+		keys = append(keys, fmt.Sprintf("sn:%s:%d", scope, frame.SerialNumber))
+	}
+	return keys
+}
+
+// LRUDedupStore 内存中的有界去重记录，超过容量后淘汰最久未使用的key
+type LRUDedupStore struct {
+	capacity int
+	items    map[string]*list.Element
+	order    *list.List
+	lock     sync.Mutex
+}
+
+func NewLRUDedupStore(capacity int) *LRUDedupStore {
+	if capacity <= 0 {
+		capacity = DefaultDedupCapacity
+	}
+	return &LRUDedupStore{
+		capacity: capacity,
+		items:    make(map[string]*list.Element, capacity),
+		order:    list.New(),
+	}
+}
+
+func (l *LRUDedupStore) Mark(key string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.add(key)
+	return nil
+}
+
+func (l *LRUDedupStore) Claim(key string) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if e, ok := l.items[key]; ok {
+		l.order.MoveToBack(e)
+		return false, nil
+	}
+	l.add(key)
+	return true, nil
+}
+
+func (l *LRUDedupStore) Release(key string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.remove(key)
+	return nil
+}
+
+func (l *LRUDedupStore) remove(key string) {
+	if e, ok := l.items[key]; ok {
+		l.order.Remove(e)
+		delete(l.items, key)
+	}
+}
+
+func (l *LRUDedupStore) add(key string) {
+	if e, ok := l.items[key]; ok {
+		l.order.MoveToBack(e)
+		return
+	}
+	l.items[key] = l.order.PushBack(key)
+	for l.order.Len() > l.capacity {
+		oldest := l.order.Front()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(string))
+	}
+}
+
+// Len 当前记录的key数量
+func (l *LRUDedupStore) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.order.Len()
+}
+
+// Keys 按从旧到新的顺序返回当前记录的key
+func (l *LRUDedupStore) Keys() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	keys := make([]string, 0, l.order.Len())
+	for e := l.order.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(string))
+	}
+	return keys
+}
+
+// TTLDedupStore 内存中按时间过期的去重记录，key在ttl后失效，同时最多保留capacity个key
+// 多个副本需要共享去重记录时，可以用redis等实现DedupStore替换：Claim使用SET NX EX，Release使用DEL
+type TTLDedupStore struct {
+	ttl      time.Duration
+	capacity int
+	items    map[string]*list.Element
+	order    *list.List
+	lock     sync.Mutex
+	now      func() time.Time
+}
+
+type ttlEntry struct {
+	key      string
+	expireAt time.Time
+}
+
+func NewTTLDedupStore(ttl time.Duration, capacity int) *TTLDedupStore {
+	if capacity <= 0 {
+		capacity = DefaultDedupCapacity
+	}
+	return &TTLDedupStore{
+		ttl:      ttl,
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+		now:      time.Now,
+	}
+}
+
+func (s *TTLDedupStore) Mark(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire()
+	entry := ttlEntry{key: key, expireAt: s.now().Add(s.ttl)}
+	if e, ok := s.items[key]; ok {
+		e.Value = entry
+		s.order.MoveToBack(e)
+		return nil
+	}
+	s.add(entry)
+	return nil
+}
+
+func (s *TTLDedupStore) Claim(key string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire()
+	if _, ok := s.items[key]; ok {
+		return false, nil
+	}
+	s.add(ttlEntry{key: key, expireAt: s.now().Add(s.ttl)})
+	return true, nil
+}
+
+func (s *TTLDedupStore) Release(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e, ok := s.items[key]; ok {
+		s.remove(e)
+	}
+	return nil
+}
+
+func (s *TTLDedupStore) add(entry ttlEntry) {
+	s.items[entry.key] = s.order.PushBack(entry)
+	for s.order.Len() > s.capacity {
+		s.remove(s.order.Front())
+	}
+}
+
+// expire 删除已经过期的key，ttl固定，所以list中的过期时间是递增的
+func (s *TTLDedupStore) expire() {
+	now := s.now()
+	for e := s.order.Front(); e != nil; e = s.order.Front() {
+		if e.Value.(ttlEntry).expireAt.After(now) {
+			return
+		}
+		s.remove(e)
+	}
+}
+
+func (s *TTLDedupStore) remove(e *list.Element) {
+	s.order.Remove(e)
+	delete(s.items, e.Value.(ttlEntry).key)
+}
+
+// Len 当前没有过期的key数量
+func (s *TTLDedupStore) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire()
+	return s.order.Len()
+}
+
+// FileDedupStore 在LRUDedupStore的基础上把处理成功(Mark)的key追加写入文件，进程重启后可以恢复去重记录
+// Claim只占用内存中的key，handler执行中进程退出时事件没有写入文件，重启后服务端重发时会再次处理
+// 文件行数超过容量的2倍时会按内存中已确认的记录重写文件
+type FileDedupStore struct {
+	*LRUDedupStore
+	Path string
+	file *os.File
+	// claimed 已经Claim还没有Mark的key，不写入文件
+	claimed map[string]struct{}
+	lines   int
+	lock    sync.Mutex
+}
+
+func NewFileDedupStore(path string, capacity int) (*FileDedupStore, error) {
+	s := &FileDedupStore{LRUDedupStore: NewLRUDedupStore(capacity), Path: path, claimed: make(map[string]struct{})}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			key := strings.TrimSpace(scanner.Text())
+			if key == "" {
+				continue
+			}
+			s.LRUDedupStore.add(key)
+			s.lines++
+		}
+		f.Close()
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.file = f
+	return s, nil
+}
+
+func (s *FileDedupStore) Claim(key string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// 处理中的key可能已经被LRU淘汰
+	if _, ok := s.claimed[key]; ok {
+		return false, nil
+	}
+	ok, err := s.LRUDedupStore.Claim(key)
+	if ok && err == nil {
+		s.claimed[key] = struct{}{}
+	}
+	return ok, err
+}
+
+// Mark 确认key并写入文件
+func (s *FileDedupStore) Mark(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.claimed, key)
+	if err := s.LRUDedupStore.Mark(key); err != nil {
+		return err
+	}
+	return s.append(key)
+}
+
+// Release 释放内存中占用的key，没有Mark的key不在文件中，不需要写入
+func (s *FileDedupStore) Release(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.claimed, key)
+	return s.LRUDedupStore.Release(key)
+}
+
+func (s *FileDedupStore) append(line string) error {
+	if _, err := s.file.WriteString(line + "\n"); err != nil {
+		return err
+	}
+	s.lines++
+	if s.lines > 2*s.capacity {
+		return s.compact()
+	}
+	return nil
+}
+
+// compact 用内存中已确认的记录重写文件，先写临时文件fsync后再rename，避免写一半时进程退出丢失记录
+// 重写失败时继续追加写入原来的文件
+func (s *FileDedupStore) compact() error {
+	keys := make([]string, 0, s.LRUDedupStore.Len())
+	for _, key := range s.LRUDedupStore.Keys() {
+		if _, ok := s.claimed[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	if err := writeFileAtomic(s.Path, []byte(strings.Join(keys, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file = f
+	s.lines = len(keys)
+	return nil
+}
+
+func (s *FileDedupStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,201 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gookit/event"
+	event2 "github.com/kaiheila/golang-bot/api/base/event"
+)
+
+func lruSeen(l *LRUDedupStore, key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, ok := l.items[key]
+	return ok
+}
+
+func ttlSeen(s *TTLDedupStore, key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire()
+	_, ok := s.items[key]
+	return ok
+}
+
+func TestLRUDedupStoreEvict(t *testing.T) {
+	s := NewLRUDedupStore(2)
+	s.Mark("a")
+	s.Mark("b")
+	s.Mark("c")
+	if lruSeen(s, "a") {
+		t.Error("a should be evicted")
+	}
+	if !lruSeen(s, "b") || !lruSeen(s, "c") {
+		t.Error("b and c should be seen")
+	}
+}
+
+func TestFileDedupStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.log")
+	s, err := NewFileDedupStore(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5", "k6", "k7"} {
+		if err = s.Mark(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	s2, err := NewFileDedupStore(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if lruSeen(s2.LRUDedupStore, "k4") {
+		t.Error("k4 should be evicted")
+	}
+	for _, key := range []string{"k5", "k6", "k7"} {
+		if !lruSeen(s2.LRUDedupStore, key) {
+			t.Errorf("%s should be seen after reload", key)
+		}
+	}
+}
+
+func TestSessionSkipDuplicateEvent(t *testing.T) {
+	acked := make([]int64, 0)
+	s := &Session{EventSyncHandle: true, DedupStore: NewLRUDedupStore(10)}
+	s.FrameAckHandler = func(frame *event2.FrameMap) {
+		acked = append(acked, frame.SerialNumber)
+	}
+	newFrame := func(sn int64) *event2.FrameMap {
+		return &event2.FrameMap{
+			SignalType:   event2.SIG_EVENT,
+			SerialNumber: sn,
+			Data:         map[string]interface{}{"channel_type": "GROUP", "type": float64(9), "msg_id": "m1"},
+		}
+	}
+	s.ReceiveFrame(newFrame(1))
+	s.ReceiveFrame(newFrame(1))
+	if len(acked) != 1 || acked[0] != 1 {
+		t.Errorf("expected only sn 1 acked once, got %v", acked)
+	}
+}
+
+func TestTTLDedupStore(t *testing.T) {
+	now := time.Now()
+	s := NewTTLDedupStore(time.Minute, 2)
+	s.now = func() time.Time { return now }
+	s.Mark("k1")
+	now = now.Add(30 * time.Second)
+	s.Mark("k2")
+	if !ttlSeen(s, "k1") || !ttlSeen(s, "k2") {
+		t.Fatal("k1 and k2 should be seen")
+	}
+	now = now.Add(31 * time.Second)
+	if ttlSeen(s, "k1") || !ttlSeen(s, "k2") {
+		t.Fatal("only k1 should expire")
+	}
+	// 重新标记会延长过期时间
+	s.Mark("k2")
+	now = now.Add(50 * time.Second)
+	if !ttlSeen(s, "k2") {
+		t.Fatal("k2 should not expire after re-mark")
+	}
+	s.Mark("k3")
+	s.Mark("k4")
+	if s.Len() != 2 || ttlSeen(s, "k2") {
+		t.Fatalf("capacity exceeded, len %d", s.Len())
+	}
+}
+
+func TestDedupClaimAcrossSessions(t *testing.T) {
+	// 两个副本共享同一个store，同一个事件只能被一个副本处理
+	store := NewTTLDedupStore(time.Minute, 10)
+	var processed atomic.Int32
+	fail := atomic.Bool{}
+	fail.Store(true)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	channelType := fmt.Sprintf("CLAIMTEST%d", time.Now().UnixNano())
+	(&Session{}).On(channelType+"_9", event.ListenerFunc(func(e event.Event) error {
+		processed.Add(1)
+		if fail.Load() {
+			started <- struct{}{}
+			<-release
+			return errors.New("handler failed")
+		}
+		return nil
+	}))
+	newFrame := func() *event2.FrameMap {
+		return &event2.FrameMap{SignalType: event2.SIG_EVENT, SerialNumber: 1,
+			Data: map[string]interface{}{"channel_type": channelType, "type": float64(9), "msg_id": "claim-m1"}}
+	}
+	replicas := []*Session{{EventSyncHandle: true, DedupStore: store}, {EventSyncHandle: true, DedupStore: store}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		replicas[0].ReceiveFrame(newFrame())
+	}()
+	<-started
+	// 副本0正在处理，副本1收到同一个事件时跳过
+	replicas[1].ReceiveFrame(newFrame())
+	close(release)
+	<-done
+	if processed.Load() != 1 {
+		t.Fatalf("processed %d times", processed.Load())
+	}
+	// 处理失败后释放key，重发的事件可以被任意副本再次处理
+	fail.Store(false)
+	replicas[1].ReceiveFrame(newFrame())
+	replicas[0].ReceiveFrame(newFrame())
+	if processed.Load() != 2 {
+		t.Fatalf("processed %d times", processed.Load())
+	}
+}
+
+func TestFileDedupStoreClaimNotPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.log")
+	s, err := NewFileDedupStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"k1", "k2", "k3"} {
+		if ok, err := s.Claim(key); !ok || err != nil {
+			t.Fatalf("claim %s: %v %v", key, ok, err)
+		}
+	}
+	if ok, _ := s.Claim("k1"); ok {
+		t.Fatal("k1 claimed twice")
+	}
+	if err = s.Release("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Mark("k2"); err != nil {
+		t.Fatal(err)
+	}
+	// 触发重写文件，k3还在处理中，不能写入
+	for _, key := range []string{"k4", "k5", "k6", "k7", "k8"} {
+		s.Claim(key)
+		if err = s.Mark(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 模拟k3的handler执行中进程退出
+	s.Close()
+
+	s2, err := NewFileDedupStore(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if lruSeen(s2.LRUDedupStore, "k1") || lruSeen(s2.LRUDedupStore, "k3") || !lruSeen(s2.LRUDedupStore, "k8") {
+		t.Errorf("unexpected keys after reload %v", s2.Keys())
+	}
+}
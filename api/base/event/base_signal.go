@@ -3,14 +3,20 @@ package event
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 
 	"github.com/bytedance/sonic/ast"
 )
 
+// ErrTruncatedSignal 数据在一个signal的中间结束，可以用errors.Is判断
+var ErrTruncatedSignal = errors.New("truncated signal")
+
 // decodeError 解码错误类型
 type decodeError struct {
-	msg string
+	msg       string
+	truncated bool
 }
 
 // Error 实现error接口
@@ -18,6 +24,15 @@ func (e *decodeError) Error() string {
 	return fmt.Sprintf("decode error: %s", e.msg)
 }
 
+func (e *decodeError) Is(target error) bool {
+	return e.truncated && target == ErrTruncatedSignal
+}
+
+// truncatedError 数据长度不足
+func truncatedError(msg string) *decodeError {
+	return &decodeError{msg: msg, truncated: true}
+}
+
 // SignalInterface 定义signal的接口
 type SignalInterface interface {
 	WithVersion(version int)
@@ -26,7 +41,7 @@ type SignalInterface interface {
 	WithPayload(payload []byte)
 	WithJsonPayload(payload *ast.Node)
 	WithJsonBytePayload(payload []byte)
-	//ithIncludeLength(include bool)
+	WithIncludeLength(include bool)
 	Encode() ([]byte, error)
 	Decode(data []byte) error
 	IsVersion0() bool
@@ -45,6 +60,10 @@ type BaseSignal struct {
 	Payload         []byte
 	JsonPayload     *ast.Node
 	JsonBytePayload []byte
+	// IncludeLength header中包含payload长度
+	IncludeLength bool
+	// ExtFlags 扩展的标志位字节(不含continuation位)，用于兼容后续版本增加的标志位
+	ExtFlags []byte
 }
 
 // NewBaseSignal 创建一个新的基础signal
@@ -100,10 +119,10 @@ func (s *BaseSignal) WithJsonBytePayload(payload []byte) {
 	s.JsonBytePayload = payload
 }
 
-//// WithIncludeLength 设置是否包含载荷长度
-//func (s *BaseSignal) WithIncludeLength(include bool) {
-//	// 暂不实现，后续可根据需要添加
-//}
+// WithIncludeLength 设置是否包含载荷长度
+func (s *BaseSignal) WithIncludeLength(include bool) {
+	s.IncludeLength = include
+}
 
 // GetSN 获取序列号
 func (s *BaseSignal) GetSN() int64 {
@@ -121,10 +140,12 @@ func (s *BaseSignal) Decode(data []byte) error {
 	if err != nil {
 		return err
 	}
-	//s.SignalType = decoded.SignalType
+	s.SignalType = decoded.SignalType
 	s.Version = decoded.Version
 	s.SN = decoded.SN
 	s.HasSN = decoded.HasSN
+	s.IncludeLength = decoded.IncludeLength
+	s.ExtFlags = decoded.ExtFlags
 	s.Payload = decoded.Payload
 	return nil
 }
@@ -133,71 +154,137 @@ func (s *BaseSignal) Decode(data []byte) error {
 func (s *BaseSignal) Encode() ([]byte, error) {
 	if s.IsVersion0() {
 		// 版本0没有header，直接返回payload
-		if s.Payload != nil {
-			return s.Payload, nil
-		}
-
+		return s.Payload, nil
+	}
+	if !IsSupportedHeaderVersion(s.Version) {
+		return nil, fmt.Errorf("unsupported header version %d", s.Version)
 	}
 
 	// 版本1需要封装header
 	return s.encodeWithHeader()
 }
 
+// header v1 格式：
+//
+//	version(1字节) | flags(1~n字节) | [signal type(1字节)] | [长度描述(1字节)] | [SN] | [payload长度] | payload
+//
+// flags每个字节的最低位表示下一个字节也是flags，第一个字节：
+// bit7 有SN，bit6 有payload长度，bit5 有signal type，bit4-1保留；后续字节的bit7-1保留给扩展(ExtFlags)
+// 长度描述：bit5-4为SN的长度，bit1-0为payload长度字段的长度，取值0/1/2/3分别表示1/2/4/8字节
+const (
+	flagHasSN      = 0x80
+	flagHasLength  = 0x40
+	flagHasType    = 0x20
+	flagContinue   = 0x01
+	flagExtMask    = 0xFE
+	maxHeaderFlags = 8
+)
+
+// SupportedHeaderVersions 支持的header版本，0表示没有header
+var SupportedHeaderVersions = []int{0, 1}
+
+// IsSupportedHeaderVersion 判断是否支持该header版本
+func IsSupportedHeaderVersion(version int) bool {
+	for _, v := range SupportedHeaderVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// NegotiateHeaderVersion 返回不超过requested的最高支持版本，用于向网关声明header-version
+func NegotiateHeaderVersion(requested int) int {
+	res := 0
+	for _, v := range SupportedHeaderVersions {
+		if v <= requested && v > res {
+			res = v
+		}
+	}
+	return res
+}
+
+// lenCode 返回保存v需要的长度编码
+func lenCode(v uint64) uint8 {
+	switch {
+	case v <= 0xFF:
+		return 0 // 1字节
+	case v <= 0xFFFF:
+		return 1 // 2字节
+	case v <= 0xFFFFFFFF:
+		return 2 // 4字节
+	default:
+		return 3 // 8字节
+	}
+}
+
+func writeUint(buf *bytes.Buffer, code uint8, v uint64) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	buf.Write(b[8-(1<<code):])
+}
+
+func readUint(data []byte, index int, code uint8, field string) (uint64, int, error) {
+	n := 1 << code
+	if index+n > len(data) {
+		return 0, index, truncatedError(fmt.Sprintf("invalid data length for %d-byte %s", n, field))
+	}
+	b := make([]byte, 8)
+	copy(b[8-n:], data[index:index+n])
+	return binary.BigEndian.Uint64(b), index + n, nil
+}
+
 // encodeWithHeader 编码带header的signal
 func (s *BaseSignal) encodeWithHeader() ([]byte, error) {
+	if s.HasSN && s.SN < 0 {
+		return nil, fmt.Errorf("invalid sn %d", s.SN)
+	}
+	if s.SignalType < 0 || s.SignalType > 0xFF {
+		return nil, fmt.Errorf("invalid signal type %d", s.SignalType)
+	}
+	if len(s.ExtFlags) > maxHeaderFlags-1 {
+		return nil, fmt.Errorf("too many ext flags %d", len(s.ExtFlags))
+	}
 	buf := &bytes.Buffer{}
+	buf.WriteByte(uint8(s.Version))
 
-	// 第一个字节：版本(8bit)
-	// 版本占8位
-	versionByte := uint8(s.Version)
+	flags := make([]byte, 1+len(s.ExtFlags))
+	if s.HasSN {
+		flags[0] |= flagHasSN
+	}
+	if s.IncludeLength {
+		flags[0] |= flagHasLength
+	}
+	if s.SignalType != 0 {
+		flags[0] |= flagHasType
+	}
+	for i, ext := range s.ExtFlags {
+		flags[i+1] = ext & flagExtMask
+	}
+	for i := 0; i < len(flags)-1; i++ {
+		flags[i] |= flagContinue
+	}
+	buf.Write(flags)
 
-	// 第二个字节：标志位
-	flagByte := uint8(0)
+	if s.SignalType != 0 {
+		buf.WriteByte(uint8(s.SignalType))
+	}
+	var snCode, payloadCode uint8
 	if s.HasSN {
-		flagByte |= 0x80 // 最高位表示是否有序列号
-	}
-	// 保留的6位填0
-	// 最低位表示下一个byte是否也是标志位，这里设置为0
-
-	buf.WriteByte(versionByte)
-	buf.WriteByte(flagByte)
-
-	// 序列号长度标识：使用4位
-	snLen := 2 // 默认使用4字节
-	if s.SN <= 0xFF {
-		snLen = 0 // 1字节
-	} else if s.SN <= 0xFFFF {
-		snLen = 1 // 2字节
-	} else if s.SN <= 0xFFFFFFFF {
-		snLen = 2 // 4字节
-	} else {
-		snLen = 3 // 8字节
-	}
-
-	snLenByte := uint8(snLen) << 6 // 高2位表示序列号长度
-	// 保留的4位填0
-	buf.WriteByte(snLenByte)
-
-	// 根据长度写入序列号
-	switch snLen {
-	case 0:
-		// 1字节
-		buf.WriteByte(uint8(s.SN))
-	case 1:
-		// 2字节
-		snBuf := make([]byte, 2)
-		binary.BigEndian.PutUint16(snBuf, uint16(s.SN))
-		buf.Write(snBuf)
-	case 2:
-		// 4字节
-		snBuf := make([]byte, 4)
-		binary.BigEndian.PutUint32(snBuf, uint32(s.SN))
-		buf.Write(snBuf)
-	case 3:
-		// 8字节
-		snBuf := make([]byte, 8)
-		binary.BigEndian.PutUint64(snBuf, uint64(s.SN))
-		buf.Write(snBuf)
+		snCode = lenCode(uint64(s.SN))
+	}
+	if s.IncludeLength {
+		payloadCode = lenCode(uint64(len(s.Payload)))
+	}
+	// 没有SN和payload长度时不写长度描述
+	if s.HasSN || s.IncludeLength {
+		buf.WriteByte(snCode<<4 | payloadCode)
+	}
+	if s.HasSN {
+		writeUint(buf, snCode, uint64(s.SN))
+	}
+	if s.IncludeLength {
+		writeUint(buf, payloadCode, uint64(len(s.Payload)))
 	}
 
 	// 写入负载
@@ -217,13 +304,48 @@ func Decode(data []byte, version int) (*BaseSignal, error) {
 	}
 
 	// 版本1需要解析header
-	return decodeWithHeader(data)
+	signal, n, err := decodeHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(data) {
+		return nil, &decodeError{msg: fmt.Sprintf("%d bytes of trailing data", len(data)-n)}
+	}
+	return signal, nil
+}
+
+// DecodeAll 解码一个消息中依次拼接的多个signal，payload直接引用data的子切片
+// 除最后一个signal外都需要带payload长度；数据在signal中间结束时返回已经完整解码的signal及ErrTruncatedSignal
+func DecodeAll(data []byte, version int) ([]*BaseSignal, error) {
+	if version == 0 {
+		signal, err := Decode(data, version)
+		if err != nil {
+			return nil, err
+		}
+		return []*BaseSignal{signal}, nil
+	}
+	signals := make([]*BaseSignal, 0, 1)
+	for offset := 0; offset < len(data) || len(signals) == 0; {
+		signal, n, err := decodeHeader(data[offset:])
+		if err != nil {
+			return signals, fmt.Errorf("signal %d at offset %d: %w", len(signals), offset, err)
+		}
+		signals = append(signals, signal)
+		offset += n
+	}
+	return signals, nil
 }
 
 // decodeWithHeader 解析带header的signal
 func decodeWithHeader(data []byte) (*BaseSignal, error) {
+	return Decode(data, 1)
+}
+
+// decodeHeader 解析一个带header的signal，返回signal及其占用的字节数
+// 没有payload长度字段时，剩余的数据全部作为payload
+func decodeHeader(data []byte) (*BaseSignal, int, error) {
 	if len(data) < 2 {
-		return nil, &decodeError{msg: "invalid data length"}
+		return nil, 0, truncatedError("invalid data length")
 	}
 
 	// 直接从字节切片读取，使用索引偏移
@@ -232,62 +354,79 @@ func decodeWithHeader(data []byte) (*BaseSignal, error) {
 	// 读取版本
 	version := int(data[index])
 	index++
+	if version == 0 || !IsSupportedHeaderVersion(version) {
+		return nil, 0, &decodeError{msg: fmt.Sprintf("unsupported header version %d", version)}
+	}
 
-	// 读取标志位
+	// 读取标志位，最低位为1时下一个字节也是标志位
 	flagByte := data[index]
 	index++
-	hasSN := (flagByte & 0x80) != 0
-
 	signal := &BaseSignal{
-		Version: version,
-		HasSN:   hasSN,
+		Version:       version,
+		HasSN:         flagByte&flagHasSN != 0,
+		IncludeLength: flagByte&flagHasLength != 0,
 	}
-
-	if hasSN {
+	hasType := flagByte&flagHasType != 0
+	for flag := flagByte; flag&flagContinue != 0; {
 		if index >= len(data) {
-			return nil, &decodeError{msg: "invalid data length for SN"}
+			return nil, 0, truncatedError("invalid data length for flags")
+		}
+		if len(signal.ExtFlags) >= maxHeaderFlags-1 {
+			return nil, 0, &decodeError{msg: "too many flag bytes"}
 		}
+		flag = data[index]
+		index++
+		signal.ExtFlags = append(signal.ExtFlags, flag&flagExtMask)
+	}
 
-		// 读取序列号长度标识
-		snLenByte := data[index]
+	if hasType {
+		if index >= len(data) {
+			return nil, 0, truncatedError("invalid data length for signal type")
+		}
+		signal.SignalType = int(data[index])
 		index++
-		snLen := int((snLenByte >> 6) & 0x03)
-
-		// 根据长度读取序列号
-		switch snLen {
-		case 0:
-			// 1字节
-			if index >= len(data) {
-				return nil, &decodeError{msg: "invalid data length for 1-byte SN"}
-			}
-			signal.SN = int64(data[index])
-			index++
-		case 1:
-			// 2字节
-			if index+1 >= len(data) {
-				return nil, &decodeError{msg: "invalid data length for 2-byte SN"}
-			}
-			signal.SN = int64(binary.BigEndian.Uint16(data[index : index+2]))
-			index += 2
-		case 2:
-			// 4字节
-			if index+3 >= len(data) {
-				return nil, &decodeError{msg: "invalid data length for 4-byte SN"}
-			}
-			signal.SN = int64(binary.BigEndian.Uint32(data[index : index+4]))
-			index += 4
-		case 3:
-			// 8字节
-			if index+7 >= len(data) {
-				return nil, &decodeError{msg: "invalid data length for 8-byte SN"}
-			}
-			signal.SN = int64(binary.BigEndian.Uint64(data[index : index+8]))
-			index += 8
+	}
+
+	if !signal.HasSN && !signal.IncludeLength {
+		// 0copy：直接使用原始数据的子切片作为payload，避免复制
+		signal.Payload = data[index:]
+		return signal, len(data), nil
+	}
+
+	// 读取长度描述
+	if index >= len(data) {
+		return nil, 0, truncatedError("invalid data length for SN")
+	}
+	lenByte := data[index]
+	index++
+	snCode, payloadCode := (lenByte>>4)&0x03, lenByte&0x03
+
+	var err error
+	if signal.HasSN {
+		var sn uint64
+		if sn, index, err = readUint(data, index, snCode, "SN"); err != nil {
+			return nil, 0, err
 		}
+		if sn > math.MaxInt64 {
+			return nil, 0, &decodeError{msg: "SN overflow"}
+		}
+		signal.SN = int64(sn)
+	}
+
+	end := len(data)
+	if signal.IncludeLength {
+		var length uint64
+		if length, index, err = readUint(data, index, payloadCode, "payload length"); err != nil {
+			return nil, 0, err
+		}
+		if length > uint64(len(data)-index) {
+			return nil, 0, truncatedError(fmt.Sprintf("payload length %d exceeds data length %d", length, len(data)-index))
+		}
+		end = index + int(length)
 	}
 
 	// 0copy：直接使用原始数据的子切片作为payload，避免复制
-	signal.Payload = data[index:]
+	signal.Payload = data[index:end]
 
-	return signal, nil
+	return signal, end, nil
 }
@@ -1,7 +1,11 @@
 package event
 
 import (
+	"bytes"
+	"errors"
+	"math"
 	"testing"
+	"testing/quick"
 )
 
 func TestDecodeWithHeader(t *testing.T) {
@@ -85,3 +89,150 @@ func TestDecodeWithHeaderNoSN(t *testing.T) {
 		t.Errorf("expected payload %q, got %q", payload, signal.Payload)
 	}
 }
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	snValues := []int64{0, 1, 0xFF, 0x100, 0xFFFF, 0x10000, 0xFFFFFFFF, 0x100000000, math.MaxInt64}
+	payloadSizes := []int{0, 1, 0xFF, 0x100, 0x10000}
+	for _, hasSN := range []bool{false, true} {
+		for _, includeLength := range []bool{false, true} {
+			for _, signalType := range []int{0, 1, 7, 0xFF} {
+				for _, extFlags := range [][]byte{nil, {0x02}, {0xFE, 0x00, 0x80}} {
+					for _, sn := range snValues {
+						for _, size := range payloadSizes {
+							s := &BaseSignal{Version: 1, SignalType: signalType, HasSN: hasSN, IncludeLength: includeLength, ExtFlags: extFlags, Payload: bytes.Repeat([]byte{'x'}, size)}
+							if hasSN {
+								s.SN = sn
+							}
+							checkRoundTrip(t, s)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeDecodeQuick(t *testing.T) {
+	f := func(hasSN, includeLength bool, sn uint64, signalType uint8, extFlags []byte, payload []byte) bool {
+		if len(extFlags) > 7 {
+			extFlags = extFlags[:7]
+		}
+		for i := range extFlags {
+			extFlags[i] &= 0xFE
+		}
+		if len(extFlags) == 0 {
+			extFlags = nil
+		}
+		s := &BaseSignal{Version: 1, SignalType: int(signalType), HasSN: hasSN, IncludeLength: includeLength, ExtFlags: extFlags, Payload: payload}
+		if hasSN {
+			s.SN = int64(sn >> 1)
+		}
+		return checkRoundTrip(t, s)
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkRoundTrip(t *testing.T, s *BaseSignal) bool {
+	t.Helper()
+	data, err := s.Encode()
+	if err != nil {
+		t.Fatalf("encode %+v: %v", s, err)
+	}
+	decoded := &BaseSignal{Version: 1}
+	if err = decoded.Decode(data); err != nil {
+		t.Fatalf("decode %+v: %v", s, err)
+	}
+	if decoded.SignalType != s.SignalType || decoded.HasSN != s.HasSN || decoded.SN != s.SN ||
+		decoded.IncludeLength != s.IncludeLength || !bytes.Equal(decoded.ExtFlags, s.ExtFlags) || !bytes.Equal(decoded.Payload, s.Payload) {
+		t.Fatalf("round trip mismatch:\n%+v\n%+v", s, decoded)
+	}
+	return true
+}
+
+func TestDecodeInvalidHeader(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		{1},
+		{2, 0x00},          // 不支持的版本
+		{1, 0x01},          // 缺少后续的flags
+		{1, 0x20},          // 缺少signal type
+		{1, 0x80},          // 缺少长度描述
+		{1, 0x80, 0x10, 1}, // SN长度不足
+		{1, 0x40, 0x00, 5, 'a'},
+		{1, 0x40, 0x00, 1, 'a', 'b'}, // 多余的数据
+		{1, 0x80, 0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, // SN溢出
+		{1, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x00},       // flags过多
+	} {
+		if _, err := Decode(data, 1); err == nil {
+			t.Errorf("expect error for %v", data)
+		}
+	}
+	// 版本0没有header
+	if s, err := Decode([]byte("{}"), 0); err != nil || string(s.Payload) != "{}" {
+		t.Errorf("version 0: %v", err)
+	}
+}
+
+func TestNegotiateHeaderVersion(t *testing.T) {
+	for requested, want := range map[int]int{-1: 0, 0: 0, 1: 1, 2: 1, 100: 1} {
+		if got := NegotiateHeaderVersion(requested); got != want {
+			t.Errorf("negotiate %d: got %d, want %d", requested, got, want)
+		}
+	}
+	if _, err := (&BaseSignal{Version: 2}).Encode(); err == nil {
+		t.Error("expect error for unsupported version")
+	}
+}
+
+func TestDecodeAll(t *testing.T) {
+	var data []byte
+	signals := []*BaseSignal{
+		{Version: 1, HasSN: true, SN: 1, IncludeLength: true, Payload: []byte(`{"s":0}`)},
+		{Version: 1, HasSN: true, SN: 2, IncludeLength: true, Payload: []byte(`{"s":0,"d":{}}`)},
+		{Version: 1, SignalType: 3, IncludeLength: true, Payload: nil},
+		// 最后一个signal可以不带长度
+		{Version: 1, HasSN: true, SN: 300, Payload: []byte(`{"s":3}`)},
+	}
+	for _, s := range signals {
+		b, err := s.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, b...)
+	}
+	decoded, err := DecodeAll(data, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(signals) {
+		t.Fatalf("decoded %d signals", len(decoded))
+	}
+	for i, s := range decoded {
+		if s.SN != signals[i].SN || s.SignalType != signals[i].SignalType || !bytes.Equal(s.Payload, signals[i].Payload) {
+			t.Fatalf("signal %d: %+v", i, s)
+		}
+	}
+	// payload引用原始数据，没有复制
+	if len(decoded[0].Payload) > 0 && &decoded[0].Payload[0] != &data[5] {
+		t.Fatal("payload should be a sub slice of data")
+	}
+
+	// 在第二个signal中间截断，返回第一个signal及ErrTruncatedSignal
+	first, _ := signals[0].Encode()
+	truncated := data[:len(first)+6]
+	decoded, err = DecodeAll(truncated, 1)
+	if !errors.Is(err, ErrTruncatedSignal) {
+		t.Fatalf("expect ErrTruncatedSignal, got %v", err)
+	}
+	if len(decoded) != 1 || decoded[0].SN != 1 {
+		t.Fatalf("decoded %d signals before truncated tail", len(decoded))
+	}
+
+	// 版本0整个消息是一个signal
+	decoded, err = DecodeAll([]byte(`{"s":0}`), 0)
+	if err != nil || len(decoded) != 1 {
+		t.Fatalf("version 0: %d %v", len(decoded), err)
+	}
+}
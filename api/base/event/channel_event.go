@@ -7,7 +7,7 @@ type ChannelAddUserEventFrame struct {
 
 type ChannelAddUserEvent struct {
 	BaseEvent
-	extra *ChannelAddUserExtra `json:"extra"`
+	Extra *ChannelAddUserExtra `json:"extra"`
 }
 type Emoji struct {
 	Id   string `json:"id"`
@@ -20,5 +20,5 @@ type ChannelAddUserExtra struct {
 		Emoji     *Emoji
 		UserId    string `json:"user_id"`
 		MsgId     string `json:"msg_id"`
-	} `json"body"`
+	} `json:"body"`
 }
@@ -1,17 +1,102 @@
 package event
 
 import (
+	"encoding/json"
+
 	"github.com/bytedance/sonic"
-	log "github.com/sirupsen/logrus"
+	"github.com/kaiheila/golang-bot/api/helper/logger"
 )
 
 type Frame struct {
 	SignalType int32 `json:"s"`
 }
+
+// GetSignalType 返回signal类型，嵌入Frame的signal都实现了OutboundSignal
+func (f Frame) GetSignalType() int32 {
+	return f.SignalType
+}
+
 type FrameMap struct {
 	SignalType   int32                  `json:"s"`
 	Data         map[string]interface{} `json:"d"`
 	SerialNumber int64                  `json:"sn"`
+	// lazy 收到的原始数据，Data没有解码时从这里读取d
+	lazy *LazyFrame
+}
+
+// Lazy 返回收到frame时的LazyFrame，自己构造的FrameMap返回nil
+func (f *FrameMap) Lazy() *LazyFrame {
+	return f.lazy
+}
+
+// DataValue 返回d中key对应的值，Data没有解码时从原始数据中读取
+func (f *FrameMap) DataValue(key string) (interface{}, bool) {
+	if f.Data != nil || f.lazy == nil {
+		v, ok := f.Data[key]
+		return v, ok
+	}
+	return f.lazy.DataValue(key)
+}
+
+// DataString 返回d中key对应的字符串
+func (f *FrameMap) DataString(key string) (string, bool) {
+	v, _ := f.DataValue(key)
+	s, ok := v.(string)
+	return s, ok
+}
+
+// EventType 返回d.type，不存在或者不是整数时返回FrameError
+func (f *FrameMap) EventType() (int64, error) {
+	if f.Data == nil && f.lazy != nil {
+		return f.lazy.EventType()
+	}
+	v, ok, err := f.DataInt64Field("type")
+	if err == nil && !ok {
+		err = &FrameError{Field: "d.type", Reason: "missing"}
+	}
+	return v, err
+}
+
+// ChannelType 返回d.channel_type，兼容旧的channelType，都不存在或者不是字符串时返回FrameError
+func (f *FrameMap) ChannelType() (string, error) {
+	if f.Data == nil && f.lazy != nil {
+		return f.lazy.ChannelType()
+	}
+	for _, key := range []string{"channel_type", "channelType"} {
+		if v, ok, err := f.DataStringField(key); err != nil || ok {
+			return v, err
+		}
+	}
+	return "", &FrameError{Field: "d.channel_type", Reason: "missing"}
+}
+
+// DecodeData 把d解码到v，收到的frame直接从原始数据解码，不需要先序列化Data
+func (f *FrameMap) DecodeData(v interface{}) error {
+	if f.lazy != nil {
+		return f.lazy.DecodeData(v)
+	}
+	data, err := sonic.Marshal(f.Data)
+	if err != nil {
+		return err
+	}
+	return sonic.Unmarshal(data, v)
+}
+
+// MarshalJSON Data没有解码时使用原始的d
+func (f *FrameMap) MarshalJSON() ([]byte, error) {
+	type frameMap FrameMap
+	if f.Data != nil || f.lazy == nil {
+		return sonic.Marshal((*frameMap)(f))
+	}
+	raw, err := f.lazy.RawData()
+	if err != nil {
+		raw = "null"
+	}
+	return sonic.Marshal(&struct {
+		SignalType   int32           `json:"s"`
+		Data         json.RawMessage `json:"d"`
+		SerialNumber int64           `json:"sn"`
+	}{f.SignalType, json.RawMessage(raw), f.SerialNumber})
 }
 
 func ParseFrameMapByData(data []byte) *FrameMap {
@@ -19,12 +104,13 @@ func ParseFrameMapByData(data []byte) *FrameMap {
 	frame := &FrameMap{}
 	err := sonic.Unmarshal(data, frame)
 	if err != nil {
-		log.Error("data unmarshal err", err)
+		logger.Default().Error("data unmarshal err", "err", err)
 		return nil
 	}
 	return frame
 }
 
+// Deprecated: 使用NewPingSignal
 func NewPingFrame(sn int64) *FrameMap {
 	frame := &FrameMap{}
 	frame.SerialNumber = sn
@@ -33,6 +119,7 @@ func NewPingFrame(sn int64) *FrameMap {
 	return frame
 }
 
+// Deprecated: 使用NewNAckSignal
 func NewNAckFrame(sns []int64) *FrameMap {
 	frame := &FrameMap{}
 	frame.SignalType = SIG_NACK
@@ -0,0 +1,82 @@
+package event
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrInvalidFrame frame格式不正确，可以用errors.Is(err, ErrInvalidFrame)判断
+var ErrInvalidFrame = errors.New("invalid frame")
+
+// FrameError 收到的frame缺少字段或字段类型不正确
+type FrameError struct {
+	// Field 出错的字段，如s、d.type，为空表示整个frame不是合法的json对象
+	Field  string
+	Reason string
+	// Err 底层的解析错误，可能为nil
+	Err error
+}
+
+func (e *FrameError) Error() string {
+	msg := ErrInvalidFrame.Error()
+	if e.Field != "" {
+		msg += " field " + e.Field
+	}
+	msg += ": " + e.Reason
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *FrameError) Is(target error) bool {
+	return target == ErrInvalidFrame
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// newFieldError 字段类型不正确
+func newFieldError(field string, want string, got interface{}) *FrameError {
+	return &FrameError{Field: field, Reason: fmt.Sprintf("want %s, got %T", want, got)}
+}
+
+// toInt64 json数字解码为float64，只接受可以无损转换为int64的整数
+func toInt64(field string, v interface{}) (int64, error) {
+	f, ok := v.(float64)
+	if !ok {
+		return 0, newFieldError(field, "integer", v)
+	}
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, &FrameError{Field: field, Reason: fmt.Sprintf("%v is not an int64", f)}
+	}
+	return int64(f), nil
+}
+
+// DataStringField 读取d中的字符串字段，不存在时ok为false，类型不正确时返回FrameError
+func (f *FrameMap) DataStringField(key string) (value string, ok bool, err error) {
+	v, ok := f.DataValue(key)
+	if !ok || v == nil {
+		return "", false, nil
+	}
+	s, isString := v.(string)
+	if !isString {
+		return "", false, newFieldError("d."+key, "string", v)
+	}
+	return s, true, nil
+}
+
+// DataInt64Field 读取d中的整数字段，不存在时ok为false，类型不正确时返回FrameError
+func (f *FrameMap) DataInt64Field(key string) (value int64, ok bool, err error) {
+	v, ok := f.DataValue(key)
+	if !ok || v == nil {
+		return 0, false, nil
+	}
+	n, err := toInt64("d."+key, v)
+	if err != nil {
+		return 0, false, err
+	}
+	return n, true, nil
+}
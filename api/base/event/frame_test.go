@@ -1,15 +1,228 @@
 package event
 
 import (
+	"errors"
+	"sync"
 	"testing"
+
+	"github.com/bytedance/sonic"
 )
 
+var testFrameData = []byte(`{"s":0,"d":{"channel_type":"GROUP","type":9,"target_id":"1095267793744046","author_id":"2125395261","content":"\u4f60\u597d","extra":{"type":9,"code":"","guild_id":"2040017328407003","channel_name":"\u5411\u65e5\u8475\ud83c\udf3b","author":{"id":"2125395261","username":"\u6bdb\u7b14\u5c0f\u65b0","identify_num":"8668","online":true,"os":"Websocket","status":1,"avatar":"https:\/\/img.kookapp.cn\/assets\/avatar_9.jpg\/icon","vip_avatar":"https:\/\/img.kookapp.cn\/assets\/avatar_9.jpg\/icon","banner":"","nickname":"\u6bdb\u7b14\u5c0f\u65b0","roles":[],"is_vip":false,"is_ai_reduce_noise":true,"is_personal_card_bg":false,"bot":false,"decorations_id_map":null},"visible_only":null,"mention":[],"mention_all":false,"mention_roles":[],"mention_here":false,"nav_channels":[],"kmarkdown":{"raw_content":"\u4f60\u597d","mention_part":[],"mention_role_part":[],"channel_part":[]},"last_msg_content":"\u6bdb\u7b14\u5c0f\u65b0\uff1a\u4f60\u597d","send_msg_device":0},"msg_id":"dc16a6f2-f711-4d0b-8022-92798d602e28","msg_timestamp":1677238292770,"nonce":"Ns3sGtJDZ611H6nXuACfYEJg","from_type":1,"verify_token":"6AOhOKALjnnySAkR"},"sn":10}`)
+
 func TestParseFrame(t *testing.T) {
-	f := ParseFrameMapByData([]byte(`{"s":0,"d":{"channel_type":"GROUP","type":9,"target_id":"1095267793744046","author_id":"2125395261","content":"\u4f60\u597d","extra":{"type":9,"code":"","guild_id":"2040017328407003","channel_name":"\u5411\u65e5\u8475\ud83c\udf3b","author":{"id":"2125395261","username":"\u6bdb\u7b14\u5c0f\u65b0","identify_num":"8668","online":true,"os":"Websocket","status":1,"avatar":"https:\/\/img.kookapp.cn\/assets\/avatar_9.jpg\/icon","vip_avatar":"https:\/\/img.kookapp.cn\/assets\/avatar_9.jpg\/icon","banner":"","nickname":"\u6bdb\u7b14\u5c0f\u65b0","roles":[],"is_vip":false,"is_ai_reduce_noise":true,"is_personal_card_bg":false,"bot":false,"decorations_id_map":null},"visible_only":null,"mention":[],"mention_all":false,"mention_roles":[],"mention_here":false,"nav_channels":[],"kmarkdown":{"raw_content":"\u4f60\u597d","mention_part":[],"mention_role_part":[],"channel_part":[]},"last_msg_content":"\u6bdb\u7b14\u5c0f\u65b0\uff1a\u4f60\u597d","send_msg_device":0},"msg_id":"dc16a6f2-f711-4d0b-8022-92798d602e28","msg_timestamp":1677238292770,"nonce":"Ns3sGtJDZ611H6nXuACfYEJg","from_type":1,"verify_token":"6AOhOKALjnnySAkR"},"sn":10}`))
+	f := ParseFrameMapByData(testFrameData)
 	if f == nil {
-		t.Error("f is nil")
+		t.Fatal("f is nil")
+	}
+	if f.Data["type"] != float64(9) || f.SerialNumber != 10 {
+		t.Errorf("unexpected frame %+v", f)
+	}
+}
+
+func TestLazyFrame(t *testing.T) {
+	lazy, err := NewLazyFrame(testFrameData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, decodeData := range []bool{true, false} {
+		f, err := lazy.FrameMap(decodeData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (f.Data != nil) != decodeData {
+			t.Fatalf("decodeData %v, Data %v", decodeData, f.Data)
+		}
+		if f.SignalType != SIG_EVENT || f.SerialNumber != 10 {
+			t.Fatalf("unexpected frame %+v", f)
+		}
+		if typ, err := f.EventType(); err != nil || typ != EventKMDMsgType {
+			t.Fatalf("event type %d %v", typ, err)
+		}
+		if ct, err := f.ChannelType(); err != nil || ct != "GROUP" {
+			t.Fatalf("channel type %q %v", ct, err)
+		}
+		if v, ok := f.DataValue("msg_timestamp"); !ok || v != float64(1677238292770) {
+			t.Fatalf("msg_timestamp %v %v", v, ok)
+		}
+		if _, ok := f.DataValue("not_exist"); ok {
+			t.Fatal("expect not exist")
+		}
+		msg := &MessageKMarkdownEvent{}
+		if err = f.DecodeData(msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Author.Username != "毛笔小新" || msg.KMarkdown.RawContent != "你好" || msg.MsgId == "" {
+			t.Fatalf("unexpected event %+v", msg)
+		}
+		// Data没有解码时序列化使用原始的d
+		data, err := sonic.Marshal(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again := ParseFrameMapByData(data)
+		if again == nil || again.Data["msg_id"] != "dc16a6f2-f711-4d0b-8022-92798d602e28" || again.SerialNumber != 10 {
+			t.Fatalf("marshal %s", data)
+		}
+	}
+
+	for _, data := range []string{`[1]`, `{"s":`, `{"s":"x"}`} {
+		lazy, err := NewLazyFrame([]byte(data))
+		if err == nil {
+			_, err = lazy.FrameMap(false)
+		}
+		if err == nil {
+			t.Fatalf("expect error for %s", data)
+		}
+	}
+	lazy, err = NewLazyFrame([]byte(`{"s":1,"d":{"code":0}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := lazy.FrameMap(false)
+	if err != nil || f.SignalType != SIG_HELLO || f.SerialNumber != 0 {
+		t.Fatalf("hello frame %+v %v", f, err)
+	}
+	if _, err := f.ChannelType(); !errors.Is(err, ErrInvalidFrame) {
+		t.Fatalf("expect ErrInvalidFrame, got %v", err)
+	}
+}
+
+// BenchmarkFrameMap 原来的流程：校验json，解码为map，handler再序列化Data后解码到结构体
+func BenchmarkFrameMap(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := sonic.Get(testFrameData); err != nil {
+			b.Fatal(err)
+		}
+		f := ParseFrameMapByData(testFrameData)
+		if _, ok := f.Data["type"].(float64); !ok {
+			b.Fatal("no type")
+		}
+		data, err := sonic.Marshal(f.Data)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err = sonic.Unmarshal(data, &MessageKMarkdownEvent{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLazyFrameConcurrent(t *testing.T) {
+	lazy, err := NewLazyFrame(testFrameData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := lazy.FrameMap(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 异步分发时多个handler并发读取同一个frame
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msgId, _ := f.DataString("msg_id")
+			nonce, _ := f.DataString("nonce")
+			event := &BaseEvent{}
+			if err := f.DecodeData(event); err != nil {
+				errs <- err
+				return
+			}
+			if msgId != "dc16a6f2-f711-4d0b-8022-92798d602e28" || nonce != "Ns3sGtJDZ611H6nXuACfYEJg" || event.Content != "你好" {
+				errs <- errors.New("unexpected data " + msgId + " " + nonce + " " + event.Content)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// BenchmarkLazyFrame 只读取路由需要的字段，d直接解码到结构体
+func BenchmarkLazyFrame(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		lazy, err := NewLazyFrame(testFrameData)
+		if err != nil {
+			b.Fatal(err)
+		}
+		f, err := lazy.FrameMap(false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = f.EventType(); err != nil {
+			b.Fatal(err)
+		}
+		if _, err = f.ChannelType(); err != nil {
+			b.Fatal(err)
+		}
+		if err = f.DecodeData(&MessageKMarkdownEvent{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkLazyFrameDecodeData 默认设置(LazyFrameData为false)：校验json后把d解码为Data，handler仍然从原始数据解码到结构体
+func BenchmarkLazyFrameDecodeData(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		lazy, err := NewLazyFrame(testFrameData)
+		if err != nil {
+			b.Fatal(err)
+		}
+		f, err := lazy.FrameMap(true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = f.EventType(); err != nil {
+			b.Fatal(err)
+		}
+		if _, err = f.ChannelType(); err != nil {
+			b.Fatal(err)
+		}
+		if err = f.DecodeData(&MessageKMarkdownEvent{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestFrameFieldErrors(t *testing.T) {
+	cases := []struct {
+		data  string
+		field string
+	}{
+		{`{"s":"0","d":{}}`, "s"},
+		{`{"s":0,"sn":1.5,"d":{}}`, "sn"},
+		{`{"s":0,"d":"x"}`, "d"},
+		{`{"s":0,"d":{"type":"9","channel_type":"GROUP"}}`, "d.type"},
+		{`{"s":0,"d":{"type":9.5,"channel_type":"GROUP"}}`, "d.type"},
+		{`{"s":0,"d":{"channel_type":"GROUP"}}`, "d.type"},
+		{`{"s":0,"d":{"type":9,"channel_type":1}}`, "d.channel_type"},
+		{`{"s":0,"d":{"type":9}}`, "d.channel_type"},
 	}
-	if f.Data["type"] != "" {
-		t.Error("type is not empty")
+	for _, c := range cases {
+		for _, decodeData := range []bool{true, false} {
+			var err error
+			lazy, err := NewLazyFrame([]byte(c.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := lazy.FrameMap(decodeData)
+			if err == nil {
+				if _, err = f.EventType(); err == nil {
+					_, err = f.ChannelType()
+				}
+			}
+			var frameErr *FrameError
+			if !errors.As(err, &frameErr) || frameErr.Field != c.field {
+				t.Fatalf("%s decodeData %v: expect error of %s, got %v", c.data, decodeData, c.field, err)
+			}
+		}
 	}
 }
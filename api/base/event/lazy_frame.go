@@ -0,0 +1,200 @@
+package event
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/bytedance/sonic"
+	"github.com/bytedance/sonic/ast"
+)
+
+var ErrNoFrameData = errors.New("frame has no d field")
+
+// LazyFrame 基于sonic ast的frame，只解析用到的字段，d按需直接解码到目标结构体，不经过map[string]interface{}
+// 引用原始数据，调用方不能再修改传入的data
+// ast.Node按需解析时会修改自身，不能并发读取，异步分发时多个handler共享同一个frame，所以方法都在lock中访问root
+type LazyFrame struct {
+	root ast.Node
+	lock sync.Mutex
+}
+
+// NewLazyFrame 校验data是合法的json对象，不做完整解码
+func NewLazyFrame(data []byte) (*LazyFrame, error) {
+	root, err := sonic.Get(data)
+	if err != nil {
+		return nil, &FrameError{Reason: "invalid json", Err: err}
+	}
+	if root.TypeSafe() != ast.V_OBJECT {
+		return nil, &FrameError{Reason: "not a json object"}
+	}
+	return &LazyFrame{root: root}, nil
+}
+
+// SignalType 返回s，没有s时为SIG_EVENT
+func (f *LazyFrame) SignalType() (int32, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.signalType()
+}
+
+func (f *LazyFrame) signalType() (int32, error) {
+	v, _, err := int64Field(f.root.Get("s"), "s")
+	if err != nil {
+		return 0, err
+	}
+	if v < math.MinInt32 || v > math.MaxInt32 {
+		return 0, &FrameError{Field: "s", Reason: fmt.Sprintf("%d out of range", v)}
+	}
+	return int32(v), nil
+}
+
+// SerialNumber 返回sn，没有sn时为0
+func (f *LazyFrame) SerialNumber() (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.serialNumber()
+}
+
+func (f *LazyFrame) serialNumber() (int64, error) {
+	v, _, err := int64Field(f.root.Get("sn"), "sn")
+	return v, err
+}
+
+// Data 返回d对应的节点，不存在时Exists()为false
+// 返回的节点与frame共享，不能在多个handler中并发使用，并发读取请使用DataValue、RawData或DecodeData
+func (f *LazyFrame) Data() *ast.Node {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.data()
+}
+
+func (f *LazyFrame) data() *ast.Node {
+	return f.root.Get("d")
+}
+
+// RawData 返回d的原始json
+func (f *LazyFrame) RawData() (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.rawData()
+}
+
+func (f *LazyFrame) rawData() (string, error) {
+	d := f.data()
+	if !d.Exists() {
+		return "", ErrNoFrameData
+	}
+	return d.Raw()
+}
+
+// EventType 返回d.type，不存在或者不是整数时返回FrameError
+func (f *LazyFrame) EventType() (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	v, ok, err := int64Field(f.data().Get("type"), "d.type")
+	if err == nil && !ok {
+		err = &FrameError{Field: "d.type", Reason: "missing"}
+	}
+	return v, err
+}
+
+// ChannelType 返回d.channel_type，兼容旧的channelType，都不存在或者不是字符串时返回FrameError
+func (f *LazyFrame) ChannelType() (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, key := range []string{"channel_type", "channelType"} {
+		node := f.data().Get(key)
+		if !node.Exists() {
+			continue
+		}
+		if node.TypeSafe() != ast.V_STRING {
+			return "", &FrameError{Field: "d." + key, Reason: fmt.Sprintf("want string, got json type %d", node.TypeSafe())}
+		}
+		return node.String()
+	}
+	return "", &FrameError{Field: "d.channel_type", Reason: "missing"}
+}
+
+// DataValue 返回d中key对应的值，类型与解码到map[string]interface{}时相同
+func (f *LazyFrame) DataValue(key string) (interface{}, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	node := f.data().Get(key)
+	if !node.Exists() {
+		return nil, false
+	}
+	v, err := node.Interface()
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// DecodeData 把d直接解码到v
+func (f *LazyFrame) DecodeData(v interface{}) error {
+	raw, err := f.RawData()
+	if err != nil {
+		return err
+	}
+	return sonic.UnmarshalString(raw, v)
+}
+
+func (f *LazyFrame) decodeData(v interface{}) error {
+	raw, err := f.rawData()
+	if err != nil {
+		return err
+	}
+	return sonic.UnmarshalString(raw, v)
+}
+
+// FrameMap 返回对应的FrameMap，decodeData为false时不解码Data，handler通过FrameMap的方法读取d
+// decodeData为true时d在NewLazyFrame的语法检查之外再完整解码一次，兼容直接读取Data的handler；
+// 这仍然比原来解码为map后再序列化到结构体少一次编解码，见BenchmarkLazyFrameDecodeData与BenchmarkFrameMap
+func (f *LazyFrame) FrameMap(decodeData bool) (*FrameMap, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	frame := &FrameMap{lazy: f}
+	var err error
+	if frame.SignalType, err = f.signalType(); err != nil {
+		return nil, err
+	}
+	if frame.SerialNumber, err = f.serialNumber(); err != nil {
+		return nil, err
+	}
+	d := f.data()
+	if !d.Exists() || d.TypeSafe() == ast.V_NULL {
+		return frame, nil
+	}
+	if d.TypeSafe() != ast.V_OBJECT {
+		return nil, &FrameError{Field: "d", Reason: fmt.Sprintf("want object, got json type %d", d.TypeSafe())}
+	}
+	if decodeData {
+		if err = f.decodeData(&frame.Data); err != nil {
+			return nil, &FrameError{Field: "d", Reason: "invalid object", Err: err}
+		}
+	}
+	return frame, nil
+}
+
+// int64Field 读取整数字段，不存在或为null时ok为false，不是整数时返回FrameError
+// 不使用node.Int64，它会把字符串等类型也转换为整数
+func int64Field(node *ast.Node, field string) (int64, bool, error) {
+	if !node.Exists() || node.TypeSafe() == ast.V_NULL {
+		return 0, false, nil
+	}
+	if node.TypeSafe() != ast.V_NUMBER {
+		return 0, false, &FrameError{Field: field, Reason: fmt.Sprintf("want integer, got json type %d", node.TypeSafe())}
+	}
+	raw, err := node.Raw()
+	if err != nil {
+		return 0, false, &FrameError{Field: field, Reason: "invalid number", Err: err}
+	}
+	v, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return 0, false, &FrameError{Field: field, Reason: "not an int64", Err: err}
+	}
+	return v, true, nil
+}
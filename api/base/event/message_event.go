@@ -2,7 +2,7 @@ package event
 
 type MessageTextEventFrame struct {
 	Frame
-	data *MessageTextEvent `json:"d"`
+	Data *MessageTextEvent `json:"d"`
 }
 
 type MessageTextEvent struct {
@@ -38,7 +38,7 @@ type User struct {
 
 type MessageKMarkdownEvent struct {
 	BaseEvent
-	KMarkdownExtra `json:"extra"'`
+	KMarkdownExtra `json:"extra"`
 }
 
 type TagInfo struct {
@@ -42,3 +42,30 @@ type ResumeACKSignal struct {
 type ResumeACKData struct {
 	SessionId string `json:"session_id"`
 }
+
+type NAckSignal struct {
+	Frame
+	Data *NAckData `json:"d"`
+}
+
+type NAckData struct {
+	SnList []int64 `json:"sn_list"`
+}
+
+// OutboundSignal 客户端发送给服务端的signal，json序列化后作为payload
+type OutboundSignal interface {
+	GetSignalType() int32
+}
+
+func NewPingSignal(sn int64) *PingSignal {
+	return &PingSignal{Frame: Frame{SignalType: SIG_PING}, SerialNumber: sn}
+}
+
+func NewResumeSignal(sn int64) *ResumeSignal {
+	return &ResumeSignal{Frame: Frame{SignalType: SIG_RESUME}, SerialNumber: sn}
+}
+
+// NewNAckSignal 请求服务端重发sns对应的事件
+func NewNAckSignal(sns []int64) *NAckSignal {
+	return &NAckSignal{Frame: Frame{SignalType: SIG_NACK}, Data: &NAckData{SnList: sns}}
+}
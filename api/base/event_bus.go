@@ -0,0 +1,33 @@
+package base
+
+import (
+	"github.com/gookit/event"
+	"sync"
+)
+
+// eventBusLock session通过event的全局Manager注册和分发事件
+// Manager注册handler时直接修改map，和异步handler中的分发并发会产生data race；
+// 注册时加写锁，分发时加读锁，所以handler中不能调用Session.On，handler执行期间注册会等待handler返回
+var eventBusLock sync.RWMutex
+
+func busOn(name string, listener event.Listener) {
+	eventBusLock.Lock()
+	defer eventBusLock.Unlock()
+	event.On(name, listener)
+}
+
+func busTrigger(name string, params event.M) (error, event.Event) {
+	eventBusLock.RLock()
+	defer eventBusLock.RUnlock()
+	return event.Trigger(name, params)
+}
+
+func busFireEvent(e event.Event) error {
+	eventBusLock.RLock()
+	defer eventBusLock.RUnlock()
+	return event.FireEvent(e)
+}
+
+func busAsyncFire(e event.Event) {
+	go busFireEvent(e)
+}
@@ -0,0 +1,318 @@
+package base
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrQueueClosed = errors.New("frame queue closed")
+
+// fileQueueCompactLines 日志中的Ack记录超过该数量时尝试重写日志
+const fileQueueCompactLines = 1000
+
+// FrameQueue webhook收到的事件在应答服务端后写入队列，由worker异步处理
+type FrameQueue interface {
+	// Push 写入一个事件，返回nil后事件不会丢失(内存队列除外)
+	Push(data []byte) error
+	// Pop 阻塞取出下一个事件，队列关闭后返回ErrQueueClosed
+	Pop() (id uint64, data []byte, err error)
+	// Ack 事件处理完成，未Ack的事件在进程重启后会重新处理
+	Ack(id uint64) error
+	// Nack 事件处理失败，delay后重新交给Pop；内存队列Close后等待重试的事件会丢失
+	Nack(id uint64, delay time.Duration) error
+	Close() error
+}
+
+type queueItem struct {
+	id   uint64
+	data []byte
+}
+
+// MemoryFrameQueue 内存中的事件队列，进程退出后未处理的事件会丢失，所以Close后Pop会先取完剩余的事件
+type MemoryFrameQueue struct {
+	pending []queueItem
+	// popped 已经Pop还没有Ack的事件，Nack时重新放回队列
+	popped map[uint64][]byte
+	nextId uint64
+	closed bool
+	// stopOnClose Close后Pop立即返回ErrQueueClosed，剩余的事件由持久化的实现在重启后处理
+	stopOnClose bool
+	lock        sync.Mutex
+	cond        *sync.Cond
+}
+
+func NewMemoryFrameQueue() *MemoryFrameQueue {
+	q := &MemoryFrameQueue{nextId: 1, popped: make(map[uint64][]byte)}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+func (q *MemoryFrameQueue) Push(data []byte) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	q.push(data)
+	return nil
+}
+
+func (q *MemoryFrameQueue) push(data []byte) uint64 {
+	id := q.nextId
+	q.nextId++
+	q.pending = append(q.pending, queueItem{id: id, data: data})
+	q.cond.Signal()
+	return id
+}
+
+func (q *MemoryFrameQueue) Pop() (uint64, []byte, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for {
+		if q.closed && (q.stopOnClose || len(q.pending) == 0) {
+			return 0, nil, ErrQueueClosed
+		}
+		if len(q.pending) > 0 {
+			break
+		}
+		q.cond.Wait()
+	}
+	item := q.pending[0]
+	q.pending[0] = queueItem{}
+	q.pending = q.pending[1:]
+	q.popped[item.id] = item.data
+	return item.id, item.data, nil
+}
+
+func (q *MemoryFrameQueue) Ack(id uint64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.popped, id)
+	return nil
+}
+
+func (q *MemoryFrameQueue) Nack(id uint64, delay time.Duration) error {
+	q.lock.Lock()
+	data, ok := q.popped[id]
+	delete(q.popped, id)
+	q.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	requeue := func() {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		if q.closed && q.stopOnClose {
+			// 持久化的实现中事件没有Ack，重启后会再次处理
+			return
+		}
+		q.pending = append(q.pending, queueItem{id: id, data: data})
+		q.cond.Signal()
+	}
+	if delay <= 0 {
+		requeue()
+	} else {
+		time.AfterFunc(delay, requeue)
+	}
+	return nil
+}
+
+// Len 等待处理的事件数量
+func (q *MemoryFrameQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.pending)
+}
+
+func (q *MemoryFrameQueue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+	return nil
+}
+
+// FileFrameQueue 基于追加日志的事件队列，Push后fsync，进程重启后重新处理没有Ack的事件
+// 日志中每行为 "P <id> <base64>" 或 "A <id>"，已确认的记录超过未确认的记录时重写日志
+type FileFrameQueue struct {
+	*MemoryFrameQueue
+	Path     string
+	file     *os.File
+	unacked  map[uint64][]byte
+	ackLines int
+	fileLock sync.Mutex
+}
+
+func NewFileFrameQueue(path string) (*FileFrameQueue, error) {
+	q := &FileFrameQueue{MemoryFrameQueue: NewMemoryFrameQueue(), Path: path, unacked: make(map[uint64][]byte)}
+	q.stopOnClose = true
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	// 重写日志，只保留未确认的事件
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// load 读取日志，按写入顺序恢复未确认的事件
+func (q *FileFrameQueue) load() error {
+	f, err := os.Open(q.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ids := make([]uint64, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		id, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch {
+		case fields[0] == "P" && len(fields) == 3:
+			data, err := base64.StdEncoding.DecodeString(fields[2])
+			if err != nil {
+				// 进程在写入时退出，最后一行可能不完整
+				continue
+			}
+			q.unacked[id] = data
+			ids = append(ids, id)
+		case fields[0] == "A":
+			delete(q.unacked, id)
+		}
+		if id >= q.nextId {
+			q.nextId = id + 1
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if data, ok := q.unacked[id]; ok {
+			q.pending = append(q.pending, queueItem{id: id, data: data})
+		}
+	}
+	return nil
+}
+
+func (q *FileFrameQueue) Push(data []byte) error {
+	q.fileLock.Lock()
+	defer q.fileLock.Unlock()
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return ErrQueueClosed
+	}
+	id := q.nextId
+	q.nextId++
+	q.lock.Unlock()
+
+	line := fmt.Sprintf("P %d %s\n", id, base64.StdEncoding.EncodeToString(data))
+	if _, err := q.file.WriteString(line); err != nil {
+		return err
+	}
+	if err := q.file.Sync(); err != nil {
+		return err
+	}
+	q.unacked[id] = data
+
+	q.lock.Lock()
+	q.pending = append(q.pending, queueItem{id: id, data: data})
+	q.cond.Signal()
+	q.lock.Unlock()
+	return nil
+}
+
+// Ack 在Close之后调用会返回ErrQueueClosed，对应的事件在重启后会再次处理
+func (q *FileFrameQueue) Ack(id uint64) error {
+	q.fileLock.Lock()
+	defer q.fileLock.Unlock()
+	if q.file == nil {
+		return ErrQueueClosed
+	}
+	q.MemoryFrameQueue.Ack(id)
+	if _, ok := q.unacked[id]; !ok {
+		return nil
+	}
+	if _, err := q.file.WriteString(fmt.Sprintf("A %d\n", id)); err != nil {
+		return err
+	}
+	delete(q.unacked, id)
+	q.ackLines++
+	if q.ackLines > fileQueueCompactLines && q.ackLines > len(q.unacked) {
+		return q.compact()
+	}
+	return nil
+}
+
+// compact 用未确认的事件重写日志，先写临时文件再rename，成功后才切换到新文件
+func (q *FileFrameQueue) compact() error {
+	q.lock.Lock()
+	pending := make([]queueItem, len(q.pending))
+	copy(pending, q.pending)
+	q.lock.Unlock()
+
+	// 已经Pop但没有Ack的事件也需要保留
+	inQueue := make(map[uint64]bool, len(pending))
+	for _, item := range pending {
+		inQueue[item.id] = true
+	}
+	ids := make([]uint64, 0, len(q.unacked))
+	for id := range q.unacked {
+		if !inQueue[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var sb strings.Builder
+	for _, id := range ids {
+		sb.WriteString(fmt.Sprintf("P %d %s\n", id, base64.StdEncoding.EncodeToString(q.unacked[id])))
+	}
+	for _, item := range pending {
+		sb.WriteString(fmt.Sprintf("P %d %s\n", item.id, base64.StdEncoding.EncodeToString(item.data)))
+	}
+	// 写入失败时原文件保持打开，继续追加
+	if err := writeFileAtomic(q.Path, []byte(sb.String()), 0644); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(q.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file = f
+	q.ackLines = 0
+	return nil
+}
+
+func (q *FileFrameQueue) Close() error {
+	q.MemoryFrameQueue.Close()
+	q.fileLock.Lock()
+	defer q.fileLock.Unlock()
+	if q.file == nil {
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
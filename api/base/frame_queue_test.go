@@ -0,0 +1,68 @@
+package base
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileFrameQueueRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhook.queue")
+	q, err := NewFileFrameQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"f1", "f2", "f3"} {
+		if err = q.Push([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id, data, _ := q.Pop()
+	if string(data) != "f1" {
+		t.Fatalf("pop %s", data)
+	}
+	q.Ack(id)
+	// f2已经取出但是没有Ack，重启后需要重新处理
+	q.Pop()
+	q.Close()
+	if _, _, err = q.Pop(); !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("expect ErrQueueClosed, got %v", err)
+	}
+
+	q2, err := NewFileFrameQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q2.Close()
+	if q2.Len() != 2 {
+		t.Fatalf("len %d", q2.Len())
+	}
+	for _, want := range []string{"f2", "f3"} {
+		id, data, err := q2.Pop()
+		if err != nil || string(data) != want {
+			t.Fatalf("pop %s %v, want %s", data, err, want)
+		}
+		q2.Ack(id)
+	}
+	// 新写入的事件id不能和之前的重复
+	q2.Push([]byte("f4"))
+	id, _, _ = q2.Pop()
+	if id <= 3 {
+		t.Fatalf("id %d reused", id)
+	}
+}
+
+func TestMemoryFrameQueueDrainOnClose(t *testing.T) {
+	q := NewMemoryFrameQueue()
+	q.Push([]byte("f1"))
+	q.Close()
+	if err := q.Push([]byte("f2")); !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("expect ErrQueueClosed, got %v", err)
+	}
+	if _, data, err := q.Pop(); err != nil || string(data) != "f1" {
+		t.Fatalf("pop %s %v", data, err)
+	}
+	if _, _, err := q.Pop(); !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("expect ErrQueueClosed, got %v", err)
+	}
+}
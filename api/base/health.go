@@ -0,0 +1,214 @@
+package base
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/kaiheila/golang-bot/api/helper/logger"
+	"github.com/looplab/fsm"
+)
+
+var (
+	ErrWsConnectFail    = errors.New("websocket connect failed")
+	ErrHelloFail        = errors.New("hello failed")
+	ErrHeartbeatTimeout = errors.New("heartbeat timeout")
+	ErrServerReconnect  = errors.New("server requires reconnect")
+)
+
+var stateCodes = map[string]int{
+	StatusStart:       0,
+	StatusInit:        1,
+	StatusGateway:     2,
+	StatusWSConnected: 3,
+	StatusConnected:   4,
+	StatusRetry:       5,
+}
+
+// NewState 根据状态名称返回State
+func NewState(name string) State {
+	return State{Name: name, Code: stateCodes[name]}
+}
+
+// StateChangeHandler 状态变化回调，reason为导致状态变化的原因，正常流程时为nil
+// 回调在状态机中同步执行，不要在回调中阻塞或者触发新的状态变化
+type StateChangeHandler func(from, to State, reason error)
+
+// OnStateChange 注册状态变化回调
+func (s *StateSession) OnStateChange(handler StateChangeHandler) {
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	s.stateChangeHandlers = append(s.stateChangeHandlers, handler)
+}
+
+// setState 直接设置状态(不经过状态机事件)，同时通知状态变化
+func (s *StateSession) setState(state string, reason error) {
+	from := s.FSM.Current()
+	s.FSM.SetState(state)
+	s.notifyStateChange(from, state, reason)
+}
+
+// notifyStateChange 记录健康状态需要的数据，并通知所有状态变化回调
+func (s *StateSession) notifyStateChange(from, to string, reason error) {
+	s.logState.Store(to)
+	if reason != nil {
+		s.logger().Info("state change", "from", from, "to", to, "reason", reason)
+	} else {
+		s.logger().Info("state change", "from", from, "to", to)
+	}
+
+	s.healthLock.Lock()
+	if to == StatusConnected && from != StatusRetry {
+		s.connectedAt = time.Now()
+	} else if to != StatusConnected && to != StatusRetry {
+		s.connectedAt = time.Time{}
+	}
+	reconnect, resume := false, false
+	if (to == StatusInit || to == StatusGateway) && (from == StatusWSConnected || from == StatusConnected || from == StatusRetry) {
+		s.reconnectCount++
+		reconnect = true
+	}
+	var recovery *Recovery
+	if errors.As(reason, &recovery) {
+		s.lastRecovery = recovery.Path
+		if recovery.Path == RecoveryResume {
+			s.resumeCount++
+			resume = true
+		}
+	}
+	retryReason := s.retryReason
+	if to == StatusRetry {
+		s.retryReason = reason
+	}
+	handlers := s.stateChangeHandlers
+	s.healthLock.Unlock()
+
+	m := s.metrics()
+	m.StateChanged(to)
+	if reconnect {
+		m.Reconnect(reasonLabel(reason))
+	}
+	if resume {
+		// resume成功时的reason只记录了恢复方式，原因取进入retry时的reason
+		m.Resume(reasonLabel(retryReason))
+	}
+
+	for _, handler := range handlers {
+		handler(NewState(from), NewState(to), reason)
+	}
+}
+
+// eventReason 从状态机事件参数中取出导致状态变化的原因
+func eventReason(e *fsm.Event) error {
+	for _, arg := range e.Args {
+		if err, ok := arg.(error); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// Health 连接的健康状态快照
+type Health struct {
+	State      string
+	SessionId  string
+	LastPingAt time.Time
+	LastPongAt time.Time
+	// RTT 最近一次心跳的往返时间，更多统计见StateSession.RTTStats
+	RTT            time.Duration
+	MaxSn          int64
+	ReconnectCount int64
+	ResumeCount    int64
+	// DecompressLimitCount 解压后超过限制而被丢弃的消息数
+	DecompressLimitCount int64
+	// FrameErrorCount 格式不正确而被丢弃的frame数
+	FrameErrorCount int64
+	// LastRecovery 最近一次心跳异常后连接恢复的方式
+	LastRecovery RecoveryPath
+	// Uptime 本次连接建立(进入connected状态)到现在的时间，未连接时为0
+	Uptime time.Duration
+	// Alive session还在运行，心跳检测没有卡住
+	Alive bool
+	// Ready 已经连接，可以收发事件
+	Ready bool
+}
+
+// Health 返回当前连接的健康状态
+func (s *StateSession) Health() Health {
+	h := Health{State: s.FSM.Current()}
+	h.SessionId, h.MaxSn = s.ackedSession()
+	h.RTT = s.RTTStats().Last
+	h.DecompressLimitCount = s.DecompressLimitCount()
+	h.FrameErrorCount = s.FrameErrorCount()
+	s.healthLock.RLock()
+	h.LastPingAt = s.LastPingAt
+	h.LastPongAt = s.LastPongAt
+	h.ReconnectCount = s.reconnectCount
+	h.ResumeCount = s.resumeCount
+	h.LastRecovery = s.lastRecovery
+	if !s.connectedAt.IsZero() {
+		h.Uptime = time.Since(s.connectedAt)
+	}
+	s.healthLock.RUnlock()
+
+	h.Ready = h.State == StatusConnected
+	h.Alive = s.ctx.Err() == nil
+	// 已连接但是长时间没有收到pong，说明心跳检测没有正常工作
+	if h.Ready && !h.LastPongAt.IsZero() && time.Since(h.LastPongAt) > 3*s.ReconnectPolicy().HeartbeatInterval {
+		h.Alive = false
+	}
+	return h
+}
+
+// MarshalJSON 时间间隔以毫秒输出
+func (h Health) MarshalJSON() ([]byte, error) {
+	return sonic.Marshal(map[string]interface{}{
+		"state":                  h.State,
+		"session_id":             h.SessionId,
+		"last_ping_at":           h.LastPingAt,
+		"last_pong_at":           h.LastPongAt,
+		"rtt_ms":                 h.RTT.Milliseconds(),
+		"max_sn":                 h.MaxSn,
+		"reconnect_count":        h.ReconnectCount,
+		"resume_count":           h.ResumeCount,
+		"decompress_limit_count": h.DecompressLimitCount,
+		"frame_error_count":      h.FrameErrorCount,
+		"last_recovery":          h.LastRecovery,
+		"uptime_ms":              h.Uptime.Milliseconds(),
+		"alive":                  h.Alive,
+		"ready":                  h.Ready,
+	})
+}
+
+// LivenessHandler 用于kubernetes livenessProbe，session停止或心跳检测卡住时返回503
+func (s *StateSession) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := s.Health()
+		writeHealth(w, h, h.Alive, s.logger())
+	})
+}
+
+// ReadinessHandler 用于kubernetes readinessProbe，未处于connected状态时返回503
+func (s *StateSession) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := s.Health()
+		writeHealth(w, h, h.Ready, s.logger())
+	})
+}
+
+func writeHealth(w http.ResponseWriter, h Health, ok bool, l logger.Logger) {
+	data, err := sonic.Marshal(h)
+	if err != nil {
+		l.Error("marshal health error", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(data)
+}
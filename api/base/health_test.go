@@ -0,0 +1,98 @@
+package base
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	event2 "github.com/kaiheila/golang-bot/api/base/event"
+	"github.com/kaiheila/golang-bot/api/helper/logger"
+)
+
+func TestStateChangeAndHealth(t *testing.T) {
+	s := NewStateSession("", 0, 0, "", 0)
+	defer s.Stop()
+	var gotFrom, gotTo State
+	var gotReason error
+	s.OnStateChange(func(from, to State, reason error) {
+		gotFrom, gotTo, gotReason = from, to, reason
+	})
+
+	s.setState(StatusConnected, nil)
+	if gotTo.Name != StatusConnected || gotTo.Code != 4 {
+		t.Errorf("unexpected to state %+v", gotTo)
+	}
+	rec := httptest.NewRecorder()
+	s.ReadinessHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected ready, got %d", rec.Code)
+	}
+
+	s.setState(StatusInit, ErrServerReconnect)
+	if gotFrom.Name != StatusConnected || !errors.Is(gotReason, ErrServerReconnect) {
+		t.Errorf("unexpected change %+v -> %+v, reason %v", gotFrom, gotTo, gotReason)
+	}
+	h := s.Health()
+	if h.ReconnectCount != 1 || h.Ready || h.Uptime != 0 {
+		t.Errorf("unexpected health %+v", h)
+	}
+	rec = httptest.NewRecorder()
+	s.ReadinessHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected not ready, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	s.LivenessHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected alive, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSessionLogContext(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := logger.NewSlog(slog.New(slog.NewTextHandler(buf, nil)))
+	s := NewStateSession("", 0, 0, "", 0, WithLogger(l))
+	defer s.Stop()
+	s.NetworkProxy = &fakeNetworkProxy{sendErr: errors.New("broken pipe")}
+	s.SaveSessionId("s1")
+	s.setState(StatusConnected, nil)
+	if !strings.Contains(buf.String(), `msg="state change" session_id=s1 state=connected from=start to=connected`) {
+		t.Fatalf("unexpected log %q", buf.String())
+	}
+	buf.Reset()
+	s.NAck([]int64{2})
+	if !strings.Contains(buf.String(), `session_id=s1 state=connected err="broken pipe" sn_list=[2]`) {
+		t.Fatalf("unexpected log %q", buf.String())
+	}
+}
+
+func TestHealthConcurrent(t *testing.T) {
+	s := NewStateSession("", 0, 0, "", 0)
+	defer s.Stop()
+	s.NetworkProxy = &fakeNetworkProxy{}
+	s.setState(StatusConnected, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			s.markPing()
+			s.receivePong(nil)
+			s.SaveSessionId("s1")
+			s.beginFrame(&event2.FrameMap{SerialNumber: int64(i + 1)})
+			s.ackFrame(&event2.FrameMap{SerialNumber: int64(i + 1)})
+		}
+	}()
+	// 用-race运行时检查健康检查接口与心跳、确认sn之间没有数据竞争
+	for i := 0; i < 50; i++ {
+		rec := httptest.NewRecorder()
+		s.LivenessHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	}
+	<-done
+	if h := s.Health(); h.MaxSn != 50 || h.LastPongAt.Before(h.LastPingAt) {
+		t.Errorf("unexpected health %+v", h)
+	}
+}
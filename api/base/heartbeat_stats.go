@@ -0,0 +1,135 @@
+package base
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultRTTWindow 默认保留最近多少次心跳的RTT
+const DefaultRTTWindow = 64
+
+var ErrRTTSpike = errors.New("heartbeat rtt spike")
+
+// AdaptiveHeartbeat 根据最近的RTT自适应调整pong超时时间，RTT突增时提前进入retry状态
+type AdaptiveHeartbeat struct {
+	// MinSamples RTT样本数达到后才开始自适应
+	MinSamples int
+	// TimeoutMultiplier pong超时时间为p99 RTT的倍数
+	TimeoutMultiplier float64
+	// MinPongTimeout 自适应后pong超时时间的下限，上限为ReconnectPolicy.PongTimeout
+	MinPongTimeout time.Duration
+	// SpikeMultiplier 单次RTT超过平均值的倍数时认为连接异常
+	SpikeMultiplier float64
+}
+
+// DefaultAdaptiveHeartbeat 默认的自适应心跳参数
+func DefaultAdaptiveHeartbeat() *AdaptiveHeartbeat {
+	return &AdaptiveHeartbeat{
+		MinSamples:        8,
+		TimeoutMultiplier: 4,
+		MinPongTimeout:    2 * time.Second,
+		SpikeMultiplier:   10,
+	}
+}
+
+// RTTStats 心跳往返时间统计
+type RTTStats struct {
+	Count int
+	Last  time.Duration
+	Min   time.Duration
+	Avg   time.Duration
+	P99   time.Duration
+}
+
+// rttRing 固定大小的环形缓冲区，保存最近的RTT
+type rttRing struct {
+	samples []time.Duration
+	next    int
+	full    bool
+	last    time.Duration
+	lock    sync.Mutex
+}
+
+func newRTTRing(size int) *rttRing {
+	if size <= 0 {
+		size = DefaultRTTWindow
+	}
+	return &rttRing{samples: make([]time.Duration, size)}
+}
+
+func (r *rttRing) add(rtt time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.samples[r.next] = rtt
+	r.last = rtt
+	r.next++
+	if r.next == len(r.samples) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+func (r *rttRing) stats() RTTStats {
+	r.lock.Lock()
+	n := r.next
+	if r.full {
+		n = len(r.samples)
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, r.samples[:n])
+	last := r.last
+	r.lock.Unlock()
+
+	st := RTTStats{Count: n, Last: last}
+	if n == 0 {
+		return st
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+	st.Min = sorted[0]
+	st.Avg = sum / time.Duration(n)
+	st.P99 = sorted[(n*99-1)/100]
+	return st
+}
+
+// RTTStats 返回最近心跳的往返时间统计
+func (s *StateSession) RTTStats() RTTStats {
+	return s.rtt.stats()
+}
+
+// pongTimeout 当前生效的pong超时时间，开启自适应且样本足够时按p99 RTT收紧
+func (s *StateSession) pongTimeout() time.Duration {
+	policy := s.ReconnectPolicy()
+	adaptive := policy.Adaptive
+	if adaptive == nil {
+		return policy.PongTimeout
+	}
+	st := s.rtt.stats()
+	if st.Count < adaptive.MinSamples {
+		return policy.PongTimeout
+	}
+	timeout := time.Duration(float64(st.P99) * adaptive.TimeoutMultiplier)
+	if timeout < adaptive.MinPongTimeout {
+		timeout = adaptive.MinPongTimeout
+	}
+	if timeout > policy.PongTimeout {
+		timeout = policy.PongTimeout
+	}
+	return timeout
+}
+
+// recordRTT 记录一次RTT，返回是否为突增(开启自适应时)
+func (s *StateSession) recordRTT(rtt time.Duration) bool {
+	spike := false
+	if adaptive := s.ReconnectPolicy().Adaptive; adaptive != nil {
+		st := s.rtt.stats()
+		spike = st.Count >= adaptive.MinSamples && float64(rtt) > float64(st.Avg)*adaptive.SpikeMultiplier
+	}
+	s.rtt.add(rtt)
+	return spike
+}
@@ -0,0 +1,45 @@
+package base
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTRingStats(t *testing.T) {
+	r := newRTTRing(4)
+	for _, ms := range []int{50, 10, 20, 30, 40} {
+		r.add(time.Duration(ms) * time.Millisecond)
+	}
+	st := r.stats()
+	// 容量为4，最早的50ms已经被覆盖
+	if st.Count != 4 || st.Min != 10*time.Millisecond || st.P99 != 40*time.Millisecond {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	if st.Avg != 25*time.Millisecond || st.Last != 40*time.Millisecond {
+		t.Errorf("unexpected avg/last %+v", st)
+	}
+}
+
+func TestAdaptivePongTimeout(t *testing.T) {
+	s := NewStateSession("", 0, 0, "", 0)
+	defer s.Stop()
+	policy := DefaultReconnectPolicy()
+	policy.Adaptive = DefaultAdaptiveHeartbeat()
+	if err := s.SetReconnectPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+	if s.pongTimeout() != policy.PongTimeout {
+		t.Error("timeout should not adapt before enough samples")
+	}
+	for i := 0; i < policy.Adaptive.MinSamples; i++ {
+		if s.recordRTT(100 * time.Millisecond) {
+			t.Error("stable rtt should not be a spike")
+		}
+	}
+	if s.pongTimeout() != policy.Adaptive.MinPongTimeout {
+		t.Errorf("expected timeout clamped to %s, got %s", policy.Adaptive.MinPongTimeout, s.pongTimeout())
+	}
+	if !s.recordRTT(2 * time.Second) {
+		t.Error("rtt 20x average should be a spike")
+	}
+}
@@ -0,0 +1,39 @@
+package base
+
+import (
+	"errors"
+
+	"github.com/kaiheila/golang-bot/api/metrics"
+)
+
+// WithMetrics 设置session的运行指标
+func WithMetrics(m metrics.Metrics) StateSessionOption {
+	return func(s *StateSession) {
+		s.Metrics = m
+	}
+}
+
+func (s *Session) metrics() metrics.Metrics {
+	return metrics.OrDefault(s.Metrics)
+}
+
+// reasonLabel 状态变化原因的简短名称，作为指标的label，避免错误信息导致label过多
+func reasonLabel(reason error) string {
+	switch {
+	case reason == nil:
+		return "none"
+	case errors.Is(reason, ErrResumeFail):
+		return "resume_fail"
+	case errors.Is(reason, ErrHeartbeatTimeout):
+		return "heartbeat_timeout"
+	case errors.Is(reason, ErrRTTSpike):
+		return "rtt_spike"
+	case errors.Is(reason, ErrServerReconnect):
+		return "server_reconnect"
+	case errors.Is(reason, ErrWsConnectFail):
+		return "ws_connect_fail"
+	case errors.Is(reason, ErrHelloFail):
+		return "hello_fail"
+	}
+	return "other"
+}
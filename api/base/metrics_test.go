@@ -0,0 +1,59 @@
+package base
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordMetrics struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (r *recordMetrics) add(format string, args ...interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func (r *recordMetrics) FrameReceived(signalType int32) { r.add("frame %d", signalType) }
+func (r *recordMetrics) FrameError(kind string)         { r.add("error %s", kind) }
+func (r *recordMetrics) HandlerDone(eventName string, d time.Duration, err error) {
+	r.add("handler %s %v", eventName, err)
+}
+func (r *recordMetrics) Reconnect(reason string)      { r.add("reconnect %s", reason) }
+func (r *recordMetrics) Resume(reason string)         { r.add("resume %s", reason) }
+func (r *recordMetrics) HeartbeatRTT(d time.Duration) { r.add("rtt") }
+func (r *recordMetrics) StateChanged(state string)    { r.add("state %s", state) }
+func (r *recordMetrics) APIRequest(endpoint string, status int, d time.Duration) {
+	r.add("api %s %d", endpoint, status)
+}
+func (r *recordMetrics) RateLimitWait(endpoint string, d time.Duration) { r.add("wait %s", endpoint) }
+
+func TestSessionMetrics(t *testing.T) {
+	m := &recordMetrics{}
+	s := &Session{Metrics: m, EventSyncHandle: true}
+	s.ReceiveData([]byte(`{"s":0,"sn":1,"d":{"type":9,"channel_type":"METRICSTEST","msg_id":"m1"}}`))
+	s.ReceiveData([]byte(`{"s":0,"sn":2,"d":{"type":"9","channel_type":"METRICSTEST"}}`))
+	s.ReceiveData([]byte(`not json`))
+	want := "[frame 0 handler METRICSTEST_9 <nil> frame 0 error frame error frame]"
+	if got := fmt.Sprint(m.events); got != want {
+		t.Fatalf("events %s, want %s", got, want)
+	}
+}
+
+func TestStateMetrics(t *testing.T) {
+	m := &recordMetrics{}
+	s := NewStateSession("", 0, 0, "", 0, WithMetrics(m))
+	defer s.Stop()
+	s.setState(StatusConnected, nil)
+	s.setState(StatusRetry, ErrHeartbeatTimeout)
+	s.setState(StatusConnected, &Recovery{Path: RecoveryResume})
+	s.setState(StatusInit, ErrServerReconnect)
+	want := "[state connected state retry state connected resume heartbeat_timeout state init reconnect server_reconnect]"
+	if got := fmt.Sprint(m.events); got != want {
+		t.Fatalf("events %s, want %s", got, want)
+	}
+}
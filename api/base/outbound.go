@@ -0,0 +1,92 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bytedance/sonic"
+	event2 "github.com/kaiheila/golang-bot/api/base/event"
+	"github.com/kaiheila/golang-bot/api/helper/compress"
+)
+
+var ErrBinaryNotSupported = errors.New("network proxy does not support binary data")
+
+// BinarySender NetworkProxy可选实现的接口，带header或压缩后的signal需要以二进制消息发送
+type BinarySender interface {
+	SendBinary(data []byte) error
+}
+
+// WithOutboundCompress 发送的signal也使用协商的压缩方式，默认只压缩服务端下发的数据
+func WithOutboundCompress(enable bool) StateSessionOption {
+	return func(s *StateSession) {
+		s.OutboundCompress = enable
+	}
+}
+
+// resetCompressor 流式压缩的上下文和连接绑定，每次连接都需要新的压缩器
+func (s *StateSession) resetCompressor() {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	if s.Compressor != nil {
+		compress.RecycleCompressor(s.CompressType, s.Compressor)
+		s.Compressor = nil
+	}
+	if !s.OutboundCompress || s.Compressed != 1 || s.CompressType == compress.CompressTypeNone {
+		return
+	}
+	c, err := compress.GetCompressorWithDict(s.CompressType, s.CompressDictVersion)
+	if err != nil {
+		s.logger().Error("get compressor failed, send signal without compression", "err", err)
+		return
+	}
+	s.Compressor = c
+}
+
+// encodeSignal 按协商的header版本和压缩方式编码signal，binary表示需要以二进制消息发送
+func (s *StateSession) encodeSignal(sig event2.OutboundSignal) (data []byte, binary bool, err error) {
+	data, err = sonic.Marshal(sig)
+	if err != nil {
+		return nil, false, err
+	}
+	if s.Compressor != nil {
+		data, err = s.Compressor.Compress(data)
+		if err != nil {
+			return nil, false, fmt.Errorf("compress signal: %w", err)
+		}
+		binary = true
+	}
+	if s.HeaderVersion > 0 {
+		baseSignal := event2.NewBaseSignal(int(sig.GetSignalType()), s.HeaderVersion, false)
+		baseSignal.WithPayload(data)
+		data, err = baseSignal.Encode()
+		if err != nil {
+			return nil, false, err
+		}
+		binary = true
+	}
+	return data, binary, nil
+}
+
+// sendSignal 所有发送给服务端的signal都经过这里，编码和发送在同一把锁内，保证流式压缩的顺序
+func (s *StateSession) sendSignal(sig event2.OutboundSignal) error {
+	if s.NetworkProxy == nil {
+		return nil
+	}
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	data, binary, err := s.encodeSignal(sig)
+	if err != nil {
+		s.logger().Error("encode signal fail", "err", err, "s", sig.GetSignalType())
+		return err
+	}
+	if !binary {
+		s.logger().Debug("Send signal", "s", sig.GetSignalType(), "frame", string(data))
+		return s.NetworkProxy.SendData(data)
+	}
+	s.logger().Debug("Send binary signal", "s", sig.GetSignalType(), "len", len(data))
+	sender, ok := s.NetworkProxy.(BinarySender)
+	if !ok {
+		return ErrBinaryNotSupported
+	}
+	return sender.SendBinary(data)
+}
@@ -0,0 +1,95 @@
+package base
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	event2 "github.com/kaiheila/golang-bot/api/base/event"
+	"github.com/kaiheila/golang-bot/api/helper/compress"
+)
+
+type fakeBinaryProxy struct {
+	fakeNetworkProxy
+	binary [][]byte
+}
+
+func (f *fakeBinaryProxy) SendBinary(data []byte) error {
+	f.binary = append(f.binary, data)
+	return f.sendErr
+}
+
+func TestSendSignalText(t *testing.T) {
+	proxy := &fakeBinaryProxy{}
+	s := NewStateSession("", 0, 0, "", 0)
+	defer s.Stop()
+	s.NetworkProxy = proxy
+	if err := s.NAck([]int64{3, 5}); err != nil {
+		t.Fatal(err)
+	}
+	if len(proxy.sent) != 1 || len(proxy.binary) != 0 {
+		t.Fatalf("sent %q binary %q", proxy.sent, proxy.binary)
+	}
+	if string(proxy.sent[0]) != `{"s":7,"d":{"sn_list":[3,5]}}` {
+		t.Fatalf("unexpected nack %s", proxy.sent[0])
+	}
+}
+
+func TestSendSignalWithHeader(t *testing.T) {
+	cases := []struct {
+		name         string
+		compressType compress.CompressType
+		outbound     bool
+	}{
+		{"header", compress.CompressTypeZstdStream, false},
+		{"zlib", compress.CompressTypeZlibPerMessage, true},
+		{"zstd_stream", compress.CompressTypeZstdStream, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			proxy := &fakeBinaryProxy{}
+			s := NewStateSession("", 1, c.compressType, "", 1, WithOutboundCompress(c.outbound))
+			defer s.Stop()
+			s.NetworkProxy = proxy
+			s.resetCompressor()
+			decompressor := compress.GetDecompressor(c.compressType)
+			for _, sn := range []int64{1, 2} {
+				if err := s.sendSignal(event2.NewResumeSignal(sn)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(proxy.sent) != 0 || len(proxy.binary) != 2 {
+				t.Fatalf("sent %q binary %q", proxy.sent, proxy.binary)
+			}
+			for i, data := range proxy.binary {
+				sig, err := event2.Decode(data, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if sig.SignalType != int(event2.SIG_RESUME) {
+					t.Fatalf("signal type %d", sig.SignalType)
+				}
+				payload := sig.Payload
+				if c.outbound {
+					payload, err = decompressor.Decompress(payload)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				want := []byte(`{"s":4,"sn":` + string(rune('1'+i)) + `}`)
+				if !bytes.Equal(payload, want) {
+					t.Fatalf("got %s, want %s", payload, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSendSignalBinaryNotSupported(t *testing.T) {
+	s := NewStateSession("", 0, 0, "", 1)
+	defer s.Stop()
+	s.NetworkProxy = &fakeNetworkProxy{}
+	if err := s.sendSignal(event2.NewPingSignal(1)); !errors.Is(err, ErrBinaryNotSupported) {
+		t.Fatalf("expect ErrBinaryNotSupported, got %v", err)
+	}
+}
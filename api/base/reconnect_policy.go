@@ -0,0 +1,220 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// RetryParam 单个状态的重试参数
+type RetryParam struct {
+	// StartDelay 进入状态后第一次执行前的等待时间
+	StartDelay time.Duration
+	// FirstDelay 指数退避的初始间隔
+	FirstDelay time.Duration
+	// MaxDelay 指数退避的最大间隔
+	MaxDelay time.Duration
+	// Jitter 每次等待额外增加的随机时间上限，避免大量客户端同时重连
+	Jitter time.Duration
+	// Attempts 重试次数，NO_RETRY：只执行一次，RETRY_INFINIT：无限重试
+	Attempts int
+}
+
+// merge 用override中非0的字段覆盖当前参数
+func (p RetryParam) merge(override *RetryParam) RetryParam {
+	if override == nil {
+		return p
+	}
+	if override.StartDelay > 0 {
+		p.StartDelay = override.StartDelay
+	}
+	if override.FirstDelay > 0 {
+		p.FirstDelay = override.FirstDelay
+	}
+	if override.MaxDelay > 0 {
+		p.MaxDelay = override.MaxDelay
+	}
+	if override.Jitter > 0 {
+		p.Jitter = override.Jitter
+	}
+	if override.Attempts != 0 {
+		p.Attempts = override.Attempts
+	}
+	return p
+}
+
+// ReconnectPolicy StateSession的重试及心跳参数
+type ReconnectPolicy struct {
+	// States 各个状态的重试参数，key为StatusInit、StatusGateway、StatusRetry等
+	States map[string]RetryParam
+	// HeartbeatInterval 发送心跳包的间隔
+	HeartbeatInterval time.Duration
+	// PongTimeout 发送心跳包后等待pong的时间
+	PongTimeout time.Duration
+	// Adaptive 不为空时根据RTT自适应调整pong超时时间
+	Adaptive *AdaptiveHeartbeat
+	// PongCheckDelay pong超时后再等待该时间才检查是否收到pong，<=0时使用defaultPongCheckDelay
+	PongCheckDelay time.Duration
+	// CloseWait 重新连接前关闭旧连接后等待服务端释放连接的时间，<=0时使用defaultCloseWait
+	CloseWait time.Duration
+}
+
+const (
+	defaultPongCheckDelay = time.Second
+	defaultCloseWait      = 3 * time.Second
+)
+
+// DefaultReconnectPolicy 默认的重试及心跳参数
+func DefaultReconnectPolicy() *ReconnectPolicy {
+	return &ReconnectPolicy{
+		States: map[string]RetryParam{
+			StatusInit:        {StartDelay: 0, FirstDelay: time.Second, MaxDelay: 60 * time.Second, Attempts: RETRY_INFINIT},
+			StatusGateway:     {StartDelay: time.Second, FirstDelay: 2 * time.Second, MaxDelay: 32 * time.Second, Attempts: 2},
+			StatusWSConnected: {StartDelay: 6 * time.Second, Attempts: NO_RETRY},
+			StatusRetry:       {StartDelay: 0, FirstDelay: 4 * time.Second, MaxDelay: 8 * time.Second, Attempts: 2},
+		},
+		HeartbeatInterval: 30 * time.Second,
+		PongTimeout:       7 * time.Second,
+		PongCheckDelay:    defaultPongCheckDelay,
+		CloseWait:         defaultCloseWait,
+	}
+}
+
+// Validate 检查参数是否合法
+func (p *ReconnectPolicy) Validate() error {
+	if p == nil {
+		return errors.New("reconnect policy is nil")
+	}
+	if p.HeartbeatInterval <= 0 {
+		return errors.New("heartbeat interval must be positive")
+	}
+	if p.PongTimeout <= 0 {
+		return errors.New("pong timeout must be positive")
+	}
+	if p.PongTimeout >= p.HeartbeatInterval {
+		return fmt.Errorf("pong timeout %s must be less than heartbeat interval %s", p.PongTimeout, p.HeartbeatInterval)
+	}
+	if a := p.Adaptive; a != nil {
+		if a.MinSamples <= 0 || a.TimeoutMultiplier <= 0 || a.SpikeMultiplier <= 1 {
+			return errors.New("adaptive heartbeat requires positive min samples, timeout multiplier and spike multiplier > 1")
+		}
+		if a.MinPongTimeout <= 0 || a.MinPongTimeout > p.PongTimeout {
+			return fmt.Errorf("adaptive min pong timeout must be in (0, %s]", p.PongTimeout)
+		}
+	}
+	for _, state := range []string{StatusInit, StatusGateway, StatusRetry} {
+		if _, ok := p.States[state]; !ok {
+			return fmt.Errorf("retry param of state %s is missing", state)
+		}
+	}
+	for state, param := range p.States {
+		if param.StartDelay < 0 || param.FirstDelay < 0 || param.MaxDelay < 0 || param.Jitter < 0 {
+			return fmt.Errorf("retry param of state %s has negative duration", state)
+		}
+		if param.Attempts < NO_RETRY {
+			return fmt.Errorf("retry attempts of state %s must be >= %d", state, NO_RETRY)
+		}
+		if param.Attempts != NO_RETRY && param.MaxDelay < param.FirstDelay {
+			return fmt.Errorf("retry param of state %s: max delay %s is less than first delay %s", state, param.MaxDelay, param.FirstDelay)
+		}
+	}
+	return nil
+}
+
+// Clone 深拷贝，避免调用方修改已生效的参数
+func (p *ReconnectPolicy) Clone() *ReconnectPolicy {
+	c := *p
+	c.States = make(map[string]RetryParam, len(p.States))
+	for state, param := range p.States {
+		c.States[state] = param
+	}
+	if p.Adaptive != nil {
+		adaptive := *p.Adaptive
+		c.Adaptive = &adaptive
+	}
+	return &c
+}
+
+func (p *ReconnectPolicy) pongCheckDelay() time.Duration {
+	if p.PongCheckDelay <= 0 {
+		return defaultPongCheckDelay
+	}
+	return p.PongCheckDelay
+}
+
+func (p *ReconnectPolicy) closeWait() time.Duration {
+	if p.CloseWait <= 0 {
+		return defaultCloseWait
+	}
+	return p.CloseWait
+}
+
+// StateParam 返回指定状态的重试参数，没有配置的状态只执行一次
+func (p *ReconnectPolicy) StateParam(state string) RetryParam {
+	if param, ok := p.States[state]; ok {
+		return param
+	}
+	return RetryParam{Attempts: NO_RETRY}
+}
+
+// StatusParam 旧版的单个状态重试参数，时间单位为秒
+//
+// Deprecated: 使用ReconnectPolicy，StateSession.StatusParams中修改过的参数会在Start时合并到ReconnectPolicy
+type StatusParam struct {
+	StartTime  int
+	MaxTime    int
+	FirstDelay int
+	Retry      int
+	MaxRetry   int
+}
+
+// newStatusParam 把RetryParam转换为旧版参数，connected状态的MaxTime为心跳间隔
+func newStatusParam(state string, policy *ReconnectPolicy) StatusParam {
+	if state == StatusConnected {
+		interval := int(policy.HeartbeatInterval / time.Second)
+		return StatusParam{StartTime: interval, MaxTime: interval, MaxRetry: NO_RETRY}
+	}
+	param := policy.StateParam(state)
+	return StatusParam{
+		StartTime:  int(param.StartDelay / time.Second),
+		MaxTime:    int(param.MaxDelay / time.Second),
+		FirstDelay: int(param.FirstDelay / time.Second),
+		MaxRetry:   param.Attempts,
+	}
+}
+
+// retryParam 把旧版参数转换为RetryParam，旧版参数没有Jitter，沿用原来的值
+func (p *StatusParam) retryParam(jitter time.Duration) RetryParam {
+	return RetryParam{
+		StartDelay: time.Duration(p.StartTime) * time.Second,
+		FirstDelay: time.Duration(p.FirstDelay) * time.Second,
+		MaxDelay:   time.Duration(p.MaxTime) * time.Second,
+		Jitter:     jitter,
+		Attempts:   p.MaxRetry,
+	}
+}
+
+// jitter 返回[0, max)之间的随机时间
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// sleepContext 等待d时间，ctx取消时提前返回false
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
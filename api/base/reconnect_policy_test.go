@@ -0,0 +1,127 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReconnectPolicyValidate(t *testing.T) {
+	if err := DefaultReconnectPolicy().Validate(); err != nil {
+		t.Fatalf("default policy should be valid: %v", err)
+	}
+	p := DefaultReconnectPolicy()
+	p.PongTimeout = p.HeartbeatInterval
+	if p.Validate() == nil {
+		t.Error("pong timeout >= heartbeat interval should be invalid")
+	}
+	p = DefaultReconnectPolicy()
+	delete(p.States, StatusGateway)
+	if p.Validate() == nil {
+		t.Error("missing gateway state should be invalid")
+	}
+}
+
+func TestSetReconnectPolicy(t *testing.T) {
+	s := NewStateSession("", 0, 0, "", 0)
+	defer s.Stop()
+	p := DefaultReconnectPolicy()
+	p.HeartbeatInterval = 10 * time.Second
+	if err := s.SetReconnectPolicy(p); err != nil {
+		t.Fatal(err)
+	}
+	p.HeartbeatInterval = time.Second
+	if s.ReconnectPolicy().HeartbeatInterval != 10*time.Second {
+		t.Error("policy should be copied on set")
+	}
+	if s.SetReconnectPolicy(&ReconnectPolicy{}) == nil {
+		t.Error("invalid policy should be rejected")
+	}
+	if s.ReconnectPolicy().HeartbeatInterval != 10*time.Second {
+		t.Error("invalid policy should not replace current one")
+	}
+}
+
+type retryNetworkProxy struct {
+	fakeNetworkProxy
+	gateways atomic.Int32
+	connects atomic.Int32
+}
+
+func (f *retryNetworkProxy) ReqGateWay() (error, string) {
+	// 第一次失败，需要退避后重试
+	if f.gateways.Add(1) == 1 {
+		return errors.New("gateway unavailable"), ""
+	}
+	return nil, "wss://gateway.test"
+}
+
+func (f *retryNetworkProxy) ConnectWebsocket(gateway string) error {
+	f.connects.Add(1)
+	return errors.New("connect refused")
+}
+
+func TestRetryWithDefaultPolicy(t *testing.T) {
+	// 使用默认参数(Jitter为0)，只缩短等待时间
+	policy := DefaultReconnectPolicy()
+	for state, param := range policy.States {
+		param.StartDelay /= 1000
+		param.FirstDelay /= 1000
+		param.MaxDelay /= 1000
+		policy.States[state] = param
+	}
+	proxy := &retryNetworkProxy{fakeNetworkProxy: fakeNetworkProxy{sendErr: errors.New("broken pipe")}}
+	s := NewStateSession("", 0, 0, "", 0, WithReconnectPolicy(policy))
+	s.NetworkProxy = proxy
+	states := make(chan string, 16)
+	s.OnStateChange(func(from, to State, reason error) {
+		select {
+		case states <- to.Name:
+		default:
+		}
+	})
+	s.setState(StatusConnected, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// resume发送失败后重新连接，gateway状态连接失败时按退避重试，失败后回到init重新获取gateway
+		s.FSM.Event(context.Background(), EventHeartbeatTimeout, ErrHeartbeatTimeout)
+	}()
+	want := []string{StatusConnected, StatusRetry, StatusGateway, StatusInit, StatusGateway}
+	for i, name := range want {
+		select {
+		case got := <-states:
+			if got != name {
+				t.Fatalf("state %d: expected %s, got %s", i, name, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("state %d: timeout waiting for %s", i, name)
+		}
+	}
+	s.Stop()
+	<-done
+	if proxy.gateways.Load() != 2 || proxy.connects.Load() < 2 {
+		t.Errorf("gateway requests %d, connects %d", proxy.gateways.Load(), proxy.connects.Load())
+	}
+}
+
+func TestStatusParamsCompat(t *testing.T) {
+	s := NewStateSession("wss://gateway.test", 0, 0, "", 0)
+	defer s.Stop()
+	if s.Timeout != 7 || s.StatusParams[StatusConnected].MaxTime != 30 || s.StatusParams[StatusRetry].FirstDelay != 4 {
+		t.Fatalf("unexpected legacy params %d %+v", s.Timeout, s.StatusParams)
+	}
+	s.StatusParams[StatusConnected].MaxTime = 20
+	s.StatusParams[StatusInit].MaxTime = 10
+	s.Timeout = 5
+	s.applyStatusParams()
+	p := s.ReconnectPolicy()
+	if p.HeartbeatInterval != 20*time.Second || p.PongTimeout != 5*time.Second || p.States[StatusInit].MaxDelay != 10*time.Second {
+		t.Errorf("legacy params not applied: %+v", p)
+	}
+	if p.States[StatusGateway] != DefaultReconnectPolicy().States[StatusGateway] {
+		t.Errorf("unchanged state should keep policy param: %+v", p.States[StatusGateway])
+	}
+}
@@ -0,0 +1,322 @@
+package base
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/kaiheila/golang-bot/api/helper/compress"
+)
+
+const (
+	// RecordKindData 收到的一条原始数据
+	RecordKindData = "data"
+	// RecordKindConnect 建立了新的websocket连接，流式压缩的上下文从这里开始
+	RecordKindConnect = "connect"
+)
+
+// DefaultRecordMaxSize 录制文件超过该大小后轮转
+const DefaultRecordMaxSize = 64 << 20
+
+// Record 录制的一条数据，Data为解压前的原始数据
+type Record struct {
+	Time          time.Time `json:"t"`
+	Kind          string    `json:"kind"`
+	Compressed    int       `json:"compressed,omitempty"`
+	CompressType  string    `json:"compress_type,omitempty"`
+	HeaderVersion int       `json:"header_version,omitempty"`
+	// Encoding webhook请求的Content-Encoding
+	Encoding string `json:"encoding,omitempty"`
+	// SN 数据中解析出的事件sn，数据无法解析时为空
+	SN   []int64 `json:"sn,omitempty"`
+	Data []byte  `json:"data,omitempty"`
+}
+
+// Recorder 录制session收到的原始数据，用于离线回放
+type Recorder interface {
+	Record(rec *Record) error
+}
+
+// FileRecorder 按行写入json的录制文件，超过MaxSize后轮转为path.1、path.2...，最多保留MaxFiles个旧文件
+type FileRecorder struct {
+	Path     string
+	MaxSize  int64
+	MaxFiles int
+	file     *os.File
+	size     int64
+	lock     sync.Mutex
+}
+
+func NewFileRecorder(path string, maxSize int64, maxFiles int) (*FileRecorder, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultRecordMaxSize
+	}
+	r := &FileRecorder{Path: path, MaxSize: maxSize, MaxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *FileRecorder) open() error {
+	f, err := os.OpenFile(r.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size = f, info.Size()
+	return nil
+}
+
+func (r *FileRecorder) Record(rec *Record) error {
+	line, err := sonic.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return os.ErrClosed
+	}
+	if r.size > 0 && r.size+int64(len(line)) > r.MaxSize {
+		if err = r.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	return err
+}
+
+// rotate path.N-1重命名为path.N，当前文件重命名为path.1
+func (r *FileRecorder) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file = nil
+	if r.MaxFiles <= 0 {
+		if err := os.Remove(r.Path); err != nil {
+			return err
+		}
+		return r.open()
+	}
+	for i := r.MaxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(rotatedPath(r.Path, i), rotatedPath(r.Path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(r.Path, rotatedPath(r.Path, 1)); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *FileRecorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func rotatedPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// RecordingFiles 返回path及轮转出的文件，按录制的先后顺序排列
+func RecordingFiles(path string) []string {
+	files := make([]string, 0)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotatedPath(path, i)); err != nil {
+			break
+		}
+		files = append([]string{rotatedPath(path, i)}, files...)
+	}
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return files
+}
+
+// OpenRecording 按顺序读取path及轮转出的文件
+func OpenRecording(path string) (io.ReadCloser, error) {
+	paths := RecordingFiles(path)
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("recording %s: %w", path, os.ErrNotExist)
+	}
+	files := make([]*os.File, 0, len(paths))
+	readers := make([]io.Reader, 0, len(paths))
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			for _, opened := range files {
+				opened.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+		readers = append(readers, f)
+	}
+	return &multiFileReader{Reader: io.MultiReader(readers...), files: files}, nil
+}
+
+type multiFileReader struct {
+	io.Reader
+	files []*os.File
+}
+
+func (m *multiFileReader) Close() error {
+	var err error
+	for _, f := range m.files {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// record 录制收到的数据，录制失败不影响数据的处理
+func (s *Session) record(rec *Record) {
+	if s.Recorder == nil || rec == nil {
+		return
+	}
+	if err := s.Recorder.Record(rec); err != nil {
+		s.logger().Error("record data failed", "err", err)
+	}
+}
+
+// newRecord 没有设置Recorder时返回nil
+func (s *Session) newRecord(kind string, data []byte, encoding string) *Record {
+	if s.Recorder == nil {
+		return nil
+	}
+	rec := &Record{Time: time.Now(), Kind: kind, Compressed: s.Compressed, HeaderVersion: s.HeaderVersion, Encoding: encoding, Data: data}
+	if s.Compressed == 1 {
+		rec.CompressType = compress.GetCompressTypeName(s.CompressType)
+	}
+	return rec
+}
+
+// ReplayOptions 回放参数
+type ReplayOptions struct {
+	// Speed 回放速度倍数，1为录制时的速度，<=0时不等待
+	Speed float64
+	// OnRecord 每条数据处理完成后回调，err为ReceiveData返回的错误
+	OnRecord func(rec *Record, err error)
+}
+
+// ReplayStats 回放结果
+type ReplayStats struct {
+	Records int
+	Errors  int
+}
+
+// Replay 把录制的数据按顺序解码并同步分发给On注册的handler，压缩和header版本按录制时的设置
+// 用于离线调试handler；回放使用session设置的副本，不修改session本身，不经过ReceiveFrameHandler、去重及Recorder，
+// 只分发事件，hello、pong等signal不会改变session的状态
+func (s *Session) Replay(ctx context.Context, r io.Reader, opt ReplayOptions) (ReplayStats, error) {
+	stats := ReplayStats{}
+	replay := s.replaySession()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64<<20)
+	var last time.Time
+	var streamDecompressor compress.DecompressorInterface
+	var streamType compress.CompressType
+	defer func() {
+		if streamDecompressor != nil {
+			compress.RecycleDecompressor(streamType, streamDecompressor)
+		}
+	}()
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		rec := &Record{}
+		if err := sonic.Unmarshal(scanner.Bytes(), rec); err != nil {
+			return stats, fmt.Errorf("parse record %d: %w", stats.Records+1, err)
+		}
+		if opt.Speed > 0 && !last.IsZero() && rec.Time.After(last) {
+			if !sleepContext(ctx, time.Duration(float64(rec.Time.Sub(last))/opt.Speed)) {
+				return stats, ctx.Err()
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		last = rec.Time
+		replay.Compressed = rec.Compressed
+		replay.HeaderVersion = rec.HeaderVersion
+		if rec.Compressed == 1 {
+			replay.CompressType = compress.ParseCompressType(true, rec.CompressType)
+		}
+		if rec.Kind == RecordKindConnect || (rec.Compressed == 1 && (streamDecompressor == nil || streamType != replay.CompressType)) {
+			// 流式压缩的上下文和连接绑定，每个连接使用新的解压器
+			if streamDecompressor != nil {
+				compress.RecycleDecompressor(streamType, streamDecompressor)
+				streamDecompressor = nil
+			}
+			if rec.Compressed == 1 {
+				streamType = replay.CompressType
+				streamDecompressor = compress.GetDecompressor(streamType)
+			}
+		}
+		if rec.Kind != RecordKindData {
+			continue
+		}
+		stats.Records++
+		err := replay.replayRecord(rec, streamDecompressor)
+		if err != nil {
+			stats.Errors++
+		}
+		if opt.OnRecord != nil {
+			opt.OnRecord(rec, err)
+		}
+	}
+	return stats, scanner.Err()
+}
+
+// replaySession 复制回放需要的设置，handler同步执行以便统计处理失败的记录
+func (s *Session) replaySession() *Session {
+	return &Session{
+		EventSyncHandle:    true,
+		ProcessDataHandler: s.ProcessDataHandler,
+		DedupScope:         s.DedupScope,
+		LazyFrameData:      s.LazyFrameData,
+		FrameErrorHandler:  s.FrameErrorHandler,
+		Logger:             s.Logger,
+		Metrics:            s.Metrics,
+		TracerProvider:     s.TracerProvider,
+		TraceEventIds:      s.TraceEventIds,
+		logFields:          s.logFields,
+	}
+}
+
+func (s *Session) replayRecord(rec *Record, decompressor compress.DecompressorInterface) error {
+	if rec.Encoding != "" {
+		compressType, err := compress.ParseContentEncoding(rec.Encoding)
+		if err != nil {
+			return err
+		}
+		decompressor = compress.GetDecompressor(compressType)
+		defer compress.RecycleDecompressor(compressType, decompressor)
+	} else if rec.Compressed != 1 {
+		decompressor = nil
+	} else if decompressor == nil {
+		return ErrNoDecompressor
+	}
+	err, _ := s.receiveData(context.Background(), rec.Data, decompressor, rec.Encoding)
+	return err
+}
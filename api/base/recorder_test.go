@@ -0,0 +1,83 @@
+package base
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gookit/event"
+	event2 "github.com/kaiheila/golang-bot/api/base/event"
+	"github.com/kaiheila/golang-bot/api/helper/compress"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	recorder, err := NewFileRecorder(path, 300, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressType := compress.CompressTypeZlibStream
+	s := &Session{Compressed: 1, CompressType: compressType, Decompressor: compress.GetDecompressor(compressType), Recorder: recorder}
+	s.ReceiveFrameHandler = func(frame *event2.FrameMap) (error, []byte) { return nil, nil }
+	s.record(s.newRecord(RecordKindConnect, nil, ""))
+	compressor := compress.GetCompressor(compressType)
+	channelType := fmt.Sprintf("REPLAYTEST%d", time.Now().UnixNano())
+	for sn := 1; sn <= 5; sn++ {
+		data, err := compressor.Compress([]byte(fmt.Sprintf(`{"s":0,"sn":%d,"d":{"type":9,"channel_type":"%s","content":"hello %d"}}`, sn, channelType, sn)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err, _ = s.ReceiveData(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files := RecordingFiles(path); len(files) < 2 {
+		t.Fatalf("recording not rotated: %v", files)
+	}
+
+	r, err := OpenRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	sns := make([]int64, 0)
+	s.On(channelType+"_9", event.ListenerFunc(func(e event.Event) error {
+		sns = append(sns, e.Get(EventDataFrameKey).(*event2.FrameMap).SerialNumber)
+		return nil
+	}))
+	// 回放到未连接的StateSession，事件直接分发给handler，session的设置不变
+	replay := NewStateSession("", 0, 0, "", 0)
+	defer replay.Stop()
+	recorded := make([]int64, 0)
+	stats, err := replay.Replay(context.Background(), r, ReplayOptions{Speed: 100, OnRecord: func(rec *Record, err error) {
+		recorded = append(recorded, rec.SN...)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Records != 5 || stats.Errors != 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+	if fmt.Sprint(sns) != "[1 2 3 4 5]" || fmt.Sprint(recorded) != "[1 2 3 4 5]" {
+		t.Fatalf("replayed sn %v, recorded sn %v", sns, recorded)
+	}
+	if replay.Compressed != 0 || replay.AckedSn() != 0 {
+		t.Fatalf("session changed by replay, compressed %d, acked sn %d", replay.Compressed, replay.AckedSn())
+	}
+}
+
+func TestReplayCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	recording := `{"t":"2024-01-01T00:00:00Z","kind":"data","data":"e30="}` + "\n"
+	stats, err := (&Session{}).Replay(ctx, strings.NewReader(recording), ReplayOptions{})
+	if err != context.Canceled || stats.Records != 0 {
+		t.Fatalf("stats %+v err %v", stats, err)
+	}
+}
@@ -0,0 +1,76 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	event2 "github.com/kaiheila/golang-bot/api/base/event"
+)
+
+var ErrResumeFail = errors.New("resume failed")
+
+// RecoveryPath 心跳异常后连接恢复的方式
+type RecoveryPath string
+
+const (
+	// RecoveryHeartbeat 重试心跳收到了pong，连接本身没有问题
+	RecoveryHeartbeat RecoveryPath = "heartbeat"
+	// RecoveryResume 在原连接上发送RESUME并收到了RESUME_ACK
+	RecoveryResume RecoveryPath = "resume"
+	// RecoveryReconnect resume失败，重新建立websocket连接
+	RecoveryReconnect RecoveryPath = "reconnect"
+)
+
+// Recovery 离开retry状态时作为reason传给OnStateChange，记录连接恢复的方式及原因
+type Recovery struct {
+	Path  RecoveryPath
+	Cause error
+}
+
+func (r *Recovery) Error() string {
+	if r.Cause != nil {
+		return fmt.Sprintf("recovered by %s: %s", r.Path, r.Cause)
+	}
+	return fmt.Sprintf("recovered by %s", r.Path)
+}
+
+func (r *Recovery) Unwrap() error {
+	return r.Cause
+}
+
+// SendResume 在当前连接上发送RESUME，携带已确认的最大sn，服务端会补发之后的事件并回复RESUME_ACK
+func (s *StateSession) SendResume() error {
+	if s.NetworkProxy == nil {
+		return nil
+	}
+	s.resumePending.Store(true)
+	sn := s.AckedSn()
+	err := s.sendSignal(event2.NewResumeSignal(sn))
+	if err != nil {
+		s.resumePending.Store(false)
+		s.logger().Error("SendResume failed!", "err", err, "sn", sn)
+		return err
+	}
+	return nil
+}
+
+// resumeOrReconnect retry状态下先尝试在原连接上resume，发送失败时直接重新连接
+func (s *StateSession) resumeOrReconnect() error {
+	s.StopHeartbeat()
+	if err := s.SendResume(); err != nil {
+		s.FSM.Event(context.Background(), EventRetryHeartbeatTimeout, &Recovery{Path: RecoveryReconnect, Cause: fmt.Errorf("%w: %s", ErrResumeFail, err)})
+		return nil
+	}
+	s.SendHeartBeat()
+	s.logger().Info("重试发送心跳包")
+	return nil
+}
+
+// retryRecovery retry状态下的状态变化原因，不在retry状态时为nil
+func (s *StateSession) retryRecovery(path RecoveryPath, cause error) error {
+	if s.FSM.Current() != StatusRetry {
+		return cause
+	}
+	return &Recovery{Path: path, Cause: cause}
+}
@@ -0,0 +1,52 @@
+package base
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type fakeNetworkProxy struct {
+	sent    [][]byte
+	sendErr error
+}
+
+func (f *fakeNetworkProxy) ReqGateWay() (error, string)           { return errors.New("not supported"), "" }
+func (f *fakeNetworkProxy) ConnectWebsocket(gateway string) error { return errors.New("not supported") }
+func (f *fakeNetworkProxy) SaveSessionId(sessionId string) error  { return nil }
+func (f *fakeNetworkProxy) SendData(data []byte) error {
+	f.sent = append(f.sent, data)
+	return f.sendErr
+}
+
+func TestResumeAckRecovers(t *testing.T) {
+	proxy := &fakeNetworkProxy{}
+	s := NewStateSession("", 0, 0, "", 0)
+	defer s.Stop()
+	s.NetworkProxy = proxy
+	s.MaxSn = 42
+	var reason error
+	s.OnStateChange(func(from, to State, r error) {
+		reason = r
+	})
+	s.setState(StatusRetry, ErrHeartbeatTimeout)
+	if err := s.SendResume(); err != nil {
+		t.Fatal(err)
+	}
+	if len(proxy.sent) != 1 || !strings.Contains(string(proxy.sent[0]), `"s":4`) || !strings.Contains(string(proxy.sent[0]), `"sn":42`) {
+		t.Fatalf("unexpected resume frame %q", proxy.sent)
+	}
+
+	s.ResumeOk()
+	if s.FSM.Current() != StatusConnected {
+		t.Fatalf("expected connected, got %s", s.FSM.Current())
+	}
+	var recovery *Recovery
+	if !errors.As(reason, &recovery) || recovery.Path != RecoveryResume {
+		t.Errorf("expected resume recovery, got %v", reason)
+	}
+	h := s.Health()
+	if h.ResumeCount != 1 || h.LastRecovery != RecoveryResume {
+		t.Errorf("unexpected health %+v", h)
+	}
+}
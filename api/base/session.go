@@ -1,12 +1,20 @@
 package base
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/bytedance/sonic"
 	"github.com/gookit/event"
 	event2 "github.com/kaiheila/golang-bot/api/base/event"
 	"github.com/kaiheila/golang-bot/api/helper/compress"
-	log "github.com/sirupsen/logrus"
+	"github.com/kaiheila/golang-bot/api/helper/logger"
+	"github.com/kaiheila/golang-bot/api/metrics"
+	"go.opentelemetry.io/otel/trace"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const EventReceiveFrame = "EVENT-GLOBAL-RECEIVE_FRAME"
@@ -15,6 +23,12 @@ const EventDataSessionKey = "session"
 const EventSigReceive = "SIG_RECEIVE"
 const EventSigDecoded = "SIG_DECODE"
 
+var ErrNoDecompressor = errors.New("compressed but decompressor not set")
+var ErrHandlerPanic = errors.New("event handler panic")
+
+// eventNamePattern event要求的事件名格式，事件名为channel_type + _ + type
+var eventNamePattern = regexp.MustCompile(`^[a-zA-Z][\w-.]*$`)
+
 type Session struct {
 	Compressed          int
 	ReceiveFrameHandler func(frame *event2.FrameMap) (error, []byte)
@@ -24,95 +38,340 @@ type Session struct {
 	CompressType        compress.CompressType
 	CompressDictVersion string
 	HeaderVersion       int
+	// receiveFrameContextHandler 不为空时代替ReceiveFrameHandler，ctx为收到数据时的context
+	receiveFrameContextHandler func(ctx context.Context, frame *event2.FrameMap) (error, []byte)
+	// DedupStore 不为空时，分发前会跳过已经处理过的事件(sn/msg_id)
+	DedupStore DedupStore
+	// DedupScope sn只在同一个session内唯一，用它区分不同session的sn
+	DedupScope string
+	// FrameDispatchHandler 事件通过去重检查、开始分发时回调，用于记录未确认的sn
+	FrameDispatchHandler func(frame *event2.FrameMap)
+	// FrameAckHandler 事件的handler全部处理成功后回调，用于推进已确认的sn
+	FrameAckHandler func(frame *event2.FrameMap)
+	// inflight 正在处理中的事件key，避免异步处理时重复分发
+	inflight sync.Map
+	// LazyFrameData 为true时不把d解码为FrameMap.Data，handler通过frame.DecodeData直接解码到结构体
+	// 默认为false，兼容直接读取frame.Data的handler，每个事件会多一次d到map的解码
+	LazyFrameData bool
+	// FrameErrorHandler frame缺少字段或字段类型不正确时回调，data为收到的数据，frame已经解析时为重新序列化的frame
+	FrameErrorHandler func(err *event2.FrameError, data []byte)
+	// decompressLimitCount 解压后超过限制而被丢弃的消息数
+	decompressLimitCount atomic.Int64
+	// frameErrorCount 格式不正确而被丢弃的frame数
+	frameErrorCount atomic.Int64
+	// Recorder 不为空时录制收到的原始数据(解压前)，用于Replay离线回放
+	Recorder Recorder
+	// Logger 为空时使用logger.Default()
+	Logger logger.Logger
+	// Metrics 为空时使用metrics.Default()
+	Metrics metrics.Metrics
+	// TracerProvider 为空时使用otel.GetTracerProvider()
+	TracerProvider trace.TracerProvider
+	// TraceEventIds 为true时事件span带有target_id、msg_id属性，它们可以关联到具体的用户和消息，默认不记录
+	TraceEventIds bool
+	// logFields 返回每条日志都带有的上下文字段，如session_id、state
+	logFields func() []any
+}
+
+// logger 返回带有session上下文字段的日志
+func (s *Session) logger() logger.Logger {
+	l := logger.OrDefault(s.Logger)
+	if s.logFields != nil {
+		return l.With(s.logFields()...)
+	}
+	return l
 }
 
+// On 在event的全局Manager上注册事件handler，所有session共用，可以在session运行中注册，但不能在handler中调用
 func (s *Session) On(message string, handler event.Listener) {
-	event.On(message, handler)
+	busOn(message, handler)
 }
 func (s *Session) Trigger(eventName string, params event.M) {
 	if s.EventSyncHandle {
-		event.Trigger(eventName, params)
+		busTrigger(eventName, params)
 	} else {
-		event.AsyncFire(event.NewBasic(eventName, params))
+		busAsyncFire(event.NewBasic(eventName, params))
 	}
 }
 
 func (s *Session) ReceiveData(data []byte) (error, []byte) {
+	return s.receiveDataContext(context.Background(), data)
+}
+
+// receiveDataContext 按创建session时的compress参数解压并处理数据，事件的span以ctx为父span
+func (s *Session) receiveDataContext(ctx context.Context, data []byte) (error, []byte) {
+	var decompressor compress.DecompressorInterface
+	if s.Compressed == 1 {
+		if s.Decompressor == nil {
+			s.logger().Error("ReceiveData", "err", ErrNoDecompressor)
+			return ErrNoDecompressor, nil
+		}
+		decompressor = s.Decompressor
+	}
+	return s.receiveData(ctx, data, decompressor, "")
+}
+
+// receiveData 处理收到的数据，decompressor为nil时不解压，encoding为webhook请求的Content-Encoding，事件的span以ctx为父span
+func (s *Session) receiveData(ctx context.Context, data []byte, decompressor compress.DecompressorInterface, encoding string) (error, []byte) {
+	rec := s.newRecord(RecordKindData, data, encoding)
+	defer s.record(rec)
 	fireEvent := event.NewBasic(EventSigReceive, map[string]interface{}{EventDataFrameKey: data})
-	event.Trigger(fireEvent.Name(), fireEvent.Data())
-	sig := event2.BaseSignal{}
-	sig.Version = s.HeaderVersion
-	err := sig.Decode(data)
-	if err != nil {
-		log.WithError(err).WithField("data", fmt.Sprintf("%x", data)).Error("Decode signal error")
-		return err, nil
+	busTrigger(fireEvent.Name(), fireEvent.Data())
+	// 一个消息中可能有多个signal，按顺序处理，其中一个处理失败不影响后续的signal
+	sigs, decodeErr := event2.DecodeAll(data, s.HeaderVersion)
+	if decodeErr != nil {
+		s.metrics().FrameError(metrics.ErrorKindDecode)
+		s.logger().Error("Decode signal error", "err", decodeErr, "data", logger.Stringer{Format: "%x", Args: []any{data}})
+	}
+	var firstErr error
+	var resData []byte
+	for _, sig := range sigs {
+		err, res := s.receiveSignal(ctx, sig, decompressor, rec)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if res != nil {
+			resData = res
+		}
 	}
+	if decodeErr != nil {
+		return decodeErr, resData
+	}
+	return firstErr, resData
+}
+
+// receiveSignal 处理一个signal，rec不为空时记录signal的sn
+func (s *Session) receiveSignal(ctx context.Context, sig *event2.BaseSignal, decompressor compress.DecompressorInterface, rec *Record) (error, []byte) {
 	if sig.SN > 0 {
-		event.Trigger(EventSigDecoded, map[string]any{"signal": &sig})
+		busTrigger(EventSigDecoded, map[string]any{"signal": sig})
+		if rec != nil {
+			rec.SN = append(rec.SN, sig.SN)
+		}
 	}
-	data = sig.Payload
-	if s.Compressed == 1 {
-		var err error
-		data, err = s.Decompressor.Decompress(data)
+	data := sig.Payload
+	var err error
+	if decompressor != nil {
+		data, err = decompressor.Decompress(data)
+		if errors.Is(err, compress.ErrDecompressLimit) {
+			count := s.decompressLimitCount.Add(1)
+			s.metrics().FrameError(metrics.ErrorKindDecompressLimit)
+			s.logger().Error("Decompress exceeds limit, drop message", "err", err, "count", count, "sn", sig.SN)
+			return err, nil
+		}
 		if err != nil {
-			log.Error(err)
+			s.metrics().FrameError(metrics.ErrorKindDecompress)
+			s.logger().Error("Decompress error", "err", err, "sn", sig.SN)
 			return err, nil
 		}
 	}
-	_, err = sonic.Get(data)
+	// 只做一次语法检查，frame的字段按需从ast中读取
+	lazy, err := event2.NewLazyFrame(data)
 	if err != nil {
-		log.Error("Json Unmarshal err.", err)
-		return err, nil
+		return s.frameError(err, data), nil
 	}
 	if s.ProcessDataHandler != nil {
 		err, data = s.ProcessDataHandler(data)
 		if err != nil {
-			log.WithError(err).Error("ProcessDataHandler")
+			s.metrics().FrameError(metrics.ErrorKindProcess)
+			s.logger().Error("ProcessDataHandler", "err", err)
 			return err, nil
 		}
+		if lazy, err = event2.NewLazyFrame(data); err != nil {
+			return s.frameError(err, data), nil
+		}
+	}
+	frame, err := lazy.FrameMap(!s.LazyFrameData)
+	if err != nil {
+		return s.frameError(err, data), nil
 	}
-	frame := event2.ParseFrameMapByData(data)
 	if s.HeaderVersion > 0 {
 		frame.SerialNumber = sig.SN
 		//log.Infof("Receive frame from server,serialNumber:%d", frame.SerialNumber)
+	} else if rec != nil && frame.SerialNumber > 0 {
+		rec.SN = append(rec.SN, frame.SerialNumber)
 	}
-	log.WithField("frame", frame).Info("Receive frame from server")
-	if frame != nil {
-		if s.ReceiveFrameHandler != nil {
-			return s.ReceiveFrameHandler(frame)
-		} else {
-			return s.ReceiveFrame(frame)
-		}
-	} else {
-		log.Warnf("数据不是合法的frame:%s", string(data))
+	s.metrics().FrameReceived(frame.SignalType)
+	s.logger().Debug("Receive frame from server", "s", frame.SignalType, "sn", frame.SerialNumber, "frame", frame)
+	if s.receiveFrameContextHandler != nil {
+		return s.receiveFrameContextHandler(ctx, frame)
 	}
-	return nil, nil
+	if s.ReceiveFrameHandler != nil {
+		return s.ReceiveFrameHandler(frame)
+	}
+	return s.ReceiveFrameContext(ctx, frame)
+}
 
+// DecompressLimitCount 返回解压后超过限制而被丢弃的消息数
+func (s *Session) DecompressLimitCount() int64 {
+	return s.decompressLimitCount.Load()
+}
+
+// FrameErrorCount 返回格式不正确而被丢弃的frame数
+func (s *Session) FrameErrorCount() int64 {
+	return s.frameErrorCount.Load()
+}
+
+// frameError 记录格式不正确的frame并回调FrameErrorHandler，返回原来的错误
+func (s *Session) frameError(err error, data []byte) error {
+	var frameErr *event2.FrameError
+	if !errors.As(err, &frameErr) {
+		return err
+	}
+	count := s.frameErrorCount.Add(1)
+	s.metrics().FrameError(metrics.ErrorKindFrame)
+	s.logger().Warn("数据不是合法的frame", "err", err, "count", count, "data", string(data))
+	if s.FrameErrorHandler != nil {
+		s.FrameErrorHandler(frameErr, data)
+	}
+	return err
+}
+
+// frameData 重新序列化frame，只在需要回调FrameErrorHandler时调用
+func (s *Session) frameData(frame *event2.FrameMap) []byte {
+	if s.FrameErrorHandler == nil {
+		return nil
+	}
+	data, _ := sonic.Marshal(frame)
+	return data
 }
 
 func (s *Session) ReceiveFrame(frame *event2.FrameMap) (error, []byte) {
-	event.Trigger(EventReceiveFrame, map[string]interface{}{"frame": frame})
+	return s.ReceiveFrameContext(context.Background(), frame)
+}
+
+// ReceiveFrameContext 分发事件，事件的span以ctx为父span，handler通过EventContext取得带有事件span的context
+func (s *Session) ReceiveFrameContext(ctx context.Context, frame *event2.FrameMap) (error, []byte) {
+	return s.dispatchFrame(ctx, frame, s.EventSyncHandle)
+}
+
+// dispatchFrame 分发事件，wait为true时等待handler处理完成后返回handler的错误，跳过的重复事件返回nil
+func (s *Session) dispatchFrame(ctx context.Context, frame *event2.FrameMap, wait bool) (error, []byte) {
+	busTrigger(EventReceiveFrame, map[string]interface{}{"frame": frame})
 	if frame.SignalType == event2.SIG_EVENT {
-		eventType := frame.Data["type"]
-		var channelType string
-		if v, ok := frame.Data["channel_type"]; ok {
-			channelType = v.(string)
-		} else if v2, ok2 := frame.Data["channelType"]; ok2 {
-			channelType = v2.(string)
-		} else {
-			log.Errorf("frame data not contain channel_type and channelType,%+v", frame.Data)
+		eventType, err := frame.EventType()
+		if err != nil {
+			return s.frameError(err, s.frameData(frame)), nil
+		}
+		channelType, err := frame.ChannelType()
+		if err != nil {
+			return s.frameError(err, s.frameData(frame)), nil
+		}
+		// 事件名不合法时event会panic
+		if !eventNamePattern.MatchString(channelType) {
+			err = &event2.FrameError{Field: "d.channel_type", Reason: fmt.Sprintf("invalid channel type %q", channelType)}
+			return s.frameError(err, s.frameData(frame)), nil
+		}
+		keys := DedupKeys(s.DedupScope, frame)
+		if !s.beginProcess(keys) {
+			s.logger().Debug("skip duplicate event", "sn", frame.SerialNumber, "keys", keys)
 			return nil, nil
 		}
-		if eventType != "" {
-			name := fmt.Sprintf("%s_%d", channelType, int64(eventType.(float64)))
-			fireEvent := event.NewBasic(name, map[string]interface{}{EventDataFrameKey: frame, EventDataSessionKey: s})
-			if s.EventSyncHandle {
-				event.Trigger(fireEvent.Name(), fireEvent.Data())
-			} else {
-				event.AsyncFire(fireEvent)
-			}
+		if s.FrameDispatchHandler != nil {
+			s.FrameDispatchHandler(frame)
+		}
+		name := fmt.Sprintf("%s_%d", channelType, eventType)
+		ctx, span := s.startEventSpan(ctx, name, channelType, eventType, frame)
+		fireEvent := event.NewBasic(name, map[string]interface{}{EventDataFrameKey: frame, EventDataSessionKey: s, EventDataContextKey: ctx})
+		if wait {
+			start := time.Now()
+			err := callHandler(func() error {
+				err, _ := busTrigger(fireEvent.Name(), fireEvent.Data())
+				return err
+			})
+			s.metrics().HandlerDone(name, time.Since(start), err)
+			endSpan(span, err)
+			s.finishProcess(frame, keys, err)
+			return err, nil
+		} else {
+			go func() {
+				start := time.Now()
+				err := callHandler(func() error { return busFireEvent(fireEvent) })
+				s.metrics().HandlerDone(name, time.Since(start), err)
+				endSpan(span, err)
+				s.finishProcess(frame, keys, err)
+			}()
 		}
 	}
 	return nil, nil
 
 }
+
+// callHandler handler panic时转换为error，事件按处理失败释放，不会导致进程退出
+func callHandler(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrHandlerPanic, r)
+		}
+	}()
+	return fn()
+}
+
+// beginProcess 占用事件的key，事件已经处理过或正在(其它副本)处理时返回false表示需要跳过
+func (s *Session) beginProcess(keys []string) bool {
+	for i, key := range keys {
+		if _, loaded := s.inflight.LoadOrStore(key, struct{}{}); loaded {
+			s.releaseInflight(keys[:i])
+			return false
+		}
+	}
+	if s.DedupStore == nil {
+		return true
+	}
+	for i, key := range keys {
+		ok, err := s.DedupStore.Claim(key)
+		if err != nil {
+			// store不可用时仍然处理，宁可重复也不丢事件
+			s.logger().Error("DedupStore Claim error", "err", err, "key", key)
+			continue
+		}
+		if !ok {
+			s.releaseClaims(keys[:i])
+			s.releaseInflight(keys)
+			return false
+		}
+	}
+	return true
+}
+
+// finishProcess handler处理成功后确认，失败则释放占用的key，服务端重发时可以再次处理
+func (s *Session) finishProcess(frame *event2.FrameMap, keys []string, err error) {
+	defer s.releaseInflight(keys)
+	if err != nil {
+		s.logger().Error("handle event error, not acked", "err", err, "sn", frame.SerialNumber, "keys", keys)
+		s.releaseClaims(keys)
+		return
+	}
+	s.markClaims(keys)
+	if s.FrameAckHandler != nil {
+		s.FrameAckHandler(frame)
+	}
+}
+
+// markClaims handler处理成功后确认占用的key
+func (s *Session) markClaims(keys []string) {
+	if s.DedupStore == nil {
+		return
+	}
+	for _, key := range keys {
+		if err := s.DedupStore.Mark(key); err != nil {
+			s.logger().Error("DedupStore Mark error", "err", err, "key", key)
+		}
+	}
+}
+
+func (s *Session) releaseClaims(keys []string) {
+	if s.DedupStore == nil {
+		return
+	}
+	for _, key := range keys {
+		if err := s.DedupStore.Release(key); err != nil {
+			s.logger().Error("DedupStore Release error", "err", err, "key", key)
+		}
+	}
+}
+
+func (s *Session) releaseInflight(keys []string) {
+	for _, key := range keys {
+		s.inflight.Delete(key)
+	}
+}
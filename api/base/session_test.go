@@ -0,0 +1,202 @@
+package base
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gookit/event"
+	event2 "github.com/kaiheila/golang-bot/api/base/event"
+	"github.com/kaiheila/golang-bot/api/helper/compress"
+)
+
+func TestReceiveDataDecompressLimit(t *testing.T) {
+	defer compress.SetLimits(compress.GetLimits())
+	compress.SetLimits(compress.Limits{MaxSize: 1 << 10})
+
+	s := &Session{Compressed: 1, CompressType: compress.CompressTypeZlibPerMessage, EventSyncHandle: true}
+	s.Decompressor = compress.GetDecompressor(s.CompressType)
+	compressor := compress.GetCompressor(s.CompressType)
+
+	data, err := compressor.Compress(append([]byte(`{"s":1,"d":"`), append(bytes.Repeat([]byte("a"), 2<<10), `"}`...)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		err, _ = s.ReceiveData(data)
+		if !errors.Is(err, compress.ErrDecompressLimit) {
+			t.Fatalf("expect limit error, got %v", err)
+		}
+		if s.DecompressLimitCount() != int64(i) {
+			t.Fatalf("count: %d", s.DecompressLimitCount())
+		}
+	}
+
+	data, _ = compressor.Compress([]byte(`{"s":3,"d":{}}`))
+	if err, _ = s.ReceiveData(data); err != nil {
+		t.Fatal(err)
+	}
+	if s.DecompressLimitCount() != 2 {
+		t.Fatalf("count: %d", s.DecompressLimitCount())
+	}
+}
+
+func TestReceiveDataMultipleSignals(t *testing.T) {
+	s := &Session{HeaderVersion: 1, EventSyncHandle: true}
+	received := make([]int64, 0)
+	s.ReceiveFrameHandler = func(frame *event2.FrameMap) (error, []byte) {
+		received = append(received, frame.SerialNumber)
+		return nil, nil
+	}
+	var data []byte
+	for sn := int64(1); sn <= 3; sn++ {
+		sig := &event2.BaseSignal{Version: 1, HasSN: true, SN: sn, IncludeLength: true, Payload: []byte(`{"s":0,"d":{}}`)}
+		b, err := sig.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, b...)
+	}
+	if err, _ := s.ReceiveData(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 3 || received[0] != 1 || received[1] != 2 || received[2] != 3 {
+		t.Fatalf("received %v", received)
+	}
+
+	// 最后一个signal被截断，前面完整的signal仍然处理
+	received = received[:0]
+	err, _ := s.ReceiveData(data[:len(data)-3])
+	if !errors.Is(err, event2.ErrTruncatedSignal) {
+		t.Fatalf("expect ErrTruncatedSignal, got %v", err)
+	}
+	if len(received) != 2 {
+		t.Fatalf("received %v", received)
+	}
+}
+
+func TestReceiveDataLazyFrame(t *testing.T) {
+	s := &Session{EventSyncHandle: true, LazyFrameData: true, DedupStore: NewLRUDedupStore(10)}
+	var got *event2.BaseEvent
+	var gotData map[string]interface{}
+	s.On("LAZY_TEST_9", event.ListenerFunc(func(e event.Event) error {
+		frame := e.Get(EventDataFrameKey).(*event2.FrameMap)
+		gotData = frame.Data
+		got = &event2.BaseEvent{}
+		return frame.DecodeData(got)
+	}))
+	data := []byte(`{"s":0,"sn":3,"d":{"channel_type":"LAZY_TEST","type":9,"content":"hi","msg_id":"m1"}}`)
+	for i := 0; i < 2; i++ {
+		if err, _ := s.ReceiveData(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got == nil || got.Content != "hi" || gotData != nil {
+		t.Fatalf("got %+v, data %v", got, gotData)
+	}
+	// 第二次按msg_id去重
+	if !lruSeen(s.DedupStore.(*LRUDedupStore), "msg:m1") {
+		t.Fatal("expect msg_id marked")
+	}
+}
+
+func TestFrameErrorHandler(t *testing.T) {
+	var got []*event2.FrameError
+	s := &Session{EventSyncHandle: true, FrameErrorHandler: func(err *event2.FrameError, data []byte) {
+		got = append(got, err)
+	}}
+	for _, data := range []string{
+		`not json`,
+		`{"s":"0"}`,
+		`{"s":0,"d":{"type":"9","channel_type":"GROUP"}}`,
+		`{"s":0,"d":{"type":9,"channel_type":["GROUP"]}}`,
+	} {
+		err, _ := s.ReceiveData([]byte(data))
+		if !errors.Is(err, event2.ErrInvalidFrame) {
+			t.Fatalf("%s: expect ErrInvalidFrame, got %v", data, err)
+		}
+	}
+	if len(got) != 4 || s.FrameErrorCount() != 4 {
+		t.Fatalf("got %v, count %d", got, s.FrameErrorCount())
+	}
+
+	// hello中的字段类型不正确时不会panic
+	ss := NewStateSession("", 0, 0, "", 0)
+	defer ss.Stop()
+	ss.NetworkProxy = &fakeNetworkProxy{}
+	for _, data := range []string{`{"s":1,"d":{"code":"0"}}`, `{"s":1,"d":{"code":0,"session_id":1}}`, `{"s":1,"d":{"code":0}}`} {
+		if err, _ := ss.ReceiveData([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ss.FrameErrorCount() != 3 {
+		t.Fatalf("count %d", ss.FrameErrorCount())
+	}
+}
+
+func FuzzReceiveData(f *testing.F) {
+	for _, seed := range []string{
+		`{"s":0,"sn":1,"d":{"channel_type":"FUZZ","type":9,"msg_id":"m","msg_timestamp":1}}`,
+		`{"s":0,"d":{"channel_type":"FUZZ","type":255,"challenge":"c","verify_token":"token"}}`,
+		`{"s":1,"d":{"code":0,"session_id":"x"}}`,
+		`{"s":5,"d":{"code":41008,"err":"x"}}`,
+		`{"s":"0","d":[]}`,
+		`{"encrypt":1}`,
+		`[]`,
+	} {
+		f.Add([]byte(seed), false)
+		f.Add([]byte(seed), true)
+	}
+	header, _ := (&event2.BaseSignal{Version: 1, SignalType: 3, HasSN: true, SN: 7, IncludeLength: true, Payload: []byte(`{"s":3}`)}).Encode()
+	f.Add(header, true)
+	f.Fuzz(func(t *testing.T, data []byte, lazy bool) {
+		sessions := make([]*Session, 0, 4)
+		for _, headerVersion := range []int{0, 1} {
+			sessions = append(sessions, &Session{EventSyncHandle: true, HeaderVersion: headerVersion, LazyFrameData: lazy})
+		}
+		webhook := NewWebhookSession("", "token", 0)
+		webhook.EventSyncHandle = true
+		webhook.LazyFrameData = lazy
+		sessions = append(sessions, &webhook.Session)
+		for _, s := range sessions {
+			s.FrameErrorHandler = func(err *event2.FrameError, data []byte) {
+				if err == nil {
+					t.Fatal("nil FrameError")
+				}
+			}
+			err, _ := s.ReceiveData(data)
+			var frameErr *event2.FrameError
+			if errors.As(err, &frameErr) && s.FrameErrorCount() == 0 {
+				t.Fatalf("FrameError %v not counted", err)
+			}
+		}
+	})
+}
+
+func TestGlobalEventListener(t *testing.T) {
+	// 直接用event.On注册在全局Manager上的handler也能收到session的事件
+	s := &Session{EventSyncHandle: true}
+	channelType := fmt.Sprintf("GLOBALTEST%d", time.Now().UnixNano())
+	var got, frames int
+	// 其它测试的异步handler可能还在分发，注册时和Session.On一样加锁
+	eventBusLock.Lock()
+	event.On(channelType+"_9", event.ListenerFunc(func(e event.Event) error {
+		got++
+		return nil
+	}))
+	eventBusLock.Unlock()
+	s.On(EventReceiveFrame, event.ListenerFunc(func(e event.Event) error {
+		if f, ok := e.Get(EventDataFrameKey).(*event2.FrameMap); ok && f.SerialNumber == 99 {
+			frames++
+		}
+		return nil
+	}))
+	if err, _ := s.ReceiveData([]byte(fmt.Sprintf(`{"s":0,"sn":99,"d":{"type":9,"channel_type":"%s"}}`, channelType))); err != nil {
+		t.Fatal(err)
+	}
+	if got != 1 || frames != 1 {
+		t.Fatalf("global listener %d, receive frame listener %d", got, frames)
+	}
+}
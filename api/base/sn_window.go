@@ -0,0 +1,56 @@
+package base
+
+import "time"
+
+// snWindow 记录正在处理的事件sn，计算可以确认的连续sn水位
+// handler异步处理时sn可能乱序完成，sn N+1先完成时不能把N也当成已处理，水位只推进到最小的未完成sn之前
+type snWindow struct {
+	pending  map[int64]time.Time
+	maxAcked int64
+	// timeout 未确认的sn最多阻塞水位的时间，超过后放弃该sn，<=0时一直等待
+	timeout time.Duration
+	now     func() time.Time
+}
+
+func newSnWindow(timeout time.Duration) *snWindow {
+	return &snWindow{pending: make(map[int64]time.Time), timeout: timeout, now: time.Now}
+}
+
+// begin 事件开始分发，处理成功前不能确认
+func (w *snWindow) begin(sn int64) {
+	w.pending[sn] = w.now()
+}
+
+// ack 事件处理成功，返回确认后的水位及超时放弃的sn
+// 处理失败的sn保留在pending中，服务端重发并处理成功后确认，超过timeout仍未确认时放弃，避免水位一直停在失败的sn之前
+func (w *snWindow) ack(sn int64) (int64, []int64) {
+	delete(w.pending, sn)
+	if sn > w.maxAcked {
+		w.maxAcked = sn
+	}
+	return w.watermark()
+}
+
+// watermark 返回当前水位，同时清理超时的sn
+func (w *snWindow) watermark() (int64, []int64) {
+	var expired []int64
+	mark := w.maxAcked
+	now := w.now()
+	for sn, beginAt := range w.pending {
+		if w.timeout > 0 && now.Sub(beginAt) >= w.timeout {
+			delete(w.pending, sn)
+			expired = append(expired, sn)
+			continue
+		}
+		if sn-1 < mark {
+			mark = sn - 1
+		}
+	}
+	return mark, expired
+}
+
+// reset 重新建立session后sn从头开始
+func (w *snWindow) reset() {
+	w.pending = make(map[int64]time.Time)
+	w.maxAcked = 0
+}
@@ -0,0 +1,134 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gookit/event"
+	event2 "github.com/kaiheila/golang-bot/api/base/event"
+)
+
+func TestSnWindow(t *testing.T) {
+	w := newSnWindow(0)
+	for sn := int64(1); sn <= 4; sn++ {
+		w.begin(sn)
+	}
+	if mark, _ := w.ack(2); mark != 0 {
+		t.Fatalf("sn 1 pending, watermark %d", mark)
+	}
+	if mark, _ := w.ack(1); mark != 2 {
+		t.Fatalf("watermark %d", mark)
+	}
+	// sn 3处理失败，一直保留到服务端重发后处理成功
+	if mark, _ := w.ack(4); mark != 2 {
+		t.Fatalf("sn 3 failed, watermark %d", mark)
+	}
+	w.begin(3)
+	if mark, _ := w.ack(3); mark != 4 {
+		t.Fatalf("watermark %d", mark)
+	}
+}
+
+func TestSnWindowTimeout(t *testing.T) {
+	now := time.Now()
+	w := newSnWindow(time.Minute)
+	w.now = func() time.Time { return now }
+	for sn := int64(1); sn <= 3; sn++ {
+		w.begin(sn)
+	}
+	// sn 1处理失败，之后的sn处理成功
+	if mark, expired := w.ack(2); mark != 0 || len(expired) != 0 {
+		t.Fatalf("watermark %d, expired %v", mark, expired)
+	}
+	now = now.Add(30 * time.Second)
+	w.begin(4)
+	if mark, _ := w.ack(3); mark != 0 {
+		t.Fatalf("watermark %d", mark)
+	}
+	// 超时后放弃sn 1，水位推进到还在处理的sn 4之前
+	now = now.Add(31 * time.Second)
+	mark, expired := w.ack(3)
+	if mark != 3 || len(expired) != 1 || expired[0] != 1 {
+		t.Fatalf("watermark %d, expired %v", mark, expired)
+	}
+	if mark, _ := w.ack(4); mark != 4 {
+		t.Fatalf("watermark %d", mark)
+	}
+}
+
+func TestAckOutOfOrder(t *testing.T) {
+	s := NewStateSession("", 0, 0, "", 0)
+	defer s.Stop()
+	s.NetworkProxy = &fakeNetworkProxy{}
+	s.SaveSessionId("ack-session")
+	release := make(chan struct{})
+	done := make(chan int64, 3)
+	calls := 0
+	// handler注册在全局的事件总线上，每次运行使用不同的channel_type，避免-count>1时收到上一次注册的handler
+	channelType := fmt.Sprintf("ACKTEST%d", time.Now().UnixNano())
+	s.On(channelType+"_1", event.ListenerFunc(func(e event.Event) error {
+		<-release
+		done <- 1
+		if calls++; calls == 1 {
+			return errors.New("handler failed")
+		}
+		return nil
+	}))
+	s.On(channelType+"_2", event.ListenerFunc(func(e event.Event) error {
+		done <- 2
+		return nil
+	}))
+	receive := func(sn int64) {
+		s.ReceiveFrame(&event2.FrameMap{SignalType: event2.SIG_EVENT, SerialNumber: sn,
+			Data: map[string]interface{}{"channel_type": channelType, "type": float64(sn), "msg_id": fmt.Sprintf("m%d", sn)}})
+	}
+	finished := func() bool {
+		_, pending1 := s.inflight.Load("sn:ack-session:1")
+		_, pending2 := s.inflight.Load("sn:ack-session:2")
+		return !pending1 && !pending2
+	}
+	receive(1)
+	receive(2)
+	<-done
+	close(release)
+	<-done
+	waitFor(t, finished)
+	// sn 2先处理成功，sn 1失败，已确认的sn不能越过1
+	if sn := s.AckedSn(); sn != 0 {
+		t.Fatalf("acked sn %d", sn)
+	}
+	// 服务端重发sn 1并处理成功后，确认到sn 2
+	receive(1)
+	<-done
+	waitFor(t, func() bool { return s.AckedSn() == 2 })
+}
+
+func TestSaveSessionFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.pid")
+	if err := writeFileAtomic(path, []byte(`["s1",3]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != `["s1",3]` {
+		t.Fatalf("read %q %v", data, err)
+	}
+	if files, _ := filepath.Glob(path + ".tmp*"); len(files) != 0 {
+		t.Fatalf("temp files left %v", files)
+	}
+}
+
+// waitFor 等待cond成立，超时后测试失败
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -5,13 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"github.com/avast/retry-go/v4"
-	"github.com/bytedance/sonic"
 	event2 "github.com/kaiheila/golang-bot/api/base/event"
 	helper "github.com/kaiheila/golang-bot/api/helper"
 	"github.com/kaiheila/golang-bot/api/helper/compress"
+	"github.com/kaiheila/golang-bot/api/helper/logger"
 	"github.com/looplab/fsm"
-	cron "github.com/robfig/cron"
-	log "github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -55,14 +55,6 @@ const (
 	RETRY_INFINIT = 0
 )
 
-type StatusParam struct {
-	StartTime  int
-	MaxTime    int
-	FirstDelay int
-	Retry      int
-	MaxRetry   int
-}
-
 /**                                                _________________
  *       获取gateWay     连接ws          收到hello |    心跳超时    |
  *             |           |                |      |      |         |
@@ -78,36 +70,116 @@ type StateSession struct {
 	Session
 	SessionId string
 	//Status           string
-	GateWay      string
+	GateWay string
+	// Timeout 发送心跳包后等待pong的秒数
+	//
+	// Deprecated: 使用ReconnectPolicy.PongTimeout，修改过的值会在Start时合并到ReconnectPolicy
 	Timeout      int
 	RecvQueue    chan *event2.FrameMap
 	MaxSn        int64
 	FSM          *fsm.FSM
 	NetworkProxy SystemInterface
-
-	StatusParams    map[string]*StatusParam
-	HeartBeatCron   *cron.Cron
+	// StatusParams 旧版的各状态重试参数，connected状态的MaxTime为心跳间隔
+	//
+	// Deprecated: 使用ReconnectPolicy，修改过的参数会在Start时合并到ReconnectPolicy
+	StatusParams map[string]*StatusParam
+	// legacyParams、legacyTimeout 创建session时StatusParams、Timeout的值，用于判断调用方是否修改过
+	legacyParams  map[string]StatusParam
+	legacyTimeout int
+	// Compressor 压缩发送的signal，只在OutboundCompress开启时使用
+	Compressor       compress.CompressorInterface
+	OutboundCompress bool
+	sendLock         sync.Mutex
+
+	// LastPongAt、LastPingAt 由healthLock保护，读取使用Health()
 	LastPongAt      time.Time
 	LastPingAt      time.Time
-	PongTimeoutChan chan time.Time
+	PongTimeoutChan chan PongCheck
+	// snLock 保护MaxSn、SessionId及未确认的sn
+	snLock        sync.Mutex
+	snWindow      *snWindow
+	snSaveTimer   *time.Timer
+	snSavedAt     time.Time
+	rtt           *rttRing
+	pingPending   atomic.Bool
+	resumePending atomic.Bool
+
+	policy          atomic.Pointer[ReconnectPolicy]
+	ctx             context.Context
+	cancel          context.CancelFunc
+	heartbeatLock   sync.Mutex
+	heartbeatCancel context.CancelFunc
+	heartbeatReset  chan struct{}
+
+	healthLock          sync.RWMutex
+	stateChangeHandlers []StateChangeHandler
+	connectedAt         time.Time
+	reconnectCount      int64
+	resumeCount         int64
+	lastRecovery        RecoveryPath
+	// retryReason 最近一次进入retry状态的原因
+	retryReason error
+
+	// logState、logSessionId 日志的上下文字段，不读取FSM.Current()，避免在状态机回调中再次加锁
+	logState     atomic.Value
+	logSessionId atomic.Value
 }
 
-func NewStateSession(gateway string, compressed int, compressType compress.CompressType, dictVersion string, headerVersion int) *StateSession {
-	s := &StateSession{}
-	s.StatusParams = map[string]*StatusParam{
-		StatusInit:        &StatusParam{StartTime: 0, MaxTime: 60, FirstDelay: 1, MaxRetry: RETRY_INFINIT},
-		StatusGateway:     &StatusParam{StartTime: 1, MaxTime: 32, FirstDelay: 2, MaxRetry: 2},
-		StatusWSConnected: &StatusParam{StartTime: 6, MaxTime: 0, FirstDelay: 0, MaxRetry: NO_RETRY},
-		StatusConnected:   &StatusParam{StartTime: 30, MaxTime: 30, FirstDelay: 0, MaxRetry: NO_RETRY},
-		StatusRetry:       &StatusParam{StartTime: 0, MaxTime: 8, FirstDelay: 4, MaxRetry: 2},
+// snSaveInterval 确认sn后写入session文件的最小间隔，进程异常退出时服务端最多重发这段时间内确认的事件
+const snSaveInterval = time.Second
+
+// snPendingTimeout 处理失败的sn等待服务端重发的最长时间，超过后放弃该sn，继续确认之后处理成功的sn
+const snPendingTimeout = time.Minute
+
+// PongCheck 一次心跳的pong超时检查，TimeoutAt之后仍没有收到PingAt之后的pong即为超时
+type PongCheck struct {
+	PingAt    time.Time
+	TimeoutAt time.Time
+}
+
+// StateSessionOption StateSession的可选参数
+type StateSessionOption func(s *StateSession)
+
+// WithReconnectPolicy 设置重试及心跳参数，参数不合法时使用默认参数
+func WithReconnectPolicy(policy *ReconnectPolicy) StateSessionOption {
+	return func(s *StateSession) {
+		if err := s.SetReconnectPolicy(policy); err != nil {
+			s.logger().Error("invalid reconnect policy, use default", "err", err)
+		}
+	}
+}
+
+// WithLogger 设置session的日志，每条日志会带上session_id和state字段
+func WithLogger(l logger.Logger) StateSessionOption {
+	return func(s *StateSession) {
+		s.Logger = l
 	}
+}
+
+func (s *StateSession) sessionLogFields() []any {
+	state, _ := s.logState.Load().(string)
+	sessionId, _ := s.logSessionId.Load().(string)
+	return []any{"session_id", sessionId, "state", state}
+}
+
+func NewStateSession(gateway string, compressed int, compressType compress.CompressType, dictVersion string, headerVersion int, opts ...StateSessionOption) *StateSession {
+	s := &StateSession{}
+	s.policy.Store(DefaultReconnectPolicy())
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.heartbeatReset = make(chan struct{}, 1)
 	s.Session.ReceiveFrameHandler = s.ReceiveFrameHandler
+	s.Session.FrameDispatchHandler = s.beginFrame
+	s.Session.FrameAckHandler = s.ackFrame
+	s.snWindow = newSnWindow(snPendingTimeout)
+	s.DedupStore = NewLRUDedupStore(DefaultDedupCapacity)
 	s.Compressed = compressed
 	s.CompressType = compressType
 	s.GateWay = gateway
 	s.RecvQueue = make(chan *event2.FrameMap)
 	s.CompressDictVersion = dictVersion
 	s.HeaderVersion = headerVersion
+	s.logState.Store(StatusStart)
+	s.logFields = s.sessionLogFields
 
 	//
 	s.FSM = fsm.NewFSM(
@@ -123,100 +195,162 @@ func NewStateSession(gateway string, compressed int, compressType compress.Compr
 			{Name: EventPongReceived, Src: []string{StatusConnected, StatusWSConnected, StatusRetry}, Dst: StatusConnected}, //??StatusWSConnected
 			{Name: EventHeartbeatTimeout, Src: []string{StatusConnected}, Dst: StatusRetry},
 			{Name: EventRetryHeartbeatTimeout, Src: []string{StatusRetry}, Dst: StatusGateway},
-			{Name: EventResumeReceivedOk, Src: []string{StatusWSConnected, StatusConnected}, Dst: StatusConnected},
+			{Name: EventResumeReceivedOk, Src: []string{StatusWSConnected, StatusConnected, StatusRetry}, Dst: StatusConnected},
 		},
 		fsm.Callbacks{
-			"enter_state": func(_ context.Context, e *fsm.Event) {
-				log.WithField("from", e.Src).WithField("to", e.Dst).Info("state change")
-			},
+			// 每个状态的enter回调中先通知状态变化，init/gateway的回调会阻塞在重试中，通用的enter_state回调会被延后到重试结束
 			EventEnterPrefix + StatusInit: func(_ context.Context, e *fsm.Event) {
+				s.notifyStateChange(e.Src, e.Dst, eventReason(e))
 				s.Retry(e, func() error { return s.GetGateway() }, nil)
 			},
 			EventEnterPrefix + StatusGateway: func(_ context.Context, e *fsm.Event) {
+				s.notifyStateChange(e.Src, e.Dst, eventReason(e))
 				s.Retry(e, func() error { return s.WsConnect() }, func() error { return s.wsConnectFail() })
 			},
 			EventEnterPrefix + StatusWSConnected: func(_ context.Context, e *fsm.Event) {
-
+				s.notifyStateChange(e.Src, e.Dst, eventReason(e))
 			},
 			EventEnterPrefix + StatusConnected: func(_ context.Context, e *fsm.Event) {
-				s.HeartBeatCron.Start()
+				s.notifyStateChange(e.Src, e.Dst, eventReason(e))
+				s.StartHeartbeat()
 				s.StartCheckHeartbeat()
 			},
 			EventEnterPrefix + StatusRetry: func(_ context.Context, e *fsm.Event) {
-				s.Retry(e, func() error { s.HeartBeatCron.Stop(); s.SendHeartBeat(); log.Info("重试发送心跳包"); return nil }, nil)
+				s.notifyStateChange(e.Src, e.Dst, eventReason(e))
+				s.Retry(e, func() error { return s.resumeOrReconnect() }, nil)
 			},
 		},
 	)
 
-	s.HeartBeatCron = cron.New()
-	interval := s.StatusParams[StatusConnected].MaxTime
-	s.HeartBeatCron.AddFunc(fmt.Sprintf("@every %ds", interval), func() {
-		s.SendHeartBeat()
-	})
-	s.Timeout = 7
-	s.PongTimeoutChan = make(chan time.Time, 10)
+	s.PongTimeoutChan = make(chan PongCheck, 10)
+	s.rtt = newRTTRing(DefaultRTTWindow)
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.initStatusParams()
 	return s
 }
 
+func (s *StateSession) initStatusParams() {
+	policy := s.ReconnectPolicy()
+	s.StatusParams = make(map[string]*StatusParam)
+	s.legacyParams = make(map[string]StatusParam)
+	for _, state := range []string{StatusInit, StatusGateway, StatusWSConnected, StatusConnected, StatusRetry} {
+		param := newStatusParam(state, policy)
+		s.StatusParams[state] = &param
+		s.legacyParams[state] = param
+	}
+	s.Timeout = int(policy.PongTimeout / time.Second)
+	s.legacyTimeout = s.Timeout
+}
+
+// applyStatusParams 把调用方修改过的StatusParams、Timeout合并到当前的ReconnectPolicy
+func (s *StateSession) applyStatusParams() {
+	policy := s.ReconnectPolicy().Clone()
+	changed := false
+	for state, param := range s.StatusParams {
+		if param == nil {
+			continue
+		}
+		if orig, ok := s.legacyParams[state]; ok && orig == *param {
+			continue
+		}
+		changed = true
+		if state == StatusConnected {
+			policy.HeartbeatInterval = time.Duration(param.MaxTime) * time.Second
+			continue
+		}
+		policy.States[state] = param.retryParam(policy.StateParam(state).Jitter)
+	}
+	if s.Timeout != s.legacyTimeout {
+		changed = true
+		policy.PongTimeout = time.Duration(s.Timeout) * time.Second
+	}
+	if !changed {
+		return
+	}
+	if err := s.SetReconnectPolicy(policy); err != nil {
+		s.logger().Error("invalid StatusParams, ignored", "err", err)
+	}
+}
+
+// ReconnectPolicy 返回当前生效的重试及心跳参数
+func (s *StateSession) ReconnectPolicy() *ReconnectPolicy {
+	return s.policy.Load()
+}
+
+// SetReconnectPolicy 校验并替换重试及心跳参数，可以在运行中调用，新的心跳间隔立即生效，重试参数在下一次重试时生效
+func (s *StateSession) SetReconnectPolicy(policy *ReconnectPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	s.policy.Store(policy.Clone())
+	select {
+	case s.heartbeatReset <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Stop 停止心跳及正在等待的重试，还没有写入的已确认sn立即写入
+func (s *StateSession) Stop() {
+	s.StopHeartbeat()
+	s.cancel()
+	s.snLock.Lock()
+	timer := s.snSaveTimer
+	s.snLock.Unlock()
+	if timer != nil && timer.Stop() {
+		s.saveAckedSn()
+	}
+}
+
 func (s *StateSession) Start() {
+	s.applyStatusParams()
 	if s.GateWay == "" {
-		s.FSM.SetState(StatusInit)
+		s.setState(StatusInit, nil)
 		s.Retry(nil, func() error { return s.GetGateway() }, nil)
 
 	} else {
-		s.FSM.SetState(StatusGateway)
+		s.setState(StatusGateway, nil)
 		s.Retry(nil, func() error { return s.WsConnect() }, func() error { return s.wsConnectFail() })
 	}
 	s.StartProcessEvent()
 }
 
 func (s *StateSession) GetGateway() error {
-	log.Info("state", "getGateway")
+	s.logger().Info("getGateway")
 	s.Trigger("status_getGateWay", nil)
 	err, gateWay := s.NetworkProxy.ReqGateWay()
 
 	if err == nil && gateWay != "" {
 		s.getGateWayOK(gateWay)
 	} else {
-		log.Error("getGateway error", err)
+		s.logger().Error("getGateway error", "err", err)
 		return errors.New("reqGateWay error")
 	}
 	return nil
 }
 
 func (s *StateSession) Retry(e *fsm.Event, handler func() error, errHandler func() error) {
-	log.Infof("Retry handler:%s", helper.GetFunctionName(handler))
-	startTime := s.StatusParams[s.FSM.Current()].StartTime
-	maxTime := s.StatusParams[s.FSM.Current()].MaxTime
-	maxRetry := s.StatusParams[s.FSM.Current()].MaxRetry
-	firstDelay := s.StatusParams[s.FSM.Current()].FirstDelay
+	s.logger().Debug("Retry handler", "handler", helper.GetFunctionName(handler))
+	param := s.ReconnectPolicy().StateParam(s.FSM.Current())
 	if e != nil {
-		if len(e.Args) > 0 {
-			if param, ok := e.Args[0].(*StatusParam); ok {
-				if param.StartTime > 0 {
-					startTime = param.StartTime
-				}
-				if param.MaxTime > 0 {
-					maxTime = param.MaxTime
-				}
-				if param.FirstDelay > 0 {
-					firstDelay = param.FirstDelay
-				}
-				if param.MaxRetry != 0 {
-					maxRetry = param.MaxRetry
-				}
-
+		for _, arg := range e.Args {
+			if override, ok := arg.(*RetryParam); ok {
+				param = param.merge(override)
 			}
 		}
 	}
 	//等待start时间开始
-	time.Sleep(time.Second * time.Duration(startTime))
+	if !sleepContext(s.ctx, param.StartDelay+jitter(param.Jitter)) {
+		return
+	}
 
 	//不用指数重试
-	if maxRetry == NO_RETRY {
+	if param.Attempts == NO_RETRY {
 		err := handler()
 		if err != nil {
-			log.WithError(err).Infof("Retry function error: %s", helper.GetFunctionName(handler))
+			s.logger().Warn("Retry function error", "err", err, "handler", helper.GetFunctionName(handler))
 			if errHandler != nil {
 				errHandler()
 			}
@@ -224,26 +358,34 @@ func (s *StateSession) Retry(e *fsm.Event, handler func() error, errHandler func
 		return
 	}
 
-	//指数重试
+	//指数重试，Jitter为0时retry.RandomDelay会panic，只在配置了Jitter时叠加随机时间
+	delayType := retry.BackOffDelay
+	if param.Jitter > 0 {
+		delayType = retry.CombineDelay(retry.BackOffDelay, retry.RandomDelay)
+	}
 	err := retry.Do(
 		handler,
-		retry.DelayType(retry.BackOffDelay),
-		retry.Delay(time.Second*time.Duration(firstDelay)),
-		retry.MaxDelay(time.Second*time.Duration(maxTime)),
-		retry.Attempts(uint(maxRetry)),
-		retry.OnRetry(func(n uint, err error) { log.WithError(err).Infof("try %d times call function %s", n, handler) }),
+		retry.Context(s.ctx),
+		retry.DelayType(delayType),
+		retry.Delay(param.FirstDelay),
+		retry.MaxDelay(param.MaxDelay),
+		retry.MaxJitter(param.Jitter),
+		retry.Attempts(uint(param.Attempts)),
+		retry.OnRetry(func(n uint, err error) {
+			s.logger().Warn("Retry function error", "err", err, "attempt", n, "handler", helper.GetFunctionName(handler))
+		}),
 	)
-	if err != nil && errHandler != nil {
+	if err != nil && s.ctx.Err() == nil && errHandler != nil {
 		errHandler()
 	}
 }
 
 func (s *StateSession) getGateWayOK(gateWay string) {
-	log.WithField("gateway", gateWay).Info("GetGatewayOk")
+	s.logger().Info("GetGatewayOk", "gateway", gateWay)
 	s.GateWay = gateWay
 	err := s.FSM.Event(context.Background(), EventGotGateway)
 	if err != nil {
-		log.Error(err)
+		s.logger().Error("fsm event", "err", err, "event", EventGotGateway)
 	}
 }
 
@@ -253,58 +395,141 @@ func (s *StateSession) WsConnect() error {
 }
 
 func (s *StateSession) wsConnectFail() error {
-	log.Warn("wsConnectFail")
-	err := s.FSM.Event(context.Background(), EventWsConnectFail)
+	s.logger().Warn("wsConnectFail")
+	err := s.FSM.Event(context.Background(), EventWsConnectFail, ErrWsConnectFail)
 	if err != nil {
-		log.Error(err)
+		s.logger().Error("fsm event", "err", err, "event", EventWsConnectFail)
 	}
 	return nil
 }
 
 func (s *StateSession) wsConnectOk() {
 	if s.Compressed == 1 {
+		// 流式解压的上下文和连接绑定，每次连接都需要新的解压器
+		compress.RecycleDecompressor(s.CompressType, s.Decompressor)
 		s.Decompressor = compress.GetDecompressor(s.CompressType)
 	}
-	log.Info("wsConnectOk")
+	s.resetCompressor()
+	s.record(s.newRecord(RecordKindConnect, nil, ""))
+	s.logger().Info("wsConnectOk")
 	err := s.FSM.Event(context.Background(), EventWsConnected)
 	if err != nil {
-		log.Error(err)
+		s.logger().Error("fsm event", "err", err, "event", EventWsConnected)
 	}
 
 }
 
 func (s *StateSession) helloFail() {
-	log.Info("helloFail")
-	err := s.FSM.Event(context.Background(), EventHelloFail)
+	s.logger().Warn("helloFail")
+	err := s.FSM.Event(context.Background(), EventHelloFail, ErrHelloFail)
 	if err != nil {
-		log.Error(err)
+		s.logger().Error("fsm event", "err", err, "event", EventHelloFail)
 	}
 
 }
 
 func (s *StateSession) receiveHello(frameMap *event2.FrameMap) {
 	code := 40100
-	if _code, ok := frameMap.Data["code"]; ok {
-		code = int(_code.(float64))
+	if _code, ok, err := frameMap.DataInt64Field("code"); err != nil {
+		s.frameError(err, s.frameData(frameMap))
+	} else if ok {
+		code = int(_code)
 	}
 	if code == 0 {
-		s.LastPongAt = time.Now()
-		log.Info("receiveHello")
-		s.SaveSessionId(frameMap.Data["sessionId"].(string))
+		s.markPong()
+		s.logger().Info("receiveHello")
+		sessionId, err := helloSessionId(frameMap)
+		if err != nil {
+			s.frameError(err, s.frameData(frameMap))
+		}
+		s.SaveSessionId(sessionId)
 		s.FSM.Event(context.Background(), EventHelloReceived)
 	} else {
-		log.Warn("connectFailed", code)
+		s.logger().Warn("connectFailed", "code", code)
 		if helper.SliceContains([]int{40100, 40101, 40102, 40103}, code) {
 
-			s.FSM.Event(context.Background(), EventHelloGatewayErrFail, &StatusParam{StartTime: 6})
+			s.FSM.Event(context.Background(), EventHelloGatewayErrFail, &RetryParam{StartDelay: 6 * time.Second}, fmt.Errorf("%w: code %d", ErrHelloFail, code))
 		}
 	}
 }
 
+// helloSessionId 读取hello中的session_id，兼容旧的sessionId
+func helloSessionId(frameMap *event2.FrameMap) (string, error) {
+	for _, key := range []string{"session_id", "sessionId"} {
+		if v, ok, err := frameMap.DataStringField(key); err != nil || ok {
+			return v, err
+		}
+	}
+	return "", &event2.FrameError{Field: "d.session_id", Reason: "missing"}
+}
+
 func (s *StateSession) SaveSessionId(sessionId string) {
+	s.snLock.Lock()
+	if sessionId != s.SessionId {
+		// 新的session的sn从头开始
+		s.MaxSn = 0
+		s.snWindow.reset()
+	}
 	s.SessionId = sessionId
+	s.snLock.Unlock()
+	s.DedupScope = sessionId
+	s.logSessionId.Store(sessionId)
 	s.NetworkProxy.SaveSessionId(sessionId)
 }
+
+// AckedSn 返回已确认的最大sn，比它小的sn都已经处理成功
+func (s *StateSession) AckedSn() int64 {
+	s.snLock.Lock()
+	defer s.snLock.Unlock()
+	return s.MaxSn
+}
+
+// ackedSession 返回session id及已确认的最大sn
+func (s *StateSession) ackedSession() (string, int64) {
+	s.snLock.Lock()
+	defer s.snLock.Unlock()
+	return s.SessionId, s.MaxSn
+}
+
+// beginFrame 记录开始分发的sn，处理成功前MaxSn不会越过它
+func (s *StateSession) beginFrame(frame *event2.FrameMap) {
+	s.snLock.Lock()
+	defer s.snLock.Unlock()
+	s.snWindow.begin(frame.SerialNumber)
+}
+
+// ackFrame handler确认处理完成后推进连续确认的MaxSn并持久化，进程重启resume时服务端会重发未确认的事件
+func (s *StateSession) ackFrame(frame *event2.FrameMap) {
+	s.snLock.Lock()
+	defer s.snLock.Unlock()
+	mark, expired := s.snWindow.ack(frame.SerialNumber)
+	if len(expired) > 0 {
+		s.logger().Warn("give up unacked sn", "sn", expired, "timeout", s.snWindow.timeout)
+	}
+	if mark <= s.MaxSn {
+		return
+	}
+	s.MaxSn = mark
+	if s.NetworkProxy == nil || s.SessionId == "" || s.snSaveTimer != nil {
+		return
+	}
+	s.snSaveTimer = time.AfterFunc(time.Until(s.snSavedAt.Add(snSaveInterval)), s.saveAckedSn)
+}
+
+// saveAckedSn 持久化已确认的sn，ackFrame中限制写入频率
+func (s *StateSession) saveAckedSn() {
+	s.snLock.Lock()
+	s.snSaveTimer = nil
+	s.snSavedAt = time.Now()
+	sessionId, sn := s.SessionId, s.MaxSn
+	s.snLock.Unlock()
+	if sessionId == "" {
+		return
+	}
+	if err := s.NetworkProxy.SaveSessionId(sessionId); err != nil {
+		s.logger().Error("save acked sn error", "err", err, "sn", sn)
+	}
+}
 func (s *StateSession) StartProcessEvent() {
 	go func() {
 		for {
@@ -322,9 +547,6 @@ func (s *StateSession) ReceiveFrameHandler(frame *event2.FrameMap) (error, []byt
 	case event2.SIG_EVENT:
 		{
 			if s.FSM.Current() == StatusConnected {
-				if frame.SerialNumber > s.MaxSn {
-					s.MaxSn = frame.SerialNumber
-				}
 				s.RecvQueue <- frame
 			}
 		}
@@ -342,7 +564,11 @@ func (s *StateSession) ReceiveFrameHandler(frame *event2.FrameMap) (error, []byt
 		}
 	case event2.SIG_RECONNECT:
 		{
-			s.Reconnect()
+			reason := ErrServerReconnect
+			if v, ok := frame.DataString("err"); ok && v != "" {
+				reason = fmt.Errorf("%w: %s", ErrServerReconnect, v)
+			}
+			s.reconnect(reason)
 		}
 
 	}
@@ -350,97 +576,166 @@ func (s *StateSession) ReceiveFrameHandler(frame *event2.FrameMap) (error, []byt
 
 }
 func (s *StateSession) NAck(sns []int64) error {
-	nackFrame := event2.NewNAckFrame(sns)
-	if s.NetworkProxy != nil {
-		data, err := sonic.Marshal(nackFrame)
-		if err != nil {
-			log.WithError(err).Error("sendHeartBeat unmarsal fail")
-			return err
-		}
-		log.WithField("frame", string(data)).Info("Send nack")
-		err = s.NetworkProxy.SendData(data)
-		if err != nil {
-			log.WithField("err", err).Error("SendNAck failed!")
-			return err
-		}
+	err := s.sendSignal(event2.NewNAckSignal(sns))
+	if err != nil {
+		s.logger().Error("SendNAck failed!", "err", err, "sn_list", sns)
+		return err
 	}
 	return nil
 }
 func (s *StateSession) SendHeartBeat() error {
-	sn := s.MaxSn
-	pingFrame := event2.NewPingFrame(sn)
+	sn := s.AckedSn()
 	if s.NetworkProxy != nil {
-		data, err := sonic.Marshal(pingFrame)
+		pingAt := s.markPing()
+		s.pingPending.Store(true)
+		err := s.sendSignal(event2.NewPingSignal(sn))
 		if err != nil {
-			log.WithError(err).Error("sendHeartBeat unmarsal fail")
-			return err
-		}
-		s.LastPingAt = time.Now()
-		log.WithField("ping", string(data)).Info("Send Ping")
-		err = s.NetworkProxy.SendData(data)
-		if err != nil {
-			log.WithField("err", err).Error("SendHeartBeat failed!")
+			s.logger().Error("SendHeartBeat failed!", "err", err, "sn", sn)
 			//发送错误，立即认为pong过期
-			s.PongTimeoutChan <- s.LastPingAt.Add(-1)
+			s.PongTimeoutChan <- PongCheck{PingAt: pingAt, TimeoutAt: pingAt.Add(-1)}
 			return err
 		} else {
-			s.PongTimeoutChan <- s.LastPingAt.Add(time.Duration(s.Timeout) * time.Second)
+			s.PongTimeoutChan <- PongCheck{PingAt: pingAt, TimeoutAt: pingAt.Add(s.pongTimeout())}
 		}
 	}
 	return nil
 }
 
+// StartHeartbeat 按照ReconnectPolicy.HeartbeatInterval定时发送心跳包，已经启动时不做处理
 func (s *StateSession) StartHeartbeat() error {
-
-	s.HeartBeatCron.Start()
+	s.heartbeatLock.Lock()
+	defer s.heartbeatLock.Unlock()
+	if s.heartbeatCancel != nil {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.heartbeatCancel = cancel
+	go s.heartbeatLoop(ctx)
 	return nil
 }
 
+// StopHeartbeat 停止定时发送心跳包
+func (s *StateSession) StopHeartbeat() {
+	s.heartbeatLock.Lock()
+	defer s.heartbeatLock.Unlock()
+	if s.heartbeatCancel != nil {
+		s.heartbeatCancel()
+		s.heartbeatCancel = nil
+	}
+}
+
+func (s *StateSession) heartbeatLoop(ctx context.Context) {
+	timer := time.NewTimer(s.ReconnectPolicy().HeartbeatInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.heartbeatReset:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(s.ReconnectPolicy().HeartbeatInterval)
+		case <-timer.C:
+			s.SendHeartBeat()
+			timer.Reset(s.ReconnectPolicy().HeartbeatInterval)
+		}
+	}
+}
+
 func (s *StateSession) RetryHeartbeat() error {
 	return s.SendHeartBeat()
 }
 
+// markPing 记录发送心跳包的时间
+func (s *StateSession) markPing() time.Time {
+	now := time.Now()
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	s.LastPingAt = now
+	return now
+}
+
+// markPong 记录收到pong的时间，同时返回最近一次发送心跳包的时间
+func (s *StateSession) markPong() (pingAt, pongAt time.Time) {
+	now := time.Now()
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	s.LastPongAt = now
+	return s.LastPingAt, now
+}
+
+func (s *StateSession) lastPong() time.Time {
+	s.healthLock.RLock()
+	defer s.healthLock.RUnlock()
+	return s.LastPongAt
+}
+
 func (s *StateSession) receivePong(frame *event2.FrameMap) {
-	log.Infof("receivePong %+v", frame)
-	s.FSM.Event(context.Background(), EventPongReceived)
-	s.LastPongAt = time.Now()
+	s.logger().Debug("receivePong")
+	pingAt, pongAt := s.markPong()
+	spike := false
+	if s.pingPending.CompareAndSwap(true, false) {
+		rtt := pongAt.Sub(pingAt)
+		spike = s.recordRTT(rtt)
+		s.metrics().HeartbeatRTT(rtt)
+		if spike {
+			s.logger().Warn("heartbeat rtt spike", "rtt", rtt, "stats", s.RTTStats())
+		}
+	}
+	s.FSM.Event(context.Background(), EventPongReceived, s.retryRecovery(RecoveryHeartbeat, nil))
+	if spike && s.FSM.Current() == StatusConnected {
+		s.FSM.Event(context.Background(), EventHeartbeatTimeout, ErrRTTSpike)
+	}
 }
 
 func (s *StateSession) StartCheckHeartbeat() {
-	log.Info("Start heartBeatTimeout check")
+	s.logger().Debug("Start heartBeatTimeout check")
 	go func() { //nolint:wsl
 		for {
 			select {
-			case pongTimeoutAt := <-s.PongTimeoutChan:
+			case <-s.ctx.Done():
+				return
+			case check := <-s.PongTimeoutChan:
 				{
-					log.WithField("pongTimeoutAt", pongTimeoutAt).WithField("state", s.FSM.Current()).Info("Pong收取超时检测开始")
+					s.logger().Debug("Pong收取超时检测开始", "pongTimeoutAt", check.TimeoutAt)
 					if s.FSM.Current() != StatusConnected && s.FSM.Current() != StatusRetry {
 						continue
 					}
-					if time.Now().Before(pongTimeoutAt) {
-						time.Sleep(time.Until(pongTimeoutAt.Add(1 * time.Second)))
+					if time.Now().Before(check.TimeoutAt) {
+						if !sleepContext(s.ctx, time.Until(check.TimeoutAt.Add(s.ReconnectPolicy().pongCheckDelay()))) {
+							return
+						}
 					}
 
-					if time.Now().After(pongTimeoutAt) { //nolint:nestif
+					if time.Now().After(check.TimeoutAt) { //nolint:nestif
 						// 还没有到的timeout检查时间点
-						// 最后收到Pong时间比（约定检查时间-最大过期时间）早，表示在过去的约定的过期时间内及之后没有收到Pong
-						if s.LastPongAt.Before(pongTimeoutAt.Add(-time.Duration(s.Timeout) * time.Second)) {
-							log.Infof("Pong not received before:%s", pongTimeoutAt)
-							if s.FSM.Current() == StatusConnected {
-								err := s.FSM.Event(context.Background(), EventHeartbeatTimeout)
+						// 最后收到Pong时间比发送Ping的时间早，表示在过去的约定的过期时间内及之后没有收到Pong
+						if s.lastPong().Before(check.PingAt) {
+							s.logger().Warn("Pong not received", "pongTimeoutAt", check.TimeoutAt)
+							// 一次超时只做一次状态变化，刚进入retry时需要等待resume的结果
+							state := s.FSM.Current()
+							if state == StatusConnected {
+								err := s.FSM.Event(context.Background(), EventHeartbeatTimeout, ErrHeartbeatTimeout)
 								if err != nil {
-									log.Error(err)
+									s.logger().Error("fsm event", "err", err, "event", EventHeartbeatTimeout)
 								}
 							}
-							if s.FSM.Current() == StatusRetry {
-								err := s.FSM.Event(context.Background(), EventRetryHeartbeatTimeout)
+							if state == StatusRetry {
+								// resume没有在超时时间内收到ack，重新建立连接
+								reason := &Recovery{Path: RecoveryReconnect, Cause: ErrHeartbeatTimeout}
+								s.resumePending.Store(false)
+								err := s.FSM.Event(context.Background(), EventRetryHeartbeatTimeout, reason)
 								if err != nil {
-									log.Error(err)
-									s.FSM.Event(context.Background(), EventRetryHeartbeatTimeout)
+									s.logger().Error("fsm event", "err", err, "event", EventRetryHeartbeatTimeout)
+									s.FSM.Event(context.Background(), EventRetryHeartbeatTimeout, reason)
 								}
 							}
 						} else {
-							s.FSM.Event(context.Background(), EventPongReceived)
+							s.FSM.Event(context.Background(), EventPongReceived, s.retryRecovery(RecoveryHeartbeat, nil))
 						}
 					}
 				}
@@ -451,20 +746,24 @@ func (s *StateSession) StartCheckHeartbeat() {
 
 func (s *StateSession) ResumeOk() {
 	s.Trigger("status_resumeOk", nil)
-	log.Info("resumeOk")
+	s.logger().Info("resumeOk", "pending", s.resumePending.Load())
+	s.resumePending.Store(false)
 	if s.FSM.Current() != StatusConnected {
-		s.FSM.Event(context.Background(), EventResumeReceivedOk)
+		s.FSM.Event(context.Background(), EventResumeReceivedOk, s.retryRecovery(RecoveryResume, nil))
 	}
 }
 
 func (s *StateSession) Reconnect() {
+	s.reconnect(ErrServerReconnect)
+}
+
+func (s *StateSession) reconnect(reason error) {
 	s.Trigger("status_reconnect", nil)
-	log.Info("reconnect")
-	s.HeartBeatCron.Stop()
+	s.logger().Info("reconnect", "reason", reason)
+	s.StopHeartbeat()
 	s.GateWay = ""
 	//s.RecvQueue = make(chan *event2.FrameMap)
-	s.MaxSn = 0
 	s.SaveSessionId("")
-	s.FSM.SetState(StatusInit)
+	s.setState(StatusInit, reason)
 	s.Retry(nil, func() error { return s.GetGateway() }, nil)
 }
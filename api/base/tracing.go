@@ -0,0 +1,94 @@
+package base
+
+import (
+	"context"
+
+	"github.com/gookit/event"
+	event2 "github.com/kaiheila/golang-bot/api/base/event"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName session创建span时使用的tracer名称
+const TracerName = "github.com/kaiheila/golang-bot/api/base"
+
+// EventDataContextKey 事件数据中的context.Context，带有当前事件的span，用EventContext读取
+const EventDataContextKey = "ctx"
+
+// WithTracerProvider 设置创建span使用的TracerProvider，默认为otel.GetTracerProvider()，没有设置全局provider时不采集
+func WithTracerProvider(tp trace.TracerProvider) StateSessionOption {
+	return func(s *StateSession) {
+		s.TracerProvider = tp
+	}
+}
+
+// WithTraceEventIds 设置事件span是否带有target_id、msg_id属性，导出到外部的trace系统前请确认符合隐私要求
+func WithTraceEventIds(enabled bool) StateSessionOption {
+	return func(s *StateSession) {
+		s.TraceEventIds = enabled
+	}
+}
+
+func (s *Session) tracer() trace.Tracer {
+	tp := s.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(TracerName)
+}
+
+// startEventSpan 为收到的事件创建span，handler中的REST请求作为它的子span
+func (s *Session) startEventSpan(ctx context.Context, name, channelType string, eventType int64, frame *event2.FrameMap) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("kook.channel_type", channelType),
+		attribute.Int64("kook.type", eventType),
+		attribute.Int64("kook.sn", frame.SerialNumber),
+	}
+	if s.TraceEventIds {
+		if targetId, ok := frame.DataString("target_id"); ok {
+			attrs = append(attrs, attribute.String("kook.target_id", targetId))
+		}
+		if msgId, ok := frame.DataString("msg_id"); ok {
+			attrs = append(attrs, attribute.String("kook.msg_id", msgId))
+		}
+	}
+	return s.tracer().Start(ctx, "kook.event "+name, trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(attrs...))
+}
+
+// injectTrace 把ctx中的span按W3C trace context格式写入map，和事件一起保存到队列中
+func injectTrace(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// extractTrace 从队列中的trace context恢复父span
+func extractTrace(carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return context.Background()
+	}
+	return propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier(carrier))
+}
+
+// endSpan handler返回错误时把span标记为失败
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// EventContext 返回事件数据中的context，handler把它传给ApiHelper.SetContext，REST请求会成为事件span的子span
+func EventContext(e event.Event) context.Context {
+	if ctx, ok := e.Get(EventDataContextKey).(context.Context); ok && ctx != nil {
+		return ctx
+	}
+	return context.Background()
+}
@@ -0,0 +1,137 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gookit/event"
+	"github.com/kaiheila/golang-bot/api/helper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanAttr(span sdktrace.ReadOnlySpan, key string) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestEventTrace(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"code":0}`))
+	}))
+	defer srv.Close()
+	recorder := tracetest.NewSpanRecorder()
+	s := &Session{EventSyncHandle: true, TraceEventIds: true, TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))}
+	// 事件总线是全局的，-count>1时使用新的事件名，避免上一次注册的handler也被调用
+	channelType := fmt.Sprintf("TRACETEST%d", time.Now().UnixNano())
+	s.On(channelType+"_9", event.ListenerFunc(func(e event.Event) error {
+		_, err := helper.NewApiHelper("/v3/message/create", "token", srv.URL, "", "").SetContext(EventContext(e)).SetBody([]byte(`{}`)).Post()
+		return err
+	}))
+	s.On(channelType+"_1", event.ListenerFunc(func(e event.Event) error {
+		return errors.New("handler failed")
+	}))
+
+	s.ReceiveData([]byte(fmt.Sprintf(`{"s":0,"sn":7,"d":{"type":9,"channel_type":"%s","target_id":"c1","msg_id":"m1"}}`, channelType)))
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans", len(spans))
+	}
+	api, evt := spans[0], spans[1]
+	if evt.Name() != "kook.event "+channelType+"_9" || api.Name() != "POST /v3/message/create" {
+		t.Fatalf("span names %q %q", evt.Name(), api.Name())
+	}
+	if api.Parent().SpanID() != evt.SpanContext().SpanID() {
+		t.Fatal("api span is not a child of the event span")
+	}
+	if spanAttr(evt, "kook.sn").AsInt64() != 7 || spanAttr(evt, "kook.target_id").AsString() != "c1" || spanAttr(evt, "kook.msg_id").AsString() != "m1" {
+		t.Fatalf("event attributes %v", evt.Attributes())
+	}
+	if spanAttr(api, "http.response.status_code").AsInt64() != 200 {
+		t.Fatalf("api attributes %v", api.Attributes())
+	}
+
+	s.ReceiveData([]byte(fmt.Sprintf(`{"s":0,"sn":8,"d":{"type":1,"channel_type":"%s","msg_id":"m2"}}`, channelType)))
+	spans = recorder.Ended()
+	if last := spans[len(spans)-1]; last.Status().Code != codes.Error {
+		t.Fatalf("failed handler span status %v", last.Status())
+	}
+}
+
+func TestEventTraceIdsOptIn(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	s := &Session{EventSyncHandle: true, TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))}
+	channelType := fmt.Sprintf("TRACEIDTEST%d", time.Now().UnixNano())
+	s.ReceiveData([]byte(fmt.Sprintf(`{"s":0,"sn":7,"d":{"type":9,"channel_type":"%s","target_id":"c1","msg_id":"m1"}}`, channelType)))
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans", len(spans))
+	}
+	if spanAttr(spans[0], "kook.target_id").Type() != attribute.INVALID || spanAttr(spans[0], "kook.msg_id").Type() != attribute.INVALID {
+		t.Fatalf("ids recorded without TraceEventIds: %v", spans[0].Attributes())
+	}
+}
+
+func TestWebhookQueueTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	s := NewWebhookSession("", "", 0)
+	s.TracerProvider = tp
+	handled := make(chan struct{}, 1)
+	channelType := fmt.Sprintf("QUEUETRACETEST%d", time.Now().UnixNano())
+	s.On(channelType+"_9", event.ListenerFunc(func(e event.Event) error {
+		handled <- struct{}{}
+		return nil
+	}))
+	queue := NewMemoryFrameQueue()
+	s.StartWorkers(queue, 1)
+	// 模拟otelhttp等中间件，请求的context中带有server span
+	handler := s.Handler()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tp.Tracer("test").Start(r.Context(), "webhook request")
+		defer span.End()
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	}))
+	defer srv.Close()
+
+	body := fmt.Sprintf(`{"s":0,"sn":1,"d":{"type":9,"channel_type":"%s","msg_id":"m1"}}`, channelType)
+	resp, err := http.Post(srv.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not handled")
+	}
+	if err = s.StopWorkers(); err != nil {
+		t.Fatal(err)
+	}
+	var request, evt sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "webhook request":
+			request = span
+		case "kook.event " + channelType + "_9":
+			evt = span
+		}
+	}
+	if request == nil || evt == nil {
+		t.Fatalf("spans %v", recorder.Ended())
+	}
+	if evt.Parent().SpanID() != request.SpanContext().SpanID() || evt.SpanContext().TraceID() != request.SpanContext().TraceID() {
+		t.Fatal("queued event span is not a child of the webhook request span")
+	}
+}
@@ -0,0 +1,76 @@
+package base
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/kaiheila/golang-bot/api/helper/compress"
+)
+
+// Handler 返回处理webhook请求的http.Handler，不依赖请求路径，可以挂载在任意路由下
+// 只接受POST请求，请求体超过MaxBodySize时返回413，解密失败返回400，verify token错误返回401，超出防重放窗口返回409
+// 窗口内重复的事件不会再次分发，但仍然返回200，避免服务端继续重试
+func (s *WebhookSession) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeWebhookError(w, http.StatusMethodNotAllowed)
+			return
+		}
+		maxBodySize := s.MaxBodySize
+		if maxBodySize <= 0 {
+			maxBodySize = DefaultWebhookMaxBodySize
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				s.logger().Warn("webhook body too large", "limit", maxBodySize)
+				writeWebhookError(w, http.StatusRequestEntityTooLarge)
+				return
+			}
+			s.logger().Error("Read req body error", "err", err)
+			writeWebhookError(w, http.StatusBadRequest)
+			return
+		}
+		err, resData := s.receiveDataWithEncoding(r.Context(), body, r.Header.Get("Content-Encoding"))
+		if err != nil {
+			s.logger().Error("handle webhook req err", "err", err)
+			writeWebhookError(w, webhookErrorStatus(err))
+			return
+		}
+		if len(resData) == 0 {
+			resData = []byte("{}")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(resData)
+	})
+}
+
+// webhookErrorStatus 根据处理错误返回http状态码
+func webhookErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrWebhookVerifyToken):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrWebhookReplay):
+		return http.StatusConflict
+	case errors.Is(err, ErrWebhookQueue):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrWebhookHandler):
+		return http.StatusInternalServerError
+	case errors.Is(err, compress.ErrUnsupportedEncoding):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, compress.ErrDecompressLimit):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func writeWebhookError(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write([]byte(`{"error":"` + http.StatusText(status) + `"}`))
+}
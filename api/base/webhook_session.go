@@ -1,17 +1,64 @@
 package base
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/bytedance/sonic"
 	event2 "github.com/kaiheila/golang-bot/api/base/event"
 	"github.com/kaiheila/golang-bot/api/helper"
-	log "github.com/sirupsen/logrus"
+	compress2 "github.com/kaiheila/golang-bot/api/helper/compress"
+	"sync"
+	"time"
+)
+
+var (
+	ErrWebhookVerifyToken = errors.New("webhook verify token error")
+	ErrWebhookDecrypt     = errors.New("webhook decrypt error")
+	ErrWebhookReplay      = errors.New("webhook event out of replay window")
+	ErrWebhookQueue       = errors.New("webhook push queue error")
+	ErrWebhookHandler     = errors.New("webhook event handler error")
+)
+
+// DefaultWebhookReplayWindow 默认的防重放时间窗口
+const DefaultWebhookReplayWindow = 10 * time.Minute
+
+// DefaultWebhookMaxBodySize webhook请求体的默认大小限制
+const DefaultWebhookMaxBodySize = 1 << 20
+
+const (
+	// DefaultWebhookMaxAttempts 队列中的事件默认最多处理的次数
+	DefaultWebhookMaxAttempts = 5
+	// DefaultWebhookRetryDelay handler失败后第一次重试的默认等待时间，之后每次翻倍
+	DefaultWebhookRetryDelay = time.Second
+	// webhookMaxRetryDelay 重试等待时间的上限
+	webhookMaxRetryDelay = time.Minute
 )
 
 type WebhookSession struct {
 	Session
 	EncryptKey  string
 	VerifyToken string
+	// MaxBodySize Handler读取请求体的大小限制，<=0时使用DefaultWebhookMaxBodySize
+	MaxBodySize int64
+	// ReplayWindow msg_timestamp与当前时间相差超过该时间的事件会被丢弃，<=0时不检查
+	// 窗口内重复的sn/msg_id由Session.DedupStore过滤，多个副本部署时需要替换为共享的DedupStore
+	ReplayWindow time.Duration
+	// Queue 不为空时，事件校验通过后写入队列并立即应答服务端，由StartWorkers启动的worker处理
+	Queue FrameQueue
+	// MaxAttempts 队列中的事件最多处理的次数，一直失败的事件交给DeadLetterHandler后Ack，<=0时使用DefaultWebhookMaxAttempts
+	MaxAttempts int
+	// RetryDelay handler失败后第一次重试的等待时间，之后每次翻倍，<=0时使用DefaultWebhookRetryDelay
+	RetryDelay time.Duration
+	// DeadLetterHandler 超过MaxAttempts仍然处理失败的事件，为空时只记录日志
+	DeadLetterHandler func(data []byte, err error)
+	workerWg          sync.WaitGroup
+	workerNum         int
+	// attempts 队列中每个事件失败的次数，进程重启后重新计数
+	attempts     map[uint64]int
+	attemptsLock sync.Mutex
 }
 
 func NewWebhookSession(encryptKey, verityToken string, compress int) *WebhookSession {
@@ -23,11 +70,41 @@ func NewWebhookSession(encryptKey, verityToken string, compress int) *WebhookSes
 		session.VerifyToken = verityToken
 	}
 	session.Compressed = compress
+	if compress == 1 {
+		session.CompressType = compress2.CompressTypeZlibPerMessage
+		session.Decompressor = compress2.GetDecompressor(session.CompressType)
+	}
+	session.ReplayWindow = DefaultWebhookReplayWindow
+	session.DedupStore = NewTTLDedupStore(DefaultWebhookReplayWindow, DefaultDedupCapacity)
+	session.DedupScope = "webhook"
 	session.Session.ProcessDataHandler = session.ProcessData
 	session.Session.ReceiveFrameHandler = session.ReceiveFrameHandler
+	session.Session.receiveFrameContextHandler = session.receiveFrameContext
 	return session
 }
 
+// ReceiveDataWithEncoding 处理webhook请求，contentEncoding为请求头中的Content-Encoding
+// contentEncoding为空时按创建session时的compress参数解压，否则按contentEncoding选择解压器
+func (s *WebhookSession) ReceiveDataWithEncoding(data []byte, contentEncoding string) (error, []byte) {
+	return s.receiveDataWithEncoding(context.Background(), data, contentEncoding)
+}
+
+// receiveDataWithEncoding ctx为http请求的context，事件的span(包括写入队列后由worker处理的事件)以它为父span
+func (s *WebhookSession) receiveDataWithEncoding(ctx context.Context, data []byte, contentEncoding string) (error, []byte) {
+	if contentEncoding == "" {
+		return s.receiveDataContext(ctx, data)
+	}
+	compressType, err := compress2.ParseContentEncoding(contentEncoding)
+	if err != nil {
+		s.logger().Error("ReceiveDataWithEncoding", "err", err, "encoding", contentEncoding)
+		return err, nil
+	}
+	// 按消息压缩的解压器没有连接级别的状态，可以在请求之间并发使用
+	decompressor := compress2.GetDecompressor(compressType)
+	defer compress2.RecycleDecompressor(compressType, decompressor)
+	return s.receiveData(ctx, data, decompressor, contentEncoding)
+}
+
 func (s *WebhookSession) ProcessData(data []byte) (err error, data2 []byte) {
 	//如果有加密，则对数据进行解密
 	if s.EncryptKey == "" {
@@ -39,53 +116,222 @@ func (s *WebhookSession) ProcessData(data []byte) (err error, data2 []byte) {
 		return err, nil
 	}
 	if jdata.Get("encrypt").Exists() == false {
-		log.Error("Encrypt_Data Not Exist", string(data))
-		err = errors.New("Encrypt_Data Not Exist")
+		s.logger().Error("Encrypt_Data Not Exist", "data", string(data))
+		err = fmt.Errorf("%w: encrypt data not exist", ErrWebhookDecrypt)
 		return
 	}
 	encryptText, err := jdata.Get("encrypt").String()
 	if err != nil {
-		log.Error(err)
+		s.logger().Error("encrypt is not a string", "err", err)
+		err = fmt.Errorf("%w: %w", ErrWebhookDecrypt, err)
 		return
 	}
 	//log.Tracef("encryptText:%s", encryptText)
 	err, plainByte := helper.DecryptData(encryptText, s.EncryptKey)
 	if err != nil {
-		log.WithError(err).Error("DecryptData failed")
+		s.logger().Warn("DecryptData failed", "err", err)
+		err = fmt.Errorf("%w: %w", ErrWebhookDecrypt, err)
 		return
 	}
 	return nil, plainByte
 }
 
 func (s *WebhookSession) ReceiveFrameHandler(frame *event2.FrameMap) (error, []byte) {
+	return s.receiveFrameContext(context.Background(), frame)
+}
+
+func (s *WebhookSession) receiveFrameContext(ctx context.Context, frame *event2.FrameMap) (error, []byte) {
 	if s.VerifyToken != "" {
-		gotVerifyToken := ""
-		if v, ok := frame.Data["verify_token"]; ok {
-			gotVerifyToken = v.(string)
-		}
-		if gotVerifyToken != s.VerifyToken {
-			log.WithField("gotVerifyToken", gotVerifyToken).Error("gotVerifyToken Error")
-			return errors.New("VerifyToken error"), nil
+		gotVerifyToken, _ := frame.DataString("verify_token")
+		// 常量时间比较，避免通过响应耗时猜测verify token
+		if subtle.ConstantTimeCompare([]byte(gotVerifyToken), []byte(s.VerifyToken)) != 1 {
+			s.logger().Error("gotVerifyToken Error", "gotVerifyToken", gotVerifyToken)
+			return ErrWebhookVerifyToken, nil
 		}
 	}
+	if err := s.checkReplay(frame); err != nil {
+		s.logger().Warn("drop webhook replay", "err", err, "sn", frame.SerialNumber, "frame", frame)
+		return err, nil
+	}
 	retData := make(map[string]interface{})
 	if frame.SignalType == event2.SIG_EVENT {
-		if _, ok := frame.Data["type"]; ok {
-			if challenge, ok := frame.Data["challenge"]; ok {
+		if _, ok := frame.DataValue("type"); ok {
+			if challenge, ok := frame.DataValue("challenge"); ok {
 				retData["challenge"] = challenge
 			}
 		}
 	}
-	s.Session.ReceiveFrame(frame)
+	if err := s.receiveFrame(ctx, frame, len(retData) > 0); err != nil {
+		return err, nil
+	}
 	retByte, err := sonic.Marshal(retData)
 	if err != nil {
-		log.WithError(err).Error("marshal retData error")
+		s.logger().Error("marshal retData error", "err", err)
 		return err, nil
 	}
 	return nil, retByte
 
 }
 
+// queuedFrame 写入队列的事件，Trace为http请求的trace context，worker处理事件时作为父span
+type queuedFrame struct {
+	Frame json.RawMessage   `json:"frame"`
+	Trace map[string]string `json:"trace,omitempty"`
+}
+
+// receiveFrame 开启队列时把事件写入队列，challenge需要在应答中返回，直接处理
+func (s *WebhookSession) receiveFrame(ctx context.Context, frame *event2.FrameMap, inline bool) error {
+	if s.Queue == nil || inline {
+		// 同步处理时返回handler的错误，应答5xx让服务端重试；frame格式错误仍然按请求错误应答
+		err, _ := s.Session.ReceiveFrameContext(ctx, frame)
+		var frameErr *event2.FrameError
+		if err != nil && !errors.As(err, &frameErr) {
+			return fmt.Errorf("%w: %w", ErrWebhookHandler, err)
+		}
+		return err
+	}
+	frameData, err := sonic.Marshal(frame)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrWebhookQueue, err)
+	}
+	data, err := sonic.Marshal(queuedFrame{Frame: frameData, Trace: injectTrace(ctx)})
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrWebhookQueue, err)
+	}
+	if err = s.Queue.Push(data); err != nil {
+		s.logger().Error("push webhook frame to queue failed", "err", err, "sn", frame.SerialNumber)
+		return fmt.Errorf("%w: %w", ErrWebhookQueue, err)
+	}
+	return nil
+}
+
+// StartWorkers 设置事件队列并启动n个worker处理队列中的事件，worker等待handler处理完成后才Ack
+func (s *WebhookSession) StartWorkers(queue FrameQueue, n int) {
+	if n <= 0 {
+		n = 1
+	}
+	s.Queue = queue
+	s.workerNum = n
+	for i := 0; i < n; i++ {
+		s.workerWg.Add(1)
+		go s.work(queue)
+	}
+}
+
+func (s *WebhookSession) work(queue FrameQueue) {
+	defer s.workerWg.Done()
+	for {
+		id, data, err := queue.Pop()
+		if err != nil {
+			if !errors.Is(err, ErrQueueClosed) {
+				s.logger().Error("pop webhook frame from queue failed", "err", err)
+			}
+			return
+		}
+		ctx, data := unwrapQueued(data)
+		if err = s.handleQueued(ctx, data); err != nil {
+			if delay, retry := s.retryDelay(id, err); retry {
+				s.logger().Warn("handle webhook frame failed, retry later", "err", err, "id", id, "delay", delay)
+				if err = queue.Nack(id, delay); err != nil {
+					s.logger().Error("nack webhook frame failed", "err", err, "id", id)
+				}
+				continue
+			}
+			s.logger().Error("handle webhook frame failed, dead letter", "err", err, "id", id)
+			if s.DeadLetterHandler != nil {
+				s.DeadLetterHandler(data, err)
+			}
+		} else {
+			s.attemptsLock.Lock()
+			delete(s.attempts, id)
+			s.attemptsLock.Unlock()
+		}
+		if err = queue.Ack(id); err != nil {
+			s.logger().Error("ack webhook frame failed", "err", err, "id", id)
+		}
+	}
+}
+
+// unwrapQueued 取出队列中的事件和写入时的trace context，兼容直接写入frame的旧数据
+func unwrapQueued(data []byte) (context.Context, []byte) {
+	var queued queuedFrame
+	if err := sonic.Unmarshal(data, &queued); err != nil || len(queued.Frame) == 0 {
+		return context.Background(), data
+	}
+	return extractTrace(queued.Trace), queued.Frame
+}
+
+// handleQueued 处理队列中的一个事件，返回handler的错误
+func (s *WebhookSession) handleQueued(ctx context.Context, data []byte) error {
+	frame := event2.ParseFrameMapByData(data)
+	if frame == nil {
+		return &event2.FrameError{Reason: "invalid queued frame"}
+	}
+	err, _ := s.Session.dispatchFrame(ctx, frame, true)
+	return err
+}
+
+// retryDelay 记录事件失败的次数，返回重试前的等待时间；格式错误或超过MaxAttempts的事件不再重试
+func (s *WebhookSession) retryDelay(id uint64, err error) (time.Duration, bool) {
+	s.attemptsLock.Lock()
+	defer s.attemptsLock.Unlock()
+	var frameErr *event2.FrameError
+	maxAttempts := s.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultWebhookMaxAttempts
+	}
+	if s.attempts == nil {
+		s.attempts = make(map[uint64]int)
+	}
+	s.attempts[id]++
+	n := s.attempts[id]
+	if errors.As(err, &frameErr) || n >= maxAttempts {
+		delete(s.attempts, id)
+		return 0, false
+	}
+	delay := s.RetryDelay
+	if delay <= 0 {
+		delay = DefaultWebhookRetryDelay
+	}
+	for i := 1; i < n && delay < webhookMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxRetryDelay {
+		delay = webhookMaxRetryDelay
+	}
+	return delay, true
+}
+
+// StopWorkers 关闭队列并等待worker退出，内存队列会先处理完剩余的事件，文件队列中未处理的事件在重启后继续处理
+func (s *WebhookSession) StopWorkers() error {
+	if s.Queue == nil {
+		return nil
+	}
+	err := s.Queue.Close()
+	s.workerWg.Wait()
+	return err
+}
+
+// checkReplay 检查事件的msg_timestamp是否在防重放窗口内，没有msg_timestamp的事件(如challenge)不检查
+func (s *WebhookSession) checkReplay(frame *event2.FrameMap) error {
+	if s.ReplayWindow <= 0 || frame.SignalType != event2.SIG_EVENT {
+		return nil
+	}
+	ts, ok, err := frame.DataInt64Field("msg_timestamp")
+	if err != nil {
+		// 类型不正确时不能跳过检查，否则可以绕过防重放
+		return s.frameError(err, s.frameData(frame))
+	}
+	if !ok {
+		return nil
+	}
+	diff := time.Since(time.UnixMilli(ts))
+	if diff > s.ReplayWindow || diff < -s.ReplayWindow {
+		return fmt.Errorf("%w: msg_timestamp %d", ErrWebhookReplay, ts)
+	}
+	return nil
+}
+
 func (s *WebhookSession) SendData(data []byte) error {
 	return errors.New("webhook不能主动发消息给服务端")
 }
@@ -0,0 +1,330 @@
+package base
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/gookit/event"
+	event2 "github.com/kaiheila/golang-bot/api/base/event"
+	"github.com/kaiheila/golang-bot/api/helper"
+	"github.com/kaiheila/golang-bot/api/helper/compress"
+)
+
+func encryptWebhookBody(t *testing.T, data []byte, encryptKey string) []byte {
+	err, body := helper.EncryptWebhookPayload(data, encryptKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func newWebhookServer(s *WebhookSession) *httptest.Server {
+	return httptest.NewServer(s.Handler())
+}
+
+func TestWebhookCompressedChallenge(t *testing.T) {
+	const encryptKey, verifyToken = "encrypt-key", "verify-token"
+	challenge, _ := sonic.Marshal(event2.NewChallengeEventSignal("challenge-value", verifyToken))
+	plain := encryptWebhookBody(t, challenge, encryptKey)
+
+	cases := []struct {
+		name            string
+		compress        int
+		compressType    compress.CompressType
+		contentEncoding string
+	}{
+		{"compress=1", 1, compress.CompressTypeZlibPerMessage, ""},
+		{"zlib", 0, compress.CompressTypeZlibPerMessage, "compress/zlib"},
+		{"deflate", 1, compress.CompressTypeZlibPerMessage, "deflate"},
+		{"zstd", 1, compress.CompressTypeZstdPerMessage, "zstd"},
+		{"identity", 1, compress.CompressTypeNone, "identity"},
+		{"none", 0, compress.CompressTypeNone, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := NewWebhookSession(encryptKey, verifyToken, c.compress)
+			s.EventSyncHandle = true
+			server := newWebhookServer(s)
+			defer server.Close()
+
+			body := plain
+			if c.compressType != compress.CompressTypeNone {
+				compressor := compress.GetCompressor(c.compressType)
+				data, err := compressor.Compress(plain)
+				if err != nil {
+					t.Fatal(err)
+				}
+				compress.RecycleCompressor(c.compressType, compressor)
+				body = data
+			}
+			req, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader(body))
+			if c.contentEncoding != "" {
+				req.Header.Set("Content-Encoding", c.contentEncoding)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			respData, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+			challenge, _ := sonic.Get(respData, "challenge")
+			if v, _ := challenge.String(); v != "challenge-value" {
+				t.Fatalf("response: %s", respData)
+			}
+		})
+	}
+}
+
+func TestWebhookUnsupportedEncoding(t *testing.T) {
+	s := NewWebhookSession("", "", 1)
+	if err, _ := s.ReceiveDataWithEncoding([]byte("{}"), "br"); err == nil {
+		t.Fatal("expect unsupported encoding error")
+	}
+	s.Decompressor = nil
+	if err, _ := s.ReceiveData([]byte("{}")); err != ErrNoDecompressor {
+		t.Fatalf("expect ErrNoDecompressor, got %v", err)
+	}
+}
+
+func TestWebhookHandlerStatus(t *testing.T) {
+	const encryptKey, verifyToken = "encrypt-key", "verify-token"
+	s := NewWebhookSession(encryptKey, verifyToken, 0)
+	s.EventSyncHandle = true
+	s.MaxBodySize = 4 << 10
+	// 挂载在子路径下
+	mux := http.NewServeMux()
+	mux.Handle("/bot/webhook", s.Handler())
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	badToken, _ := sonic.Marshal(event2.NewChallengeEventSignal("challenge-value", "wrong-token"))
+	goodToken, _ := sonic.Marshal(event2.NewChallengeEventSignal("challenge-value", verifyToken))
+	channelType := fmt.Sprintf("WEBHOOKFAIL%d", time.Now().UnixNano())
+	s.On(channelType+"_9", event.ListenerFunc(func(e event.Event) error {
+		return errors.New("handler failed")
+	}))
+	handlerFail, _ := sonic.Marshal(map[string]interface{}{"s": event2.SIG_EVENT, "sn": 1, "d": map[string]interface{}{
+		"channel_type": channelType, "type": 9, "verify_token": verifyToken, "msg_id": "fail-m1", "msg_timestamp": time.Now().UnixMilli()}})
+	cases := []struct {
+		name   string
+		method string
+		body   []byte
+		status int
+	}{
+		{"ok", http.MethodPost, encryptWebhookBody(t, goodToken, encryptKey), http.StatusOK},
+		{"method", http.MethodGet, nil, http.StatusMethodNotAllowed},
+		{"too large", http.MethodPost, []byte(`{"encrypt":"` + strings.Repeat("a", 8<<10) + `"}`), http.StatusRequestEntityTooLarge},
+		{"verify token", http.MethodPost, encryptWebhookBody(t, badToken, encryptKey), http.StatusUnauthorized},
+		{"not encrypted", http.MethodPost, goodToken, http.StatusBadRequest},
+		{"bad base64", http.MethodPost, []byte(`{"encrypt":"!!!"}`), http.StatusBadRequest},
+		{"not json", http.MethodPost, []byte(`not json`), http.StatusBadRequest},
+		{"handler error", http.MethodPost, encryptWebhookBody(t, handlerFail, encryptKey), http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req, _ := http.NewRequest(c.method, server.URL+"/bot/webhook", bytes.NewReader(c.body))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != c.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, c.status)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+				t.Fatalf("content type %s", ct)
+			}
+		})
+	}
+}
+
+func TestWebhookReplay(t *testing.T) {
+	const encryptKey = "encrypt-key"
+	s := NewWebhookSession(encryptKey, "", 0)
+	s.EventSyncHandle = true
+	server := newWebhookServer(s)
+	defer server.Close()
+
+	var handled atomic.Int32
+	s.On("WEBHOOK_REPLAY_TEST_9", event.ListenerFunc(func(e event.Event) error {
+		handled.Add(1)
+		return nil
+	}))
+	post := func(sn int64, msgID string, ts time.Time) int {
+		data, _ := sonic.Marshal(map[string]interface{}{
+			"s":  event2.SIG_EVENT,
+			"sn": sn,
+			"d": map[string]interface{}{
+				"channel_type":  "WEBHOOK_REPLAY_TEST",
+				"type":          9,
+				"msg_id":        msgID,
+				"msg_timestamp": ts.UnixMilli(),
+			},
+		})
+		resp, err := http.Post(server.URL, "application/json", bytes.NewReader(encryptWebhookBody(t, data, encryptKey)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := post(1, "m1", time.Now()); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	// 服务端重试，不再分发但返回200
+	if status := post(1, "m1", time.Now()); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	if status := post(2, "m2", time.Now().Add(-time.Hour)); status != http.StatusConflict {
+		t.Fatalf("stale event status %d", status)
+	}
+	if status := post(3, "m3", time.Now().Add(time.Hour)); status != http.StatusConflict {
+		t.Fatalf("future event status %d", status)
+	}
+	if status := post(4, "m4", time.Now()); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	if n := handled.Load(); n != 2 {
+		t.Fatalf("handled %d events, want 2", n)
+	}
+}
+
+func TestWebhookAsyncAck(t *testing.T) {
+	s := NewWebhookSession("", "", 0)
+	s.EventSyncHandle = true
+	queue, err := NewFileFrameQueue(t.TempDir() + "/webhook.queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.StartWorkers(queue, 2)
+	server := newWebhookServer(s)
+	defer server.Close()
+
+	release := make(chan struct{})
+	done := make(chan int64, 2)
+	channelType := fmt.Sprintf("WEBHOOK_ASYNC_TEST%d", time.Now().UnixNano())
+	s.On(channelType+"_9", event.ListenerFunc(func(e event.Event) error {
+		<-release
+		done <- e.Get(EventDataFrameKey).(*event2.FrameMap).SerialNumber
+		return nil
+	}))
+	for sn := int64(1); sn <= 2; sn++ {
+		data, _ := sonic.Marshal(map[string]interface{}{
+			"s":  event2.SIG_EVENT,
+			"sn": sn,
+			"d":  map[string]interface{}{"channel_type": channelType, "type": 9, "msg_id": fmt.Sprintf("async-%d", sn)},
+		})
+		// handler阻塞时也要立即应答
+		resp, err := http.Post(server.URL, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+	}
+	close(release)
+	got := map[int64]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case sn := <-done:
+			got[sn] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("event not handled")
+		}
+	}
+	if !got[1] || !got[2] {
+		t.Fatalf("handled %v", got)
+	}
+	if err = s.StopWorkers(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 所有事件已经Ack，重启后队列为空
+	q2, err := NewFileFrameQueue(queue.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q2.Close()
+	if q2.Len() != 0 {
+		t.Fatalf("queue len %d after restart", q2.Len())
+	}
+}
+
+func TestWebhookQueueRetry(t *testing.T) {
+	s := NewWebhookSession("", "", 0)
+	s.RetryDelay = time.Millisecond
+	s.MaxAttempts = 3
+	deadLetters := make(chan []byte, 2)
+	s.DeadLetterHandler = func(data []byte, err error) {
+		deadLetters <- data
+	}
+	calls := map[string]int{}
+	var lock sync.Mutex
+	succeeded := make(chan string, 2)
+	channelType := fmt.Sprintf("WEBHOOK_RETRY_TEST%d", time.Now().UnixNano())
+	s.On(channelType+"_9", event.ListenerFunc(func(e event.Event) error {
+		msgId, _ := e.Get(EventDataFrameKey).(*event2.FrameMap).DataString("msg_id")
+		lock.Lock()
+		calls[msgId]++
+		n := calls[msgId]
+		lock.Unlock()
+		switch {
+		case msgId == "retry-panic" && n == 1:
+			panic("handler panic")
+		case msgId == "retry-ok" && n < 3, msgId == "retry-dead":
+			return errors.New("handler failed")
+		}
+		succeeded <- msgId
+		return nil
+	}))
+	queue := NewMemoryFrameQueue()
+	s.StartWorkers(queue, 2)
+	defer s.StopWorkers()
+	for _, msgId := range []string{"retry-ok", "retry-panic", "retry-dead"} {
+		data, _ := sonic.Marshal(map[string]interface{}{
+			"s": event2.SIG_EVENT,
+			"d": map[string]interface{}{"channel_type": channelType, "type": 9, "msg_id": msgId},
+		})
+		if err := queue.Push(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case msgId := <-succeeded:
+			got[msgId] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("events not retried, succeeded %v", got)
+		}
+	}
+	select {
+	case data := <-deadLetters:
+		if !strings.Contains(string(data), "retry-dead") {
+			t.Fatalf("dead letter %s", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dead letter not handled")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if !got["retry-ok"] || !got["retry-panic"] || calls["retry-ok"] != 3 || calls["retry-dead"] != 3 {
+		t.Fatalf("succeeded %v, calls %v", got, calls)
+	}
+}
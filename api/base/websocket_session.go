@@ -5,14 +5,14 @@ import (
 	"fmt"
 	"github.com/bytedance/sonic"
 	"github.com/gorilla/websocket"
+	event2 "github.com/kaiheila/golang-bot/api/base/event"
 	"github.com/kaiheila/golang-bot/api/helper"
 	"github.com/kaiheila/golang-bot/api/helper/compress"
-	log "github.com/sirupsen/logrus"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"sync"
-	"time"
 )
 
 type WebSocketSession struct {
@@ -24,6 +24,16 @@ type WebSocketSession struct {
 	WsWriteLock *sync.Mutex
 	ReqGateway  func() (error, string)
 	//sWSClient
+
+	// negotiated ReqGateWay协商的参数，关闭旧连接后在ConnectWebsocket中生效，由negotiateLock保护
+	negotiated    *negotiatedParams
+	negotiateLock sync.Mutex
+}
+
+// negotiatedParams 向网关声明的压缩字典版本和header版本
+type negotiatedParams struct {
+	dictVersion   string
+	headerVersion int
 }
 
 type GateWayHttpApiResult struct {
@@ -34,10 +44,10 @@ type GateWayHttpApiResult struct {
 	} `json:"data"`
 }
 
-func NewWebSocketSession(token, baseUrl, sessionFile, gateWay string, compressed int, compressType compress.CompressType, dictVersion string, headerVersion int) *WebSocketSession {
+func NewWebSocketSession(token, baseUrl, sessionFile, gateWay string, compressed int, compressType compress.CompressType, dictVersion string, headerVersion int, opts ...StateSessionOption) *WebSocketSession {
 	s := &WebSocketSession{
 		Token: token, BaseUrl: baseUrl, SessionFile: sessionFile}
-	s.StateSession = NewStateSession(gateWay, compressed, compressType, dictVersion, headerVersion)
+	s.StateSession = NewStateSession(gateWay, compressed, compressType, dictVersion, headerVersion, opts...)
 	s.NetworkProxy = s
 	s.WsWriteLock = new(sync.Mutex)
 	if content, err := os.ReadFile(sessionFile); err == nil && len(content) > 0 {
@@ -45,14 +55,18 @@ func NewWebSocketSession(token, baseUrl, sessionFile, gateWay string, compressed
 		err2 := sonic.Unmarshal(content, &data)
 		if err2 == nil {
 			if len(data) == 2 {
-				fmt.Printf("%v, %v", data[0], data[1])
 				if v, ok := data[0].(string); ok {
 					s.SessionId = v
+					s.DedupScope = v
+					s.logSessionId.Store(v)
+				}
+				if v, ok := data[1].(float64); ok {
+					s.MaxSn = int64(v)
 				}
-				s.MaxSn = int64(data[1].(float64))
 			}
+			s.logger().Info("load session file", "file", sessionFile, "sn", s.MaxSn)
 		} else {
-			log.WithError(err).Error("unmarsal from sessionFile error", sessionFile)
+			s.logger().Error("unmarsal from sessionFile error", "err", err2, "file", sessionFile)
 		}
 
 	}
@@ -64,32 +78,47 @@ func (ws *WebSocketSession) ReqGateWay() (error, string) {
 	if ws.ReqGateway != nil {
 		return ws.ReqGateway()
 	}
-	client := helper.NewApiHelper("/v3/gateway/index", ws.Token, ws.BaseUrl, "", "")
+	client := helper.NewApiHelper("/v3/gateway/index", ws.Token, ws.BaseUrl, "", "").SetLogger(ws.logger())
 	params := map[string]string{"compress": strconv.Itoa(ws.Compressed)}
-	if ws.CompressType == compress.CompressTypeZstdPerMessage {
-		params["compress-type"] = "zstd"
-		params["dict-version"] = ws.CompressDictVersion
+	if ws.Compressed > 0 && ws.CompressType != compress.CompressTypeZlibPerMessage && ws.CompressType != compress.CompressTypeNone {
+		params["compress-type"] = compress.GetCompressTypeName(ws.CompressType)
+	}
+	// 旧连接的读取goroutine还在使用session的设置，协商结果先保存，连接新的网关时再生效
+	negotiated := &negotiatedParams{dictVersion: ws.CompressDictVersion}
+	if ws.Compressed > 0 && (ws.CompressType == compress.CompressTypeZstdPerMessage || ws.CompressType == compress.CompressTypeZstdStream) {
+		// 只声明本地已经加载的字典版本，否则网关压缩的数据无法解压
+		version, err := compress.DefaultDictRegistry.Negotiate(ws.CompressDictVersion)
+		if err != nil {
+			ws.logger().Error("ReqGateWay negotiate dict version", "err", err)
+			return err, ""
+		}
+		negotiated.dictVersion = version
+		params["dict-version"] = version
 	}
-	params["header-version"] = strconv.Itoa(ws.HeaderVersion)
+	// 只声明本地支持的header版本
+	negotiated.headerVersion = event2.NegotiateHeaderVersion(ws.HeaderVersion)
+	params["header-version"] = strconv.Itoa(negotiated.headerVersion)
 
 	client.SetQuery(params)
 
 	data, err := client.Get()
 	if err != nil {
-		log.WithError(err).Error("ReqGateWay")
+		ws.logger().Error("ReqGateWay", "err", err)
 		return err, ""
 	}
 	result := &GateWayHttpApiResult{}
 	err = sonic.Unmarshal(data, result)
 	if err != nil {
-		log.WithError(err).Error("ReqGateWay")
+		ws.logger().Error("ReqGateWay", "err", err)
 		return err, ""
 	}
-	log.Infof("gateway URL:%s", result.Data.Url)
 	if result.Code == 0 && len(result.Data.Url) > 0 {
+		ws.negotiateLock.Lock()
+		ws.negotiated = negotiated
+		ws.negotiateLock.Unlock()
 		return nil, result.Data.Url
 	}
-	log.WithField("result", result).Error("ReqGateWay resultCode is not 0 or Url is empty")
+	ws.logger().Error("ReqGateWay resultCode is not 0 or Url is empty", "code", result.Code, "message", result.Message)
 	return errors.New("resultCode is not 0 or Url is empty"), ""
 
 }
@@ -97,19 +126,23 @@ func (ws *WebSocketSession) ConnectWebsocket(gateway string) error {
 	if ws.WsConn != nil {
 		err := ws.WsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 		if err != nil {
-			log.Error(err)
+			ws.logger().Warn("write close message", "err", err)
 		}
 		err = ws.WsConn.Close()
 		if err != nil {
-			log.Error(err)
+			ws.logger().Warn("close websocket", "err", err)
 		}
 		ws.WsConn = nil
-		//等3秒让之前的链接被服务器释放
-		time.Sleep(time.Duration(3 * time.Second))
+		//等待之前的链接被服务器释放
+		if !sleepContext(ws.ctx, ws.ReconnectPolicy().closeWait()) {
+			return ws.ctx.Err()
+		}
 	}
 
-	if ws.SessionId != "" {
-		gateway += "&" + fmt.Sprintf("sn=%d&sessionId=%s&resume=1", ws.MaxSn, ws.SessionId)
+	ws.applyNegotiated()
+
+	if sessionId, sn := ws.ackedSession(); sessionId != "" {
+		gateway += "&" + fmt.Sprintf("sn=%d&sessionId=%s&resume=1", sn, sessionId)
 	}
 	if ws.Compressed > 0 {
 		//gateway += "&compress_type=" + compress.GetCompressTypeName(compress.CompressType(ws.CompressType))
@@ -117,11 +150,14 @@ func (ws *WebSocketSession) ConnectWebsocket(gateway string) error {
 		//	gateway += "&dict=" + ws.CompressDictName
 		//}
 	}
-	log.WithField("gateway", gateway).Info("ConnectWebsocket")
+	ws.logger().Info("ConnectWebsocket", "gateway", gateway)
 	c, resp, err := websocket.DefaultDialer.Dial(gateway, nil)
-	log.Infof("webscoket dial resp:%+v", resp)
 	if err != nil {
-		log.WithError(err).Error("ConnectWebsocket Dial")
+		if resp != nil {
+			ws.logger().Error("ConnectWebsocket Dial", "err", err, "status", resp.StatusCode)
+		} else {
+			ws.logger().Error("ConnectWebsocket Dial", "err", err)
+		}
 		return err
 	}
 	ws.WsConn = c
@@ -139,40 +175,102 @@ func (ws *WebSocketSession) ConnectWebsocket(gateway string) error {
 			_, message, err := c.ReadMessage()
 
 			if err != nil {
-				log.Println("read:", err)
+				ws.logger().Warn("websocket read", "err", err)
 				return
 			}
-			log.WithField("message", message).Trace("websocket recv")
 			err, _ = ws.ReceiveData(message)
 			if err != nil {
-				log.WithError(err).Error("ReceiveData error")
+				ws.logger().Error("ReceiveData error", "err", err)
 			}
 		}
 	}()
 	return nil
 }
 
+// applyNegotiated 关闭旧连接后应用ReqGateWay协商的参数，发送signal时也会读取它们，所以在sendLock中修改
+// 协商结果只在第一次连接前变化，之后重新协商得到相同的值，不会写入还在被旧连接的读取goroutine使用的字段
+func (ws *WebSocketSession) applyNegotiated() {
+	ws.negotiateLock.Lock()
+	negotiated := ws.negotiated
+	ws.negotiated = nil
+	ws.negotiateLock.Unlock()
+	if negotiated == nil {
+		return
+	}
+	ws.sendLock.Lock()
+	defer ws.sendLock.Unlock()
+	if ws.CompressDictVersion != negotiated.dictVersion {
+		ws.CompressDictVersion = negotiated.dictVersion
+	}
+	if ws.HeaderVersion != negotiated.headerVersion {
+		ws.HeaderVersion = negotiated.headerVersion
+	}
+}
+
 func (ws *WebSocketSession) SendData(data []byte) error {
 	ws.WsWriteLock.Lock()
 	defer ws.WsWriteLock.Unlock()
 	return ws.WsConn.WriteMessage(websocket.TextMessage, data)
 }
 
+// SendBinary 发送带header或压缩后的signal
+func (ws *WebSocketSession) SendBinary(data []byte) error {
+	ws.WsWriteLock.Lock()
+	defer ws.WsWriteLock.Unlock()
+	return ws.WsConn.WriteMessage(websocket.BinaryMessage, data)
+}
+
 func (ws *WebSocketSession) SaveSessionId(sessionId string) error {
-	dataArray := []interface{}{sessionId, ws.MaxSn}
+	dataArray := []interface{}{sessionId, ws.AckedSn()}
 	data, err := sonic.Marshal(dataArray)
 	if err != nil {
-		log.WithError(err).Error("SaveSessionId")
+		ws.logger().Error("SaveSessionId", "err", err)
 		return err
 	}
-	err = os.WriteFile(ws.SessionFile, data, 0644)
+	err = writeFileAtomic(ws.SessionFile, data, 0644)
 	if err != nil {
-		log.WithError(err).WithField("sessionId", sessionId).Error("SaveSessionId")
+		ws.logger().Error("SaveSessionId", "err", err, "file", ws.SessionFile)
 		return err
 	}
 	return nil
 }
 
+// writeFileAtomic 先写入临时文件再重命名，进程在写入过程中退出时不会留下不完整的文件
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir fsync目录，确保rename后的目录项已经写入磁盘
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
 func (ws *WebSocketSession) Start() {
 	ws.StateSession.Start()
 	interrupt := make(chan os.Signal, 1)
@@ -181,13 +279,15 @@ func (ws *WebSocketSession) Start() {
 		select {
 
 		case <-interrupt:
-			log.Println("interrupt")
+			ws.logger().Info("interrupt")
+			// 停止心跳和重试，并写入已确认的sn
+			ws.Stop()
 
 			// Cleanly close the connection by sending a close message and then
 			// waiting (with timeout) for the server to close the connection.
 			err := ws.WsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 			if err != nil {
-				log.Println("write close:", err)
+				ws.logger().Error("write close message", "err", err)
 				return
 			}
 			return
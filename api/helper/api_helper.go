@@ -2,9 +2,15 @@ package helper
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	log "github.com/sirupsen/logrus"
+	"github.com/kaiheila/golang-bot/api/helper/logger"
+	"github.com/kaiheila/golang-bot/api/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"mime/multipart"
 	"net/http"
@@ -12,6 +18,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type HttpMethod string
@@ -39,8 +46,16 @@ type ApiHelper struct {
 	ContentTypeStr string
 	err            error
 	BodyBuffer     *bytes.Buffer
+	// RateLimiter 为nil(默认)时不按响应头限速，多个ApiHelper共用同一个RateLimiter才能共享限速状态
+	RateLimiter *RateLimiter
+	logger      logger.Logger
+	metrics     metrics.Metrics
+	ctx         context.Context
 }
 
+// TracerName ApiHelper创建span时使用的tracer名称
+const TracerName = "github.com/kaiheila/golang-bot/api/helper"
+
 func NewApiHelper(path, token, baseUrl, apiType, language string) *ApiHelper {
 	apiHelper := &ApiHelper{Token: token, Type: "Bot", BaseUrl: "https://www.kaiheila.cn", Language: "zh-CN"}
 
@@ -72,6 +87,49 @@ func (h *ApiHelper) SetQuery(values map[string]string) *ApiHelper {
 
 }
 
+// SetLogger 设置请求使用的日志，默认为logger.Default()
+func (h *ApiHelper) SetLogger(l logger.Logger) *ApiHelper {
+	h.logger = l
+	return h
+}
+
+func (h *ApiHelper) log() logger.Logger {
+	return logger.OrDefault(h.logger)
+}
+
+// SetContext 设置请求的context，ctx中带有span时请求的span作为它的子span，ctx取消时请求和限速等待也会结束
+func (h *ApiHelper) SetContext(ctx context.Context) *ApiHelper {
+	h.ctx = ctx
+	return h
+}
+
+func (h *ApiHelper) context() context.Context {
+	if h.ctx == nil {
+		return context.Background()
+	}
+	return h.ctx
+}
+
+// tracer 优先使用ctx中span的TracerProvider，没有span时使用otel.GetTracerProvider()
+func (h *ApiHelper) tracer(ctx context.Context) trace.Tracer {
+	if span := trace.SpanFromContext(ctx); span.SpanContext().IsValid() {
+		return span.TracerProvider().Tracer(TracerName)
+	}
+	return otel.GetTracerProvider().Tracer(TracerName)
+}
+
+// SetRateLimiter 设置按响应头限速的RateLimiter，默认不限速
+func (h *ApiHelper) SetRateLimiter(r *RateLimiter) *ApiHelper {
+	h.RateLimiter = r
+	return h
+}
+
+// SetMetrics 设置请求的运行指标，默认为metrics.Default()
+func (h *ApiHelper) SetMetrics(m metrics.Metrics) *ApiHelper {
+	h.metrics = m
+	return h
+}
+
 func (h *ApiHelper) SetBody(body []byte) *ApiHelper {
 	h.Body = body
 	return h
@@ -89,7 +147,7 @@ func (h *ApiHelper) SetUploadFile(filePath string) *ApiHelper {
 	// this step is very important
 	fileWriter, err := bodyWriter.CreateFormFile("file", fileName)
 	if err != nil {
-		log.Error(err)
+		h.log().Error("SetUploadFile", "err", err, "file", filePath)
 		h.err = err
 		return h
 	}
@@ -98,7 +156,7 @@ func (h *ApiHelper) SetUploadFile(filePath string) *ApiHelper {
 	fh, err := os.Open(filePath)
 	defer fh.Close()
 	if err != nil {
-		log.Error(err)
+		h.log().Error("SetUploadFile", "err", err, "file", filePath)
 		h.err = err
 		return h
 	}
@@ -106,7 +164,7 @@ func (h *ApiHelper) SetUploadFile(filePath string) *ApiHelper {
 	//iocopy
 	_, err = io.Copy(fileWriter, fh)
 	if err != nil {
-		log.Error(err)
+		h.log().Error("SetUploadFile", "err", err, "file", filePath)
 		h.err = err
 		return h
 	}
@@ -145,43 +203,74 @@ func (h *ApiHelper) setHeader(req *http.Request) {
 	req.Header.Set("Authorization", fmt.Sprintf("%s %s", h.Type, h.Token))
 	req.Header.Set("Accept-Language", h.Language)
 }
-func (h *ApiHelper) Send() ([]byte, error) {
+func (h *ApiHelper) Send() (data []byte, err error) {
 	if h.err != nil {
 		return nil, h.err
 	}
+	ctx, span := h.tracer(h.context()).Start(h.context(), string(h.Method)+" "+h.Path, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.request.method", string(h.Method)), attribute.String("url.path", h.Path)))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
 	client := &http.Client{}
 	reqPath := h.getReqPath()
 	var req *http.Request
-	var err error
 	if h.Body != nil {
-		req, err = http.NewRequest(string(h.Method), reqPath, bytes.NewBuffer(h.Body))
+		req, err = http.NewRequestWithContext(ctx, string(h.Method), reqPath, bytes.NewBuffer(h.Body))
 	} else if h.BodyBuffer != nil {
-		req, err = http.NewRequest(string(h.Method), reqPath, h.BodyBuffer)
+		req, err = http.NewRequestWithContext(ctx, string(h.Method), reqPath, h.BodyBuffer)
 	} else {
-		req, err = http.NewRequest(string(h.Method), reqPath, nil)
+		req, err = http.NewRequestWithContext(ctx, string(h.Method), reqPath, nil)
 	}
 	if err != nil {
 		return nil, err
 	}
 	h.setHeader(req)
-	printRequestAsCurl(req)
+	h.log().Debug("api request", "curl", requestCurl{req})
+	m := metrics.OrDefault(h.metrics)
+	if h.RateLimiter != nil {
+		if waited := h.RateLimiter.Wait(ctx, h.Token, h.Path); waited > 0 {
+			span.AddEvent("rate limit wait", trace.WithAttributes(attribute.Int64("wait_ms", waited.Milliseconds())))
+			m.RateLimitWait(h.Path, waited)
+			h.log().Info("api rate limit wait", "path", h.Path, "wait", waited)
+		}
+	}
+	start := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
+		m.APIRequest(h.Path, 0, time.Since(start))
 		return nil, err
 	}
 	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	defer func() {
+		m.APIRequest(h.Path, resp.StatusCode, time.Since(start))
+	}()
+	if h.RateLimiter != nil {
+		h.RateLimiter.Update(h.Token, h.Path, resp.StatusCode, resp.Header)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		// 限速是预期内的响应，由调用方根据Reset决定是否重试
+		rateErr := newRateLimitError(h.Path, resp.StatusCode, resp.Header)
+		h.log().Warn("api rate limited", "path", h.Path, "statusCode", resp.StatusCode, "reset", rateErr.Reset, "global", rateErr.Global)
+		return nil, rateErr
+	}
 	if resp.StatusCode != 200 {
 		var data []byte
 		if resp.Body != nil {
 			data, _ = io.ReadAll(resp.Body)
-			log.WithField("statusCode", resp.StatusCode).WithField("data", string(data)).Error("http error", reqPath)
+			h.log().Error("http error", "path", h.Path, "statusCode", resp.StatusCode, "data", string(data))
 		} else {
-			log.WithField("statusCode", resp.StatusCode).WithField("data", nil).Error("http error", reqPath)
+			h.log().Error("http error", "path", h.Path, "statusCode", resp.StatusCode)
 		}
 
 		return nil, errors.New("http error")
 	}
-	data, err := io.ReadAll(resp.Body)
+	data, err = io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
@@ -197,7 +286,16 @@ func (h *ApiHelper) String() string {
 	return sb.String()
 }
 
-func printRequestAsCurl(req *http.Request) {
+// requestCurl 日志输出时才格式化为curl命令，Authorization会被隐藏
+type requestCurl struct {
+	req *http.Request
+}
+
+func (r requestCurl) String() string {
+	return formatRequestAsCurl(r.req)
+}
+
+func formatRequestAsCurl(req *http.Request) string {
 	method := req.Method
 	urlStr := req.URL.String()
 	u, _ := url.Parse(urlStr)
@@ -212,19 +310,23 @@ func printRequestAsCurl(req *http.Request) {
 	// 处理请求头
 	for key, values := range req.Header {
 		for _, value := range values {
+			if key == "Authorization" {
+				value = "***"
+			}
 			curlCmd += " -H '" + key + ": " + value + "'"
 		}
 	}
 
 	// 处理请求体（如果有）
-	if req.Body != nil {
+	if req.Body != nil && req.GetBody != nil {
 		// 这里假设请求体是字符串，实际可能需要更复杂的处理
-		body, _ := req.GetBody()
-		b, _ := io.ReadAll(body)
-		curlCmd += " --data '" + string(b) + "'"
+		if body, err := req.GetBody(); err == nil {
+			b, _ := io.ReadAll(body)
+			curlCmd += " --data '" + string(b) + "'"
+		}
 	}
 
-	fmt.Println(curlCmd)
+	return curlCmd
 }
 
 //func (h *ApiHelper) PrintAsCurl() string {
@@ -0,0 +1,85 @@
+package compress
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	messages := make([][]byte, 0, 20)
+	for i := 0; i < 20; i++ {
+		messages = append(messages, []byte(fmt.Sprintf(`{"s":0,"sn":%d,"d":{"channel_type":"GROUP","type":9,"content":"%s"}}`, i, bytes.Repeat([]byte("x"), i*10))))
+	}
+	cases := []struct {
+		compressType CompressType
+		dictVersion  string
+	}{
+		{CompressTypeZlibPerMessage, ""},
+		{CompressTypeZstdPerMessage, ""},
+		{CompressTypeZstdPerMessage, "1"},
+		{CompressTypeZstdPerMessage, "2"},
+		{CompressTypeZlibStream, ""},
+		{CompressTypeZstdStream, ""},
+		{CompressTypeZstdStream, "2"},
+	}
+	for _, c := range cases {
+		name := GetCompressTypeName(c.compressType) + "/" + c.dictVersion
+		t.Run(name, func(t *testing.T) {
+			// 两轮，第二轮验证回收后重新获取的压缩器和解压器状态正确
+			for round := 0; round < 2; round++ {
+				compressor, err := GetCompressorWithDict(c.compressType, c.dictVersion)
+				if err != nil {
+					t.Fatal(err)
+				}
+				decompressor := GetDecompressor(c.compressType)
+				for _, msg := range messages {
+					data, err := compressor.Compress(msg)
+					if err != nil {
+						t.Fatal(err)
+					}
+					res, err := decompressor.Decompress(data)
+					if err != nil {
+						t.Fatalf("round %d: %v", round, err)
+					}
+					if !bytes.Equal(res, msg) {
+						t.Fatalf("round %d: got %s, want %s", round, res, msg)
+					}
+				}
+				RecycleCompressor(c.compressType, compressor)
+				RecycleDecompressor(c.compressType, decompressor)
+			}
+		})
+	}
+}
+
+func TestGetCompressorUnknownDict(t *testing.T) {
+	if _, err := GetCompressorWithDict(CompressTypeZstdPerMessage, "not-exist"); err == nil {
+		t.Fatal("expect error for unknown dict version")
+	}
+	if _, err := GetCompressorWithDict(CompressTypeZstdStream, "not-exist"); err == nil {
+		t.Fatal("expect error for unknown dict version")
+	}
+	if c := GetCompressor(CompressTypeNone); c != nil {
+		t.Fatal("expect nil compressor for none")
+	}
+}
+
+func TestZstdStreamCompressorRecycle(t *testing.T) {
+	// Recycle后encoder已经关闭，再次Compress时重新创建
+	z := NewZstdStreamCompressor("")
+	msg := []byte(`{"s":2,"sn":1}`)
+	for round := 0; round < 2; round++ {
+		data, err := z.Compress(msg)
+		if err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+		res, err := NewZstdStreamDecompressor().Decompress(data)
+		if err != nil || !bytes.Equal(res, msg) {
+			t.Fatalf("round %d: got %s, %v", round, res, err)
+		}
+		if err = z.Recycle(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
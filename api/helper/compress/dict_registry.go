@@ -0,0 +1,332 @@
+package compress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kaiheila/golang-bot/api/helper/logger"
+	"github.com/kaiheila/golang-bot/dict"
+	"github.com/klauspost/compress/zip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdDictMagic zstd字典文件的magic number
+const zstdDictMagic = 0xEC30A437
+
+var ErrNoDict = errors.New("no zstd dictionary loaded")
+
+// ErrDictVersionNotLoaded 指定的字典版本没有加载
+var ErrDictVersionNotLoaded = errors.New("zstd dictionary version not loaded")
+
+// ZstdDict 一个版本的zstd字典
+type ZstdDict struct {
+	// Version 字典版本，即网关参数dict-version，取自字典包中的文件名 <version>.dict
+	Version string
+	// ID 字典头中的dictionary id，压缩帧通过它找到对应的字典
+	ID      uint32
+	Content []byte
+}
+
+// DictRegistry 按版本管理zstd字典，并维护对应的编解码器池
+type DictRegistry struct {
+	dicts       map[string]*ZstdDict
+	decodePool  *sync.Pool
+	encodePools map[string]*sync.Pool
+	lock        sync.RWMutex
+}
+
+// plainEncodePool 不使用字典的编码器
+var plainEncodePool = &sync.Pool{
+	New: func() interface{} {
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		if err != nil {
+			logger.Default().Error("create zstd encoder", "err", err)
+			return nil
+		}
+		return encoder
+	},
+}
+
+// DefaultDictRegistry 默认的字典注册表，没有加载任何字典时，首次使用会加载内置的字典包
+var DefaultDictRegistry = NewDictRegistry()
+
+func NewDictRegistry() *DictRegistry {
+	r := &DictRegistry{dicts: make(map[string]*ZstdDict)}
+	r.rebuildPools()
+	return r
+}
+
+// ParseZstdDict 校验字典格式并读取dictionary id
+func ParseZstdDict(version string, content []byte) (*ZstdDict, error) {
+	if len(content) < 8 || binary.LittleEndian.Uint32(content[:4]) != zstdDictMagic {
+		return nil, fmt.Errorf("zstd dict %s: invalid magic number", version)
+	}
+	id := binary.LittleEndian.Uint32(content[4:8])
+	if id == 0 {
+		return nil, fmt.Errorf("zstd dict %s: dictionary id must not be 0", version)
+	}
+	d, err := zstd.InspectDictionary(content)
+	if err != nil {
+		return nil, fmt.Errorf("zstd dict %s: %w", version, err)
+	}
+	return &ZstdDict{Version: version, ID: d.ID(), Content: content}, nil
+}
+
+// Add 加载一个版本的字典，同一个版本或同一个dictionary id不能对应不同的字典
+func (r *DictRegistry) Add(version string, content []byte) error {
+	d, err := ParseZstdDict(version, content)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err = r.checkConflict(d); err != nil {
+		return err
+	}
+	r.dicts[version] = d
+	r.rebuildPools()
+	return nil
+}
+
+func (r *DictRegistry) checkConflict(d *ZstdDict) error {
+	for version, exist := range r.dicts {
+		if version == d.Version && exist.ID != d.ID {
+			return fmt.Errorf("zstd dict version %s already loaded with id %d, got id %d", version, exist.ID, d.ID)
+		}
+		if version != d.Version && exist.ID == d.ID {
+			return fmt.Errorf("zstd dict id %d of version %s conflicts with version %s", d.ID, d.Version, version)
+		}
+	}
+	return nil
+}
+
+// LoadZip 从字典包加载所有 <version>.dict，任何一个字典不合法时都不会加载
+func (r *DictRegistry) LoadZip(ra io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return err
+	}
+	dicts := make([]*ZstdDict, 0, len(zr.File))
+	for _, f := range zr.File {
+		name := path.Base(f.Name)
+		if !strings.HasSuffix(name, ".dict") {
+			continue
+		}
+		content, err := readZipFile(f)
+		if err != nil {
+			return fmt.Errorf("read zstd dict %s: %w", f.Name, err)
+		}
+		d, err := ParseZstdDict(strings.TrimSuffix(name, ".dict"), content)
+		if err != nil {
+			return err
+		}
+		dicts = append(dicts, d)
+	}
+	if len(dicts) == 0 {
+		return errors.New("no .dict file found in zip")
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, d := range dicts {
+		if err = r.checkConflict(d); err != nil {
+			return err
+		}
+	}
+	for _, d := range dicts {
+		r.dicts[d.Version] = d
+		logger.Default().Info("load zstd dict", "version", d.Version, "id", d.ID)
+	}
+	r.rebuildPools()
+	return nil
+}
+
+// LoadZipFile 从文件路径加载字典包
+func (r *DictRegistry) LoadZipFile(dictPath string) error {
+	data, err := os.ReadFile(dictPath)
+	if err != nil {
+		return err
+	}
+	return r.LoadZip(bytes.NewReader(data), int64(len(data)))
+}
+
+// LoadFS 从fs.FS(如embed.FS)加载字典包
+func (r *DictRegistry) LoadFS(fsys fs.FS, name string) error {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err
+	}
+	return r.LoadZip(bytes.NewReader(data), int64(len(data)))
+}
+
+// LoadEmbedded 加载内置的字典包
+func (r *DictRegistry) LoadEmbedded() error {
+	return r.LoadFS(dict.FS, dict.DefaultZip)
+}
+
+// ensureLoaded 没有加载任何字典时加载内置的字典包
+func (r *DictRegistry) ensureLoaded() error {
+	if r.Len() > 0 {
+		return nil
+	}
+	return r.LoadEmbedded()
+}
+
+func (r *DictRegistry) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.dicts)
+}
+
+func (r *DictRegistry) Get(version string) (*ZstdDict, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	d, ok := r.dicts[version]
+	return d, ok
+}
+
+// Versions 返回已加载的版本，数字版本按数值排序
+func (r *DictRegistry) Versions() []string {
+	r.lock.RLock()
+	versions := make([]string, 0, len(r.dicts))
+	for version := range r.dicts {
+		versions = append(versions, version)
+	}
+	r.lock.RUnlock()
+	sort.Slice(versions, func(i, j int) bool {
+		vi, erri := strconv.Atoi(versions[i])
+		vj, errj := strconv.Atoi(versions[j])
+		if erri == nil && errj == nil {
+			return vi < vj
+		}
+		return versions[i] < versions[j]
+	})
+	return versions
+}
+
+// Negotiate 返回客户端可以向网关声明的dict-version，保证是已经加载的版本
+// version为空时使用最新的版本，指定的版本没有加载时返回ErrDictVersionNotLoaded；没有任何字典时先加载内置的字典包
+func (r *DictRegistry) Negotiate(version string) (string, error) {
+	if err := r.ensureLoaded(); err != nil {
+		return "", err
+	}
+	if version != "" {
+		if _, ok := r.Get(version); !ok {
+			return "", fmt.Errorf("%w: %s", ErrDictVersionNotLoaded, version)
+		}
+		return version, nil
+	}
+	versions := r.Versions()
+	if len(versions) == 0 {
+		return "", ErrNoDict
+	}
+	return versions[len(versions)-1], nil
+}
+
+// Dicts 返回所有字典的内容，用于创建可以解压任意版本的解码器
+func (r *DictRegistry) Dicts() [][]byte {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.dictContents()
+}
+
+func (r *DictRegistry) dictContents() [][]byte {
+	dicts := make([][]byte, 0, len(r.dicts))
+	for _, d := range r.dicts {
+		dicts = append(dicts, d.Content)
+	}
+	return dicts
+}
+
+// rebuildPools 字典变化后重建编解码器池，调用时需要持有写锁
+func (r *DictRegistry) rebuildPools() {
+	dicts := r.dictContents()
+	r.decodePool = &sync.Pool{
+		New: func() interface{} {
+			decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderDicts(dicts...))
+			if err != nil {
+				logger.Default().Error("create zstd decoder", "err", err)
+				return nil
+			}
+			return decoder
+		},
+	}
+	r.encodePools = make(map[string]*sync.Pool, len(r.dicts))
+	for version, d := range r.dicts {
+		content := d.Content
+		r.encodePools[version] = &sync.Pool{
+			New: func() interface{} {
+				encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderDict(content))
+				if err != nil {
+					logger.Default().Error("create zstd encoder", "err", err)
+					return nil
+				}
+				return encoder
+			},
+		}
+	}
+}
+
+// get 返回指定版本的字典，没有加载时返回错误
+func (r *DictRegistry) get(version string) (*ZstdDict, error) {
+	if err := r.ensureLoaded(); err != nil {
+		return nil, err
+	}
+	d, ok := r.Get(version)
+	if !ok {
+		return nil, fmt.Errorf("zstd dict version %s not loaded", version)
+	}
+	return d, nil
+}
+
+// getEncoder 从池中获取使用指定版本字典的编码器，version为空时不使用字典
+func (r *DictRegistry) getEncoder(version string) (*zstd.Encoder, func(), error) {
+	pool := plainEncodePool
+	if version != "" {
+		if _, err := r.get(version); err != nil {
+			return nil, nil, err
+		}
+		r.lock.RLock()
+		pool = r.encodePools[version]
+		r.lock.RUnlock()
+	}
+	encoder, ok := pool.Get().(*zstd.Encoder)
+	if !ok || encoder == nil {
+		return nil, nil, errors.New("create zstd encoder failed")
+	}
+	return encoder, func() { pool.Put(encoder) }, nil
+}
+
+// getDecoder 从池中获取可以解压所有已加载字典的解码器，用完后调用返回的put放回原来的池
+func (r *DictRegistry) getDecoder() (*zstd.Decoder, func(), error) {
+	if err := r.ensureLoaded(); err != nil {
+		logger.Default().Warn("load embedded zstd dict failed, decode without dict", "err", err)
+	}
+	r.lock.RLock()
+	pool := r.decodePool
+	r.lock.RUnlock()
+	decoder, ok := pool.Get().(*zstd.Decoder)
+	if !ok || decoder == nil {
+		return nil, nil, errors.New("create zstd decoder failed")
+	}
+	return decoder, func() { pool.Put(decoder) }, nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
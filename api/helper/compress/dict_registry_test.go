@@ -0,0 +1,69 @@
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDictRegistry(t *testing.T) {
+	r := NewDictRegistry()
+	if err := r.LoadEmbedded(); err != nil {
+		t.Fatal(err)
+	}
+	versions := r.Versions()
+	if len(versions) != 2 || versions[0] != "1" || versions[1] != "2" {
+		t.Fatalf("versions: %v", versions)
+	}
+	d1, _ := r.Get("1")
+	d2, _ := r.Get("2")
+	if d1.ID != 0x2e6330e7 || d2.ID != 0x570ae9f1 {
+		t.Fatalf("dict id: %x %x", d1.ID, d2.ID)
+	}
+
+	for want, expect := range map[string]string{"1": "1", "2": "2", "": "2"} {
+		got, err := r.Negotiate(want)
+		if err != nil || got != expect {
+			t.Fatalf("negotiate %q: %q %v", want, got, err)
+		}
+	}
+	// 指定的版本没有加载时不能回退到其它版本
+	if got, err := r.Negotiate("99"); !errors.Is(err, ErrDictVersionNotLoaded) {
+		t.Fatalf("negotiate 99: %q %v", got, err)
+	}
+
+	// 重新加载同一个包不报错，同一个id对应不同版本时报错
+	if err := r.LoadEmbedded(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add("3", d1.Content); err == nil {
+		t.Fatal("expect id conflict error")
+	}
+	if err := r.Add("bad", []byte("not a dict")); err == nil {
+		t.Fatal("expect invalid dict error")
+	}
+}
+
+func TestZstdPerMessageWithDict(t *testing.T) {
+	version, err := DefaultDictRegistry.Negotiate("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ := DefaultDictRegistry.Get(version)
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderDict(d.Content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte(`{"s":0,"d":{"channel_type":"GROUP","type":9,"content":"hello"}}`)
+	data := encoder.EncodeAll(msg, nil)
+
+	res, err := NewZstdPerMessageDecompressor().Decompress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, msg) {
+		t.Fatalf("got %s", res)
+	}
+}
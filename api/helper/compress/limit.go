@@ -0,0 +1,105 @@
+package compress
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+var ErrDecompressLimit = errors.New("decompressed data exceeds limit")
+
+const (
+	LimitReasonSize  = "size"
+	LimitReasonRatio = "ratio"
+)
+
+// DecompressLimitError 单条消息解压后超过限制，可以用errors.Is(err, ErrDecompressLimit)判断
+type DecompressLimitError struct {
+	// Reason 超过的限制，LimitReasonSize或LimitReasonRatio
+	Reason     string
+	Compressed int
+	Limit      int64
+}
+
+func (e *DecompressLimitError) Error() string {
+	return fmt.Sprintf("%s: %s limit %d bytes, compressed %d bytes", ErrDecompressLimit, e.Reason, e.Limit, e.Compressed)
+}
+
+func (e *DecompressLimitError) Is(target error) bool {
+	return target == ErrDecompressLimit
+}
+
+// Limits 单条消息的解压限制，防止压缩炸弹占用大量内存
+type Limits struct {
+	// MaxSize 解压后的最大字节数，<=0时不限制
+	MaxSize int64
+	// MaxRatio 解压后与压缩数据大小的最大比例，<=0时不限制
+	MaxRatio float64
+	// RatioMinSize 解压后不超过该大小时不检查比例，短消息的压缩比通常很高
+	RatioMinSize int64
+}
+
+// DefaultLimits 默认的解压限制
+func DefaultLimits() Limits {
+	return Limits{
+		MaxSize:      32 << 20,
+		MaxRatio:     1024,
+		RatioMinSize: 1 << 20,
+	}
+}
+
+var limits atomic.Pointer[Limits]
+
+func init() {
+	SetLimits(DefaultLimits())
+}
+
+// SetLimits 设置所有解压器使用的限制
+func SetLimits(l Limits) {
+	limits.Store(&l)
+}
+
+// GetLimits 返回当前的解压限制
+func GetLimits() Limits {
+	return *limits.Load()
+}
+
+// maxOutput 返回压缩数据解压后允许的最大字节数及对应的限制，<0表示不限制
+func (l Limits) maxOutput(compressed int) (int64, string) {
+	limit, reason := int64(-1), ""
+	if l.MaxSize > 0 {
+		limit, reason = l.MaxSize, LimitReasonSize
+	}
+	if l.MaxRatio > 0 {
+		ratioMax := int64(float64(compressed) * l.MaxRatio)
+		if ratioMax < l.RatioMinSize {
+			ratioMax = l.RatioMinSize
+		}
+		if limit < 0 || ratioMax < limit {
+			limit, reason = ratioMax, LimitReasonRatio
+		}
+	}
+	return limit, reason
+}
+
+// readLimited 读取r的全部数据，超过限制时返回DecompressLimitError
+func readLimited(r io.Reader, compressed int) ([]byte, error) {
+	limit, reason := GetLimits().maxOutput(compressed)
+	if limit < 0 {
+		return io.ReadAll(r)
+	}
+	res, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(res)) > limit {
+		return nil, &DecompressLimitError{Reason: reason, Compressed: compressed, Limit: limit}
+	}
+	return res, nil
+}
+
+// plainReader 隐藏bytes.Reader的Len方法，避免zstd解码器对小数据直接DecodeAll而绕过限制
+type plainReader struct {
+	io.Reader
+}
@@ -0,0 +1,79 @@
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDecompressLimits(t *testing.T) {
+	defer SetLimits(GetLimits())
+	SetLimits(Limits{MaxSize: 64 << 10, MaxRatio: 100, RatioMinSize: 4 << 10})
+
+	small := bytes.Repeat([]byte("a"), 1<<10)
+	ratioBomb := bytes.Repeat([]byte("a"), 32<<10)
+	sizeBomb := bytes.Repeat([]byte("abcdefghijklmnopqrstuvwxyz0123456789"), 16<<10)
+
+	for _, compressType := range []CompressType{CompressTypeZlibPerMessage, CompressTypeZstdPerMessage, CompressTypeZlibStream, CompressTypeZstdStream} {
+		t.Run(GetCompressTypeName(compressType), func(t *testing.T) {
+			compressor := GetCompressor(compressType)
+			decompressor := GetDecompressor(compressType)
+			defer RecycleCompressor(compressType, compressor)
+			defer RecycleDecompressor(compressType, decompressor)
+
+			for _, c := range []struct {
+				data   []byte
+				reason string
+			}{
+				{small, ""},
+				{ratioBomb, LimitReasonRatio},
+				{sizeBomb, ""},
+				{small, ""},
+			} {
+				compressed, err := compressor.Compress(c.data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res, err := decompressor.Decompress(compressed)
+				var limitErr *DecompressLimitError
+				switch {
+				case c.reason == "" && len(c.data) > 64<<10:
+					// 压缩比不高但超过大小限制，可能先触发比例限制
+					if !errors.Is(err, ErrDecompressLimit) {
+						t.Fatalf("expect limit error, got %v", err)
+					}
+				case c.reason != "":
+					if !errors.As(err, &limitErr) || limitErr.Reason != c.reason {
+						t.Fatalf("expect %s limit error, got %v", c.reason, err)
+					}
+				default:
+					// 流式模式下超过限制的消息被丢弃后，后续消息仍然可以解压
+					if err != nil || !bytes.Equal(res, c.data) {
+						t.Fatalf("decompress %d bytes: %v", len(c.data), err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLimitsMaxOutput(t *testing.T) {
+	l := Limits{MaxSize: 1000, MaxRatio: 10, RatioMinSize: 200}
+	for _, c := range []struct {
+		compressed int
+		limit      int64
+		reason     string
+	}{
+		{10, 200, LimitReasonRatio},
+		{50, 500, LimitReasonRatio},
+		{500, 1000, LimitReasonSize},
+	} {
+		limit, reason := l.maxOutput(c.compressed)
+		if limit != c.limit || reason != c.reason {
+			t.Fatalf("compressed %d: got %d %s", c.compressed, limit, reason)
+		}
+	}
+	if limit, _ := (Limits{}).maxOutput(10); limit >= 0 {
+		t.Fatalf("expect no limit, got %d", limit)
+	}
+}
@@ -1,7 +1,12 @@
 package compress
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"sync"
+
+	"github.com/kaiheila/golang-bot/api/helper/logger"
 )
 
 type CompressType int
@@ -10,8 +15,8 @@ const (
 	CompressTypeNone           CompressType = 0
 	CompressTypeZlibPerMessage CompressType = 1
 	CompressTypeZstdPerMessage CompressType = 2
-	//CompressTypeZlibStream     CompressType = 3 // TODO: 暂未支持
-	//CompressTypeZstdStream     CompressType = 4
+	CompressTypeZlibStream     CompressType = 3
+	CompressTypeZstdStream     CompressType = 4
 )
 
 func ParseCompressType(compress bool, compressTypeStr string) CompressType {
@@ -23,25 +28,41 @@ func ParseCompressType(compress bool, compressTypeStr string) CompressType {
 		return CompressTypeZlibPerMessage
 	case "zstd":
 		return CompressTypeZstdPerMessage
-	//case "zlib_stream":
-	//	return CompressTypeZlibStream
-	//case "zstd_stream":
-	//	return CompressTypeZstdStream
+	case "zlib_stream":
+		return CompressTypeZlibStream
+	case "zstd_stream":
+		return CompressTypeZstdStream
 	default:
 		return CompressTypeZlibPerMessage
 	}
 }
 
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// ParseContentEncoding 根据http请求的Content-Encoding返回压缩类型，只支持按消息压缩的类型
+func ParseContentEncoding(contentEncoding string) (CompressType, error) {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "", "identity":
+		return CompressTypeNone, nil
+	case "compress/zlib", "zlib", "deflate":
+		return CompressTypeZlibPerMessage, nil
+	case "compress/zstd", "zstd":
+		return CompressTypeZstdPerMessage, nil
+	default:
+		return CompressTypeNone, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, contentEncoding)
+	}
+}
+
 func GetCompressTypeName(compressType CompressType) string {
 	switch compressType {
 	case CompressTypeZlibPerMessage:
 		return "zlib"
 	case CompressTypeZstdPerMessage:
 		return "zstd"
-	//case CompressTypeZlibStream:
-	//	return "zlib_stream"
-	//case CompressTypeZstdStream:
-	//	return "zstd_stream"
+	case CompressTypeZlibStream:
+		return "zlib_stream"
+	case CompressTypeZstdStream:
+		return "zstd_stream"
 	default:
 		return "none"
 	}
@@ -61,84 +82,133 @@ type DecompressorInterface interface {
 	Recycle() error
 }
 
-//var compressorZlibStreamPool = sync.Pool{
-//	New: func() interface{} {
-//		return newZlibStreamCompressor()
-//	},
-//}
+var compressorZlibPerMessagePool = sync.Pool{
+	New: func() interface{} {
+		return NewZlibPerMessageCompressor()
+	},
+}
+
+var compressorZstdPerMessagePool = sync.Pool{
+	New: func() interface{} {
+		return NewZstdPerMessageCompressor("")
+	},
+}
+
+var compressorZlibStreamPool = sync.Pool{
+	New: func() interface{} {
+		return NewZlibStreamCompressor()
+	},
+}
+
+var compressorZstdStreamPool = sync.Pool{
+	New: func() interface{} {
+		return NewZstdStreamCompressor("")
+	},
+}
 
-//var compressorZstdStreamPool = sync.Pool{
-//	New: func() interface{} {
-//		return newZstdStreamCompressor()
-//	},
-//}
+var decompressorZlibPerMessagePool = sync.Pool{
+	New: func() interface{} {
+		return NewZlibPerMessageDecompressor()
+	},
+}
 
+var decompressorZstdPerMessagePool = sync.Pool{
+	New: func() interface{} {
+		return NewZstdPerMessageDecompressor()
+	},
+}
+
+// GetCompressor 返回不使用字典的压缩器，流式压缩器带有连接级别的上下文，每个连接需要单独获取，用完后调用RecycleCompressor
 func GetCompressor(compressType CompressType) CompressorInterface {
-	//if compressType == CompressTypeZstdStream {
-	//	c := compressorZstdStreamPool.Get().(CompressorInterface)
-	//	c.Reset()
-	//	return c
-	//} else if compressType == CompressTypeZlibStream {
-	//	c := compressorZlibStreamPool.Get().(CompressorInterface)
-	//	c.Reset()
-	//	return c
-	//}
-	return nil
+	c, err := GetCompressorWithDict(compressType, "")
+	if err != nil {
+		logger.Default().Error("GetCompressor", "err", err)
+		return nil
+	}
+	return c
 }
+
+// GetCompressorWithDict 返回压缩器，dictVersion只对zstd类型有效，为空时不使用字典
+func GetCompressorWithDict(compressType CompressType, dictVersion string) (CompressorInterface, error) {
+	var c CompressorInterface
+	switch compressType {
+	case CompressTypeZlibPerMessage:
+		c = compressorZlibPerMessagePool.Get().(CompressorInterface)
+	case CompressTypeZstdPerMessage:
+		if dictVersion != "" {
+			if _, err := DefaultDictRegistry.get(dictVersion); err != nil {
+				return nil, err
+			}
+			return NewZstdPerMessageCompressor(dictVersion), nil
+		}
+		c = compressorZstdPerMessagePool.Get().(CompressorInterface)
+	case CompressTypeZlibStream:
+		c = compressorZlibStreamPool.Get().(CompressorInterface)
+	case CompressTypeZstdStream:
+		if dictVersion != "" {
+			c = NewZstdStreamCompressor(dictVersion)
+		} else {
+			c = compressorZstdStreamPool.Get().(CompressorInterface)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compress type %d", compressType)
+	}
+	if err := c.Reset(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// RecycleCompressor 回收压缩器，使用字典的zstd压缩器不放回池中
 func RecycleCompressor(compressType CompressType, c CompressorInterface) {
 	if c == nil || compressType == CompressTypeNone {
 		return
 	}
-	// 确保所有数据已刷新
-	// 放回池中
-	//if compressType == CompressTypeZstdStream {
-	//	c.Recycle()
-	//	compressorZstdStreamPool.Put(c)
-	//	return
-	//} else if compressType == CompressTypeZlibStream {
-	//	c.Recycle()
-	//	compressorZlibStreamPool.Put(c)
-	//	return
-	//
-	//}
-}
-
-//var decompressorZstdStreamPool = sync.Pool{
-//	New: func() interface{} {
-//		return NewZstdStreamDecompressor()
-//	},
-//}
-//var decompressorZlibStreamPool = sync.Pool{
-//	New: func() interface{} {
-//		return NewZlibStreamDecompressor()
-//	},
-//}
+	if err := c.Recycle(); err != nil {
+		logger.Default().Warn("RecycleCompressor", "err", err)
+	}
+	switch compressor := c.(type) {
+	case *ZlibPerMessageCompressor:
+		compressorZlibPerMessagePool.Put(compressor)
+	case *ZlibStreamCompressor:
+		compressorZlibStreamPool.Put(compressor)
+	case *ZstdPerMessageCompressor:
+		if compressor.DictVersion == "" {
+			compressorZstdPerMessagePool.Put(compressor)
+		}
+	case *ZstdStreamCompressor:
+		if compressor.DictVersion == "" {
+			compressorZstdStreamPool.Put(compressor)
+		}
+	}
+}
 
+// GetDecompressor 返回解压器，流式解压器带有连接级别的上下文，每个连接需要单独获取，连接断开后调用RecycleDecompressor
 func GetDecompressor(compressType CompressType) DecompressorInterface {
-	if compressType == CompressTypeZlibPerMessage {
-		return NewZlibPerMessageDecompressor()
-	} else if compressType == CompressTypeZstdPerMessage {
-		return NewZstdPerMessageDecompressor()
+	switch compressType {
+	case CompressTypeZlibPerMessage:
+		return decompressorZlibPerMessagePool.Get().(DecompressorInterface)
+	case CompressTypeZstdPerMessage:
+		return decompressorZstdPerMessagePool.Get().(DecompressorInterface)
+	case CompressTypeZlibStream:
+		return NewZlibStreamDecompressor()
+	case CompressTypeZstdStream:
+		return NewZstdStreamDecompressor()
 	}
 	return nil
 }
 
 func RecycleDecompressor(compressType CompressType, decompressor DecompressorInterface) {
-
-}
-
-var compressorZstdPerMessagePool = sync.Pool{
-	New: func() interface{} {
-		c := NewZstdPerMessageCompressor()
-		c.Reset()
-		return c
-	},
-}
-
-var compressorZlibPerMessagePool = sync.Pool{
-	New: func() interface{} {
-		c := NewZlibPerMessageCompressor()
-		c.Reset()
-		return c
-	},
+	if decompressor == nil {
+		return
+	}
+	switch compressType {
+	case CompressTypeZlibPerMessage:
+		decompressorZlibPerMessagePool.Put(decompressor)
+	case CompressTypeZstdPerMessage:
+		decompressorZstdPerMessagePool.Put(decompressor)
+	case CompressTypeZlibStream, CompressTypeZstdStream:
+		// 关闭流式解压的后台goroutine，下一个连接的上下文需要重新创建
+		decompressor.Recycle()
+	}
 }
@@ -0,0 +1,171 @@
+package compress
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var ErrStreamClosed = errors.New("compress stream closed")
+
+// streamSource 流式解压的输入，没有数据时阻塞等待下一条消息，并通知解压器当前消息已经读完
+type streamSource struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	buf     []byte
+	closed  bool
+	starved chan struct{}
+}
+
+func newStreamSource() *streamSource {
+	s := &streamSource{starved: make(chan struct{}, 1)}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+func (s *streamSource) Read(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.buf) == 0 {
+		if s.closed {
+			return 0, io.EOF
+		}
+		select {
+		case s.starved <- struct{}{}:
+		default:
+		}
+		s.cond.Wait()
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// push 写入一条消息，之前残留的读完通知已经过期，需要丢弃
+func (s *streamSource) push(data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-s.starved:
+	default:
+	}
+	s.buf = append(s.buf, data...)
+	s.cond.Signal()
+}
+
+func (s *streamSource) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+func (s *streamSource) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+// streamRun 一个压缩流对应的后台解压goroutine的状态
+type streamRun struct {
+	src   *streamSource
+	out   []byte
+	errCh chan error
+	// limit 当前消息解压后允许的最大字节数，<0表示不限制，超过后丢弃后续数据并记录exceeded
+	limit    int64
+	exceeded bool
+}
+
+// streamDecompressor 一个连接上的流式解压器，服务端对每条消息flush，消息之间共享压缩上下文
+// 后台goroutine持续从解压reader读取，当reader需要下一条消息的数据时，说明当前消息已经全部解压
+type streamDecompressor struct {
+	newReader func(r io.Reader) (io.Reader, error)
+	run       *streamRun
+	lock      sync.Mutex
+}
+
+func newStreamDecompressor(newReader func(r io.Reader) (io.Reader, error)) *streamDecompressor {
+	d := &streamDecompressor{newReader: newReader}
+	d.start()
+	return d
+}
+
+func (d *streamDecompressor) start() {
+	run := &streamRun{src: newStreamSource(), errCh: make(chan error, 1)}
+	d.run = run
+	go d.decode(run)
+}
+
+func (d *streamDecompressor) decode(run *streamRun) {
+	reader, err := d.newReader(run.src)
+	if err != nil {
+		run.errCh <- err
+		return
+	}
+	if c, ok := reader.(io.Closer); ok {
+		defer c.Close()
+	}
+	buf := make([]byte, 128*1024)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			if run.limit >= 0 && int64(len(run.out)+n) > run.limit {
+				run.exceeded = true
+			} else {
+				run.out = append(run.out, buf[:n]...)
+			}
+		}
+		if err != nil {
+			if run.src.isClosed() {
+				err = ErrStreamClosed
+			}
+			run.errCh <- err
+			return
+		}
+	}
+}
+
+func (d *streamDecompressor) Decompress(data []byte) ([]byte, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(data) == 0 {
+		return nil, nil
+	}
+	run := d.run
+	run.out = run.out[:0]
+	run.exceeded = false
+	limit, reason := GetLimits().maxOutput(len(data))
+	run.limit = limit
+	run.src.push(data)
+	select {
+	case <-run.src.starved:
+	case err := <-run.errCh:
+		// 流已经损坏，需要Reset后才能继续使用
+		run.errCh <- err
+		return nil, err
+	}
+	if run.exceeded {
+		// 超过限制的数据已经丢弃，压缩上下文仍然可用，后续消息可以继续解压
+		return nil, &DecompressLimitError{Reason: reason, Compressed: len(data), Limit: limit}
+	}
+	res := make([]byte, len(run.out))
+	copy(res, run.out)
+	return res, nil
+}
+
+// Reset 丢弃当前的压缩上下文，用于新的连接
+func (d *streamDecompressor) Reset() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.run.src.close()
+	d.start()
+	return nil
+}
+
+// Recycle 关闭后台goroutine
+func (d *streamDecompressor) Recycle() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.run.src.close()
+	return nil
+}
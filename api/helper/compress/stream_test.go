@@ -0,0 +1,79 @@
+package compress
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+)
+
+type flushWriter interface {
+	Write(p []byte) (int, error)
+	Flush() error
+}
+
+// compressStream 模拟服务端，在同一个压缩流中写入多条消息，每条消息后flush
+func compressStream(t *testing.T, buf *bytes.Buffer, w flushWriter, messages []string) [][]byte {
+	res := make([][]byte, 0, len(messages))
+	for _, msg := range messages {
+		buf.Reset()
+		if _, err := w.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, append([]byte(nil), buf.Bytes()...))
+	}
+	return res
+}
+
+func testMessages() []string {
+	messages := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		messages = append(messages, fmt.Sprintf(`{"s":0,"sn":%d,"d":{"channel_type":"GROUP","type":9,"content":"hello %d"}}`, i, i))
+	}
+	return messages
+}
+
+func TestStreamDecompressor(t *testing.T) {
+	messages := testMessages()
+	buf := &bytes.Buffer{}
+	zlibWriter := zlib.NewWriter(buf)
+	zlibData := compressStream(t, buf, zlibWriter, messages)
+	zstdWriter, err := zstd.NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstdData := compressStream(t, buf, zstdWriter, messages)
+
+	cases := []struct {
+		compressType CompressType
+		data         [][]byte
+	}{
+		{CompressTypeZlibStream, zlibData},
+		{CompressTypeZstdStream, zstdData},
+	}
+	for _, c := range cases {
+		t.Run(GetCompressTypeName(c.compressType), func(t *testing.T) {
+			d := GetDecompressor(c.compressType)
+			defer RecycleDecompressor(c.compressType, d)
+			for i, data := range c.data {
+				out, err := d.Decompress(data)
+				if err != nil {
+					t.Fatalf("message %d: %v", i, err)
+				}
+				if string(out) != messages[i] {
+					t.Fatalf("message %d: expected %q, got %q", i, messages[i], out)
+				}
+			}
+			// 新连接需要新的压缩上下文
+			d.Reset()
+			if _, err := d.Decompress(c.data[1]); err == nil {
+				t.Error("decompress a message from the middle of a stream should fail after reset")
+			}
+		})
+	}
+}
@@ -3,22 +3,21 @@ package compress
 import (
 	"bytes"
 	"github.com/klauspost/compress/zlib"
-	"github.com/sirupsen/logrus"
 	"io"
 	"sync"
 )
 
+// ZlibStreamCompressor zlib_stream模式的压缩器，一个连接共享一个zlib流，每条消息后sync flush
 type ZlibStreamCompressor struct {
 	writer *zlib.Writer
-	buffer bytes.Buffer
+	buffer *bytes.Buffer
 	mu     sync.Mutex
 }
 
-func newZlibStreamCompressor() *ZlibStreamCompressor {
-	var buf bytes.Buffer
-	writer := zlib.NewWriter(&buf)
+func NewZlibStreamCompressor() *ZlibStreamCompressor {
+	buf := &bytes.Buffer{}
 	return &ZlibStreamCompressor{
-		writer: writer,
+		writer: zlib.NewWriter(buf),
 		buffer: buf,
 	}
 }
@@ -33,100 +32,76 @@ func (z *ZlibStreamCompressor) Compress(data []byte) ([]byte, error) {
 	if err := z.writer.Flush(); err != nil {
 		return nil, err
 	}
-	return z.buffer.Bytes(), nil
+	return bytes.Clone(z.buffer.Bytes()), nil
 }
 
+// Reset 开始新的压缩流，用于新的连接
 func (z *ZlibStreamCompressor) Reset() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
 	z.buffer.Reset()
-	z.writer.Reset(&z.buffer)
+	z.writer.Reset(z.buffer)
 	return nil
 }
 
 func (z *ZlibStreamCompressor) Recycle() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.writer.Close()
 	z.buffer.Reset()
-	return z.writer.Close()
+	return err
 }
 
+// ZlibStreamDecompressor zlib_stream模式的解压器，一个连接共享一个zlib流，服务端对每条消息做sync flush
 type ZlibStreamDecompressor struct {
-	decoder io.ReadCloser
-	buf     bytes.Buffer
-	mu      sync.Mutex
+	*streamDecompressor
 }
 
 func NewZlibStreamDecompressor() DecompressorInterface {
-	buf := bytes.Buffer{}
-	decoder, err := zlib.NewReader(&buf)
-	if err != nil {
-		logrus.Error(err)
-		return nil
+	return &ZlibStreamDecompressor{
+		streamDecompressor: newStreamDecompressor(func(r io.Reader) (io.Reader, error) {
+			return zlib.NewReader(r)
+		}),
 	}
-	z := &ZlibStreamDecompressor{decoder: decoder, buf: buf}
-	return z
-}
-
-func (z *ZlibStreamDecompressor) Decompress(data []byte) ([]byte, error) {
-	z.mu.Lock()
-	defer z.mu.Unlock()
-	// 使用缓冲区复制数据
-	//// 创建带缓冲的写入器
-	z.buf.Write(data)
-	out := bytes.Buffer{}
-	for {
-		buf := make([]byte, 1024)
-		n, err := z.decoder.Read(buf)
-		if err != nil && err != io.EOF {
-			return nil, err
-		}
-		if n > 0 {
-			out.Write(buf[:n])
-		} else if n == 0 || err == io.EOF {
-			break
-		}
-
-	}
-	return out.Bytes(), nil
-}
-
-func (z *ZlibStreamDecompressor) Reset() error {
-	z.buf.Reset()
-	return nil
-}
-
-func (z *ZlibStreamDecompressor) Recycle() error {
-	z.buf.Reset()
-	z.decoder = nil
-	return nil
 }
 
+// ZlibPerMessageCompressor zlib模式的压缩器，每条消息是一个完整的zlib流
 type ZlibPerMessageCompressor struct {
 	writer *zlib.Writer
-	buffer bytes.Buffer
+	buffer *bytes.Buffer
+	mu     sync.Mutex
 }
 
 func NewZlibPerMessageCompressor() *ZlibPerMessageCompressor {
-	buffer := bytes.Buffer{}
-	writer := zlib.NewWriter(&buffer)
+	buffer := &bytes.Buffer{}
+	writer := zlib.NewWriter(buffer)
 	return &ZlibPerMessageCompressor{writer: writer, buffer: buffer}
 }
 
 func (z *ZlibPerMessageCompressor) Compress(data []byte) ([]byte, error) {
-	_, err := z.writer.Write(data)
-	if err != nil {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.buffer.Reset()
+	z.writer.Reset(z.buffer)
+	if _, err := z.writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := z.writer.Close(); err != nil {
 		return nil, err
 	}
-	z.writer.Flush()
-	return z.buffer.Bytes(), nil
+	return bytes.Clone(z.buffer.Bytes()), nil
 }
 
 func (z *ZlibPerMessageCompressor) Reset() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
 	z.buffer.Reset()
-	z.writer.Reset(&z.buffer)
+	z.writer.Reset(z.buffer)
 	return nil
 }
 
 func (z *ZlibPerMessageCompressor) Recycle() error {
-	z.Reset()
-	return nil
+	return z.Reset()
 }
 
 type ZlibPerMessageDecompressor struct {
@@ -145,11 +120,7 @@ func (z *ZlibPerMessageDecompressor) Decompress(data []byte) ([]byte, error) {
 		return nil, err
 	}
 	defer decoder.Close()
-	res, err := io.ReadAll(decoder)
-	if err != nil {
-		return nil, err
-	}
-	return res, nil
+	return readLimited(decoder, len(data))
 }
 func (z *ZlibPerMessageDecompressor) Reset() error {
 	return nil
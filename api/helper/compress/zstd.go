@@ -2,124 +2,125 @@ package compress
 
 import (
 	"bytes"
-	"github.com/klauspost/compress/zip"
+	"github.com/kaiheila/golang-bot/api/helper/logger"
 	"github.com/klauspost/compress/zstd"
-	"github.com/sirupsen/logrus"
-	//"github.com/valyala/gozstd"
 	"io"
-	"os"
-	"strings"
 	"sync"
 )
 
-//type ZstdStreamCompressor struct {
-//	encoder *gozstd.Writer // 直接作为Writer使用
-//	buffer  bytes.Buffer   // 输出缓冲区
-//	mu      sync.Mutex     // 并发控制
-//}
-//
-//func newZstdStreamCompressor() *ZstdStreamCompressor {
-//	var buf bytes.Buffer
-//	encoder := gozstd.NewWriter(&buf)
-//	//encoder, err := zstd.NewWriter(&buf, zstd.WithEncoderLevel(zstd.SpeedDefault))
-//
-//	return &ZstdStreamCompressor{
-//		encoder: encoder, // encoder本身即是Writer
-//		buffer:  buf,
-//	}
-//}
-//
-//func (z *ZstdStreamCompressor) Reset() error {
-//	z.buffer.Reset()                   // 重置缓冲区
-//	z.encoder.Reset(&z.buffer, nil, 6) // 重置编码器状态
-//	return nil
-//}
-//
-//func (z *ZstdStreamCompressor) Recycle() error {
-//	z.buffer.Reset()
-//	z.encoder.Reset(nil, nil, 6) // 释放资源
-//	return nil
-//}
-//func (z *ZstdStreamCompressor) Compress(data []byte) ([]byte, error) {
-//	z.mu.Lock()
-//	defer z.mu.Unlock()
-//	z.buffer.Reset()
-//	if _, err := z.encoder.Write(data); err != nil {
-//		return nil, err
-//	}
-//	if err := z.encoder.Flush(); err != nil {
-//		return nil, err
-//	}
-//	res := z.buffer.Bytes()
-//	return res, nil
-//}
-//
-//func (z *ZstdStreamCompressor) Close() error {
-//	return z.encoder.Close()
-//}
-//
-//type ZstdStreamDecompressor struct {
-//	decoder *gozstd.Reader
-//	src     *bytes.Buffer
-//	mu      sync.Mutex
-//}
-//
-//func NewZstdStreamDecompressor() DecompressorInterface {
-//	buf := new(bytes.Buffer)
-//	decoder := gozstd.NewReader(buf)
-//	return &ZstdStreamDecompressor{
-//		decoder: decoder,
-//		src:     buf,
-//	}
-//}
-//
-//func (z *ZstdStreamDecompressor) Decompress(data []byte) ([]byte, error) {
-//	z.mu.Lock()
-//	defer z.mu.Unlock()
-//	// 使用缓冲区复制数据
-//	//// 创建带缓冲的写入器
-//	z.src.Write(data)
-//	out := bytes.Buffer{}
-//	for {
-//		buf := make([]byte, 1024)
-//		n, err := z.decoder.Read(buf)
-//		if err != nil && err != io.EOF {
-//			return nil, err
-//		}
-//		if n > 0 {
-//			out.Write(buf[:n])
-//		} else if n == 0 || err == io.EOF {
-//			break
-//		}
-//
-//	}
-//	return out.Bytes(), nil
-//
-//}
-
-//func (z *ZstdStreamDecompressor) Reset() error {
-//	z.src.Reset()
-//	z.decoder.Reset(z.src, nil)
-//	return nil
-//}
-//
-//func (z *ZstdStreamDecompressor) Recycle() error {
-//	z.src.Reset()
-//	z.decoder.Reset(nil, nil)
-//	return nil
-//}
+// ZstdStreamCompressor zstd_stream模式的压缩器，一个连接共享一个zstd帧，每条消息后flush
+type ZstdStreamCompressor struct {
+	// DictVersion 使用的字典版本，为空时不使用字典
+	DictVersion string
+	encoder     *zstd.Encoder
+	buffer      *bytes.Buffer
+	mu          sync.Mutex
+}
+
+func NewZstdStreamCompressor(dictVersion string) *ZstdStreamCompressor {
+	return &ZstdStreamCompressor{DictVersion: dictVersion, buffer: &bytes.Buffer{}}
+}
+
+// Reset 开始新的压缩流，用于新的连接
+func (z *ZstdStreamCompressor) Reset() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.reset()
+}
+
+// reset 调用方需要持有mu
+func (z *ZstdStreamCompressor) reset() error {
+	z.buffer.Reset()
+	if z.encoder != nil {
+		z.encoder.Reset(z.buffer)
+		return nil
+	}
+	opts := []zstd.EOption{zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1)}
+	if z.DictVersion != "" {
+		d, err := DefaultDictRegistry.get(z.DictVersion)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, zstd.WithEncoderDict(d.Content))
+	}
+	encoder, err := zstd.NewWriter(z.buffer, opts...)
+	if err != nil {
+		return err
+	}
+	z.encoder = encoder
+	return nil
+}
 
+// Recycle 关闭encoder，之后再调用Compress会创建新的encoder
+func (z *ZstdStreamCompressor) Recycle() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.buffer.Reset()
+	if z.encoder == nil {
+		return nil
+	}
+	err := z.encoder.Close()
+	z.encoder = nil
+	return err
+}
+
+func (z *ZstdStreamCompressor) Compress(data []byte) ([]byte, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.encoder == nil {
+		if err := z.reset(); err != nil {
+			return nil, err
+		}
+	}
+	z.buffer.Reset()
+	if _, err := z.encoder.Write(data); err != nil {
+		return nil, err
+	}
+	if err := z.encoder.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(z.buffer.Bytes()), nil
+}
+
+// ZstdStreamDecompressor zstd_stream模式的解压器，一个连接共享一个zstd帧，服务端对每条消息flush
+type ZstdStreamDecompressor struct {
+	*streamDecompressor
+}
+
+func NewZstdStreamDecompressor() DecompressorInterface {
+	return &ZstdStreamDecompressor{
+		streamDecompressor: newStreamDecompressor(func(r io.Reader) (io.Reader, error) {
+			// 单线程同步解码，每次Read最多返回一个block，读取下一个block时才会向r要数据
+			if err := DefaultDictRegistry.ensureLoaded(); err != nil {
+				logger.Default().Warn("load embedded zstd dict failed, decode without dict", "err", err)
+			}
+			decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderDicts(DefaultDictRegistry.Dicts()...))
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		}),
+	}
+}
+
+// ZstdPerMessageCompressor zstd模式的压缩器，每条消息是一个完整的zstd帧
 type ZstdPerMessageCompressor struct {
+	// DictVersion 使用的字典版本，为空时不使用字典
+	DictVersion string
 }
 
-func NewZstdPerMessageCompressor() *ZstdPerMessageCompressor {
-	return &ZstdPerMessageCompressor{}
+func NewZstdPerMessageCompressor(dictVersion string) *ZstdPerMessageCompressor {
+	return &ZstdPerMessageCompressor{DictVersion: dictVersion}
 }
 
-//func (z *ZstdPerMessageCompressor) Compress(data []byte) ([]byte, error) {
-//	out := gozstd.Compress(nil, data)
-//	return out, nil
-//}
+func (z *ZstdPerMessageCompressor) Compress(data []byte) ([]byte, error) {
+	encoder, put, err := DefaultDictRegistry.getEncoder(z.DictVersion)
+	if err != nil {
+		return nil, err
+	}
+	defer put()
+	return encoder.EncodeAll(data, nil), nil
+}
 
 func (z *ZstdPerMessageCompressor) Reset() error {
 	return nil
@@ -138,9 +139,16 @@ func NewZstdPerMessageDecompressor() DecompressorInterface {
 }
 
 func (z *ZstdPerMessageDecompressor) Decompress(data []byte) ([]byte, error) {
-	decoder := zstdDecodePool.Get().(*zstd.Decoder)
-	defer zstdDecodePool.Put(decoder)
-	return decoder.DecodeAll(data, nil)
+	decoder, put, err := DefaultDictRegistry.getDecoder()
+	if err != nil {
+		return nil, err
+	}
+	defer put()
+	// DecodeAll会按帧头中声明的大小分配内存，改为流式读取以便限制解压后的大小
+	if err = decoder.Reset(plainReader{bytes.NewReader(data)}); err != nil {
+		return nil, err
+	}
+	return readLimited(decoder, len(data))
 }
 
 func (z *ZstdPerMessageDecompressor) Reset() error {
@@ -151,57 +159,8 @@ func (z *ZstdPerMessageDecompressor) Recycle() error {
 	return nil
 }
 
-var zstdEncodePoolMap map[string]*sync.Pool
-var zstdDecodePool *sync.Pool
-
-func InitZSTDPool(dictPath string) {
-	logrus.Infof("load zstd pool from dict:%s", dictPath)
-	zstdEncodePoolMap = make(map[string]*sync.Pool)
-	data, err := os.ReadFile(dictPath)
-	if err != nil {
-		panic(err)
-	}
-	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
-	if err != nil {
-		panic(err)
-	}
-	dicts := make([][]byte, 0)
-	for _, tt := range zr.File {
-		if !strings.HasSuffix(tt.Name, ".dict") {
-			continue
-		}
-		func() {
-			r, err := tt.Open()
-			if err != nil {
-				panic(err)
-			}
-			defer r.Close()
-			in, err := io.ReadAll(r)
-			if err != nil {
-				panic(err)
-			}
-
-			dicts = append(dicts, in)
-			item := sync.Pool{
-				New: func() interface{} {
-					writer, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderDict(in))
-					if err != nil {
-						panic(err)
-					}
-					return writer
-				},
-			}
-			zstdEncodePoolMap[tt.Name] = &item
-		}()
-	}
-
-	zstdDecodePool = &sync.Pool{
-		New: func() interface{} {
-			decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dicts...))
-			if err != nil {
-				panic(err)
-			}
-			return decoder
-		},
-	}
+// InitZSTDPool 从指定的字典包加载zstd字典，不调用时使用内置的字典包
+func InitZSTDPool(dictPath string) error {
+	logger.Default().Info("load zstd pool from dict", "dict", dictPath)
+	return DefaultDictRegistry.LoadZipFile(dictPath)
 }
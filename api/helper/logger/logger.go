@@ -0,0 +1,145 @@
+// Package logger SDK使用的日志接口，默认输出到logrus的StandardLogger，也可以替换为slog或自定义实现
+package logger
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Logger 结构化日志，args为交替的key、value，与slog相同
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+	// With 返回每条日志都带有args字段的Logger
+	With(args ...any) Logger
+}
+
+var defaultLogger atomic.Pointer[Logger]
+
+func init() {
+	SetDefault(NewLogrus(logrus.StandardLogger()))
+}
+
+// Default 返回没有单独设置Logger时使用的日志
+func Default() Logger {
+	return *defaultLogger.Load()
+}
+
+// SetDefault 替换默认日志，l为nil时不输出日志
+func SetDefault(l Logger) {
+	if l == nil {
+		l = Nop()
+	}
+	defaultLogger.Store(&l)
+}
+
+// OrDefault l为nil时返回Default()
+func OrDefault(l Logger) Logger {
+	if l == nil {
+		return Default()
+	}
+	return l
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlog 使用log/slog输出，l为nil时使用slog.Default()
+func NewSlog(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return &slogLogger{l: l}
+}
+
+func (s *slogLogger) Debug(msg string, args ...any) { s.log(slog.LevelDebug, msg, args) }
+func (s *slogLogger) Info(msg string, args ...any)  { s.log(slog.LevelInfo, msg, args) }
+func (s *slogLogger) Warn(msg string, args ...any)  { s.log(slog.LevelWarn, msg, args) }
+func (s *slogLogger) Error(msg string, args ...any) { s.log(slog.LevelError, msg, args) }
+
+func (s *slogLogger) log(level slog.Level, msg string, args []any) {
+	s.l.Log(context.Background(), level, msg, args...)
+}
+
+func (s *slogLogger) With(args ...any) Logger {
+	return &slogLogger{l: s.l.With(args...)}
+}
+
+type logrusLogger struct {
+	l logrus.FieldLogger
+}
+
+// NewLogrus 使用logrus输出，key为err的error值写入logrus的error字段
+func NewLogrus(l logrus.FieldLogger) Logger {
+	if l == nil {
+		l = logrus.StandardLogger()
+	}
+	return &logrusLogger{l: l}
+}
+
+func (l *logrusLogger) Debug(msg string, args ...any) { l.entry(args).Debug(msg) }
+func (l *logrusLogger) Info(msg string, args ...any)  { l.entry(args).Info(msg) }
+func (l *logrusLogger) Warn(msg string, args ...any)  { l.entry(args).Warn(msg) }
+func (l *logrusLogger) Error(msg string, args ...any) { l.entry(args).Error(msg) }
+
+func (l *logrusLogger) With(args ...any) Logger {
+	return &logrusLogger{l: l.entry(args)}
+}
+
+func (l *logrusLogger) entry(args []any) logrus.FieldLogger {
+	if len(args) == 0 {
+		return l.l
+	}
+	return l.l.WithFields(Fields(args))
+}
+
+// Fields 把交替的key、value转换为map，key不是字符串时与slog一样记为!BADKEY
+func Fields(args []any) logrus.Fields {
+	fields := make(logrus.Fields, len(args)/2+1)
+	for i := 0; i < len(args); {
+		key, ok := args[i].(string)
+		if !ok || i+1 == len(args) {
+			fields["!BADKEY"] = args[i]
+			i++
+			continue
+		}
+		value := args[i+1]
+		if err, isErr := value.(error); isErr && key == "err" {
+			key = logrus.ErrorKey
+			value = err
+		}
+		fields[key] = value
+		i += 2
+	}
+	return fields
+}
+
+type nopLogger struct{}
+
+// Nop 不输出任何日志
+func Nop() Logger {
+	return nopLogger{}
+}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+func (n nopLogger) With(...any) Logger { return n }
+
+// Stringer 延迟格式化，只有日志真正输出时才调用fmt.Sprintf
+type Stringer struct {
+	Format string
+	Args   []any
+}
+
+func (s Stringer) String() string {
+	return fmt.Sprintf(s.Format, s.Args...)
+}
@@ -0,0 +1,57 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSlog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewSlog(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	l = l.With("session_id", "s1")
+	l.Debug("hidden")
+	l.Info("receive", "sn", 3)
+	out := buf.String()
+	if strings.Contains(out, "hidden") || !strings.Contains(out, "msg=receive session_id=s1 sn=3") {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestLogrus(t *testing.T) {
+	buf := &bytes.Buffer{}
+	base := logrus.New()
+	base.SetOutput(buf)
+	base.SetFormatter(&logrus.TextFormatter{DisableTimestamp: true})
+	l := NewLogrus(base).With("state", "connected")
+	l.Error("send failed", "err", errors.New("broken pipe"), "sn", int64(5))
+	out := buf.String()
+	for _, want := range []string{`error="broken pipe"`, "sn=5", "state=connected", `msg="send failed"`} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output %q missing %s", out, want)
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	fields := Fields([]any{"a", 1, 2, "b"})
+	if fields["a"] != 1 || fields["!BADKEY"] != "b" || len(fields) != 2 {
+		t.Fatalf("fields %v", fields)
+	}
+}
+
+func TestSetDefault(t *testing.T) {
+	old := Default()
+	defer SetDefault(old)
+	SetDefault(nil)
+	if _, ok := Default().(nopLogger); !ok {
+		t.Fatalf("default %T", Default())
+	}
+	if OrDefault(nil) != Default() {
+		t.Fatal("OrDefault(nil) should return Default()")
+	}
+}
@@ -0,0 +1,123 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// KOOK接口返回的限速响应头
+const (
+	HeaderRateLimitRemaining = "X-Rate-Limit-Remaining"
+	HeaderRateLimitReset     = "X-Rate-Limit-Reset"
+	HeaderRateLimitBucket    = "X-Rate-Limit-Bucket"
+	HeaderRateLimitGlobal    = "X-Rate-Limit-Global"
+)
+
+const globalBucket = "global"
+
+// ErrRateLimited 接口返回429，可以用errors.Is判断，errors.As取得RateLimitError
+var ErrRateLimited = errors.New("api rate limited")
+
+// RateLimitError 接口返回429时的错误，Reset为响应头中的重置时间，没有时为0
+type RateLimitError struct {
+	Path       string
+	StatusCode int
+	Reset      time.Duration
+	// Global 为true时是全局限速，所有接口都需要等待
+	Global bool
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s: path %s status %d reset %s", ErrRateLimited, e.Path, e.StatusCode, e.Reset)
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// newRateLimitError 根据429响应头创建RateLimitError
+func newRateLimitError(path string, status int, header http.Header) *RateLimitError {
+	e := &RateLimitError{Path: path, StatusCode: status, Global: header.Get(HeaderRateLimitGlobal) != ""}
+	if reset, err := strconv.ParseFloat(header.Get(HeaderRateLimitReset), 64); err == nil && reset > 0 {
+		e.Reset = time.Duration(reset * float64(time.Second))
+	}
+	return e
+}
+
+// DefaultRateLimitMaxWait RateLimiter默认的单次最长等待时间
+const DefaultRateLimitMaxWait = 60 * time.Second
+
+// RateLimiter 按响应头记录每个bucket的限速，bucket剩余次数为0时，之后的请求等待到重置时间再发送
+// 限速按token区分，多个机器人共用一个RateLimiter时互不影响
+type RateLimiter struct {
+	// MaxWait 单次最长等待时间，重置时间更久时只等待MaxWait
+	MaxWait time.Duration
+	lock    sync.Mutex
+	buckets map[string]string
+	resetAt map[string]time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{MaxWait: DefaultRateLimitMaxWait, buckets: make(map[string]string), resetAt: make(map[string]time.Time)}
+}
+
+// rateLimitKey token与path或bucket组成的key
+func rateLimitKey(token, name string) string {
+	return token + "\x00" + name
+}
+
+// Wait 等待token下path所在的bucket及全局限速重置，返回等待的时间，ctx取消时提前返回
+func (r *RateLimiter) Wait(ctx context.Context, token, path string) time.Duration {
+	r.lock.Lock()
+	until := r.resetAt[rateLimitKey(token, globalBucket)]
+	if bucket, ok := r.buckets[rateLimitKey(token, path)]; ok && r.resetAt[bucket].After(until) {
+		until = r.resetAt[bucket]
+	}
+	r.lock.Unlock()
+	d := time.Until(until)
+	if d <= 0 {
+		return 0
+	}
+	if r.MaxWait > 0 && d > r.MaxWait {
+		d = r.MaxWait
+	}
+	start := time.Now()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+	return time.Since(start)
+}
+
+// Update 根据响应头更新token下path所在bucket的限速，429时即使没有剩余次数的响应头也会等待到重置时间
+func (r *RateLimiter) Update(token, path string, status int, header http.Header) {
+	reset, err := strconv.ParseFloat(header.Get(HeaderRateLimitReset), 64)
+	if err != nil || reset <= 0 {
+		return
+	}
+	bucket := header.Get(HeaderRateLimitBucket)
+	if bucket == "" {
+		bucket = path
+	}
+	if header.Get(HeaderRateLimitGlobal) != "" {
+		bucket = globalBucket
+	}
+	key := rateLimitKey(token, bucket)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if bucket != globalBucket {
+		r.buckets[rateLimitKey(token, path)] = key
+	}
+	if header.Get(HeaderRateLimitRemaining) == "0" || status == http.StatusTooManyRequests {
+		r.resetAt[key] = time.Now().Add(time.Duration(reset * float64(time.Second)))
+	} else {
+		delete(r.resetAt, key)
+	}
+}
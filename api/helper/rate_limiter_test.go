@@ -0,0 +1,105 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeMetrics struct {
+	waits    []time.Duration
+	statuses []int
+}
+
+func (f *fakeMetrics) FrameReceived(int32)                      {}
+func (f *fakeMetrics) FrameError(string)                        {}
+func (f *fakeMetrics) HandlerDone(string, time.Duration, error) {}
+func (f *fakeMetrics) Reconnect(string)                         {}
+func (f *fakeMetrics) Resume(string)                            {}
+func (f *fakeMetrics) HeartbeatRTT(time.Duration)               {}
+func (f *fakeMetrics) StateChanged(string)                      {}
+func (f *fakeMetrics) APIRequest(endpoint string, status int, d time.Duration) {
+	f.statuses = append(f.statuses, status)
+}
+func (f *fakeMetrics) RateLimitWait(endpoint string, d time.Duration) {
+	f.waits = append(f.waits, d)
+}
+
+func TestRateLimitWait(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderRateLimitRemaining, "0")
+		w.Header().Set(HeaderRateLimitReset, "0.2")
+		w.Header().Set(HeaderRateLimitBucket, "message/create")
+		w.Write([]byte(`{"code":0}`))
+	}))
+	defer srv.Close()
+	limiter := NewRateLimiter()
+	m := &fakeMetrics{}
+	for i := 0; i < 2; i++ {
+		h := NewApiHelper("/v3/message/create", "token", srv.URL, "", "").SetMetrics(m).SetRateLimiter(limiter)
+		if _, err := h.Post(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.statuses) != 2 || m.statuses[0] != 200 {
+		t.Fatalf("api requests %v", m.statuses)
+	}
+	if len(m.waits) != 1 || m.waits[0] < 150*time.Millisecond {
+		t.Fatalf("rate limit waits %v", m.waits)
+	}
+}
+
+func TestRateLimiterGlobal(t *testing.T) {
+	limiter := NewRateLimiter()
+	limiter.MaxWait = 50 * time.Millisecond
+	header := http.Header{}
+	header.Set(HeaderRateLimitReset, "10")
+	header.Set(HeaderRateLimitGlobal, "1")
+	limiter.Update("token", "/v3/message/create", http.StatusTooManyRequests, header)
+	if d := limiter.Wait(context.Background(), "token", "/v3/user/me"); d < 50*time.Millisecond || d > time.Second {
+		t.Fatalf("global wait %v", d)
+	}
+}
+
+func TestRateLimiterPerToken(t *testing.T) {
+	limiter := NewRateLimiter()
+	header := http.Header{}
+	header.Set(HeaderRateLimitRemaining, "0")
+	header.Set(HeaderRateLimitReset, "10")
+	header.Set(HeaderRateLimitBucket, "message/create")
+	limiter.Update("token1", "/v3/message/create", http.StatusOK, header)
+	// 其它机器人的同一个bucket不受影响
+	if d := limiter.Wait(context.Background(), "token2", "/v3/message/create"); d != 0 {
+		t.Fatalf("token2 wait %v", d)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if d := limiter.Wait(ctx, "token1", "/v3/message/create"); d < 50*time.Millisecond {
+		t.Fatalf("token1 wait %v", d)
+	}
+}
+
+func TestApiHelperNoRateLimitByDefault(t *testing.T) {
+	if h := NewApiHelper("/v3/message/create", "token", "", "", ""); h.RateLimiter != nil {
+		t.Fatal("rate limiter should be opt-in")
+	}
+}
+
+func TestRateLimitError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderRateLimitReset, "1.5")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+	_, err := NewApiHelper("/v3/message/create", "token", srv.URL, "", "").Post()
+	var rateErr *RateLimitError
+	if !errors.Is(err, ErrRateLimited) || !errors.As(err, &rateErr) {
+		t.Fatalf("expect RateLimitError, got %v", err)
+	}
+	if rateErr.StatusCode != http.StatusTooManyRequests || rateErr.Reset != 1500*time.Millisecond || rateErr.Global {
+		t.Fatalf("rate limit error %+v", rateErr)
+	}
+}
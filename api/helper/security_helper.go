@@ -4,33 +4,64 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
-	log "github.com/sirupsen/logrus"
+	"errors"
+	"fmt"
+	"github.com/bytedance/sonic"
 	"strings"
 )
 
-func DecryptData(data string, encryptKey string) (error, []byte) {
+var (
+	ErrInvalidBase64        = errors.New("invalid base64 data")
+	ErrCipherTextTooShort   = errors.New("cipher text too short")
+	ErrCipherTextNotAligned = errors.New("cipher text is not a multiple of the block size")
+	ErrInvalidIV            = errors.New("iv length must equal the block size")
+	ErrInvalidPadding       = errors.New("invalid padding")
+)
 
-	rawBase64Decoded, err := base64.StdEncoding.DecodeString(data)
+// EncryptData 加密webhook数据，使用随机的iv，返回值可以用DecryptData解密
+func EncryptData(plaintext []byte, encryptKey string) (error, string) {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return err, ""
+	}
+	err, cipherText := Aes256CBCEncode(string(plaintext), []byte(encryptKey), iv)
+	if err != nil {
+		return err, ""
+	}
+	return nil, base64.StdEncoding.EncodeToString(append(iv, cipherText...))
+}
 
+// EncryptWebhookPayload 生成和服务端相同格式的加密webhook请求体 {"encrypt": base64(iv + base64(密文))}
+func EncryptWebhookPayload(plaintext []byte, encryptKey string) (error, []byte) {
+	err, encrypted := EncryptData(plaintext, encryptKey)
 	if err != nil {
-		log.Error(err)
 		return err, nil
 	}
-	iv := rawBase64Decoded[:16]
-	decryptedContent := string(rawBase64Decoded[16:])
-	return Ase256CBCDecode(decryptedContent, []byte(encryptKey), iv)
+	payload, err := sonic.Marshal(map[string]string{"encrypt": encrypted})
+	if err != nil {
+		return err, nil
+	}
+	return nil, payload
 }
 
-// PKCS7 填充函数
-func pkcs7Padding(data []byte, blockSize int) []byte {
-	padding := blockSize - len(data)%blockSize
-	padtext := make([]byte, len(data)+padding)
-	copy(padtext, data)
-	for i := len(data); i < len(padtext); i++ {
-		padtext[i] = byte(padding)
+// DecryptData 解密webhook数据，data为base64(iv + base64(密文))
+// 解密失败只返回错误，不记录日志，由调用方决定日志级别，避免伪造的请求刷屏
+func DecryptData(data string, encryptKey string) (error, []byte) {
+
+	rawBase64Decoded, err := base64.StdEncoding.DecodeString(data)
+
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBase64, err), nil
+	}
+	if len(rawBase64Decoded) <= aes.BlockSize {
+		return ErrCipherTextTooShort, nil
 	}
-	return padtext
+	iv := rawBase64Decoded[:aes.BlockSize]
+	decryptedContent := string(rawBase64Decoded[aes.BlockSize:])
+	return Ase256CBCDecode(decryptedContent, []byte(encryptKey), iv)
 }
 
 func processPassphrase(passphrase []byte) []byte {
@@ -49,33 +80,35 @@ func processPassphrase(passphrase []byte) []byte {
 	return passphrase
 }
 
-// 加密函数
+// 加密函数，返回未编码的密文
 func encryptAES256CBC(plaintext []byte, key []byte, iv []byte) ([]byte, error) {
+	if len(iv) != aes.BlockSize {
+		return nil, ErrInvalidIV
+	}
 	usedKey := processPassphrase(key)
 	block, err := aes.NewCipher(usedKey)
 	if err != nil {
 		return nil, err
 	}
 
-	// 对明文进行填充
-	plaintext = pkcs7Padding(plaintext, aes.BlockSize)
+	// 对明文进行填充，复制一份避免修改调用方的数据
+	padded := PKCS5Padding(append([]byte(nil), plaintext...), aes.BlockSize)
 
-	ciphertext := make([]byte, len(plaintext))
+	ciphertext := make([]byte, len(padded))
 	mode := cipher.NewCBCEncrypter(block, iv)
-	mode.CryptBlocks(ciphertext, plaintext)
+	mode.CryptBlocks(ciphertext, padded)
 
 	return ciphertext, nil
 }
 
-// PKCS7 去除填充函数
-func pkcs7UnPadding(data []byte) []byte {
-	length := len(data)
-	padding := int(data[length-1])
-	return data[:(length - padding)]
-}
-
 // 解密函数
 func decryptAES256CBC(ciphertext []byte, key []byte, iv []byte) ([]byte, error) {
+	if len(iv) != aes.BlockSize {
+		return nil, ErrInvalidIV
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, ErrCipherTextNotAligned
+	}
 	useKey := processPassphrase(key)
 	block, err := aes.NewCipher(useKey)
 	if err != nil {
@@ -87,20 +120,13 @@ func decryptAES256CBC(ciphertext []byte, key []byte, iv []byte) ([]byte, error)
 	mode.CryptBlocks(plaintext, ciphertext)
 
 	// 去除填充
-	plaintext = pkcs7UnPadding(plaintext)
-
-	return plaintext, nil
+	return PKCS7Unpadding(plaintext, aes.BlockSize)
 }
 func Aes256CBCEncode(plaintext string, encryptKey []byte, iv []byte) (error, []byte) {
-	bKey := processPassphrase(encryptKey)
-	bPlaintext := PKCS5Padding([]byte(plaintext), aes.BlockSize)
-	block, err := aes.NewCipher(bKey)
+	ciphertext, err := encryptAES256CBC([]byte(plaintext), encryptKey, iv)
 	if err != nil {
 		return err, nil
 	}
-	ciphertext := make([]byte, len(bPlaintext))
-	mode := cipher.NewCBCEncrypter(block, iv)
-	mode.CryptBlocks(ciphertext, bPlaintext)
 	dst := make([]byte, base64.StdEncoding.EncodedLen(len(ciphertext)))
 	base64.StdEncoding.Encode(dst, ciphertext)
 	return nil, dst
@@ -110,22 +136,13 @@ func Ase256CBCDecode(cipherText string, encKey []byte, iv []byte) (error, []byte
 
 	cipherTextDecoded, err := base64.StdEncoding.DecodeString(cipherText)
 	if err != nil {
-		log.Error(err)
-		return err, nil
+		return fmt.Errorf("%w: %v", ErrInvalidBase64, err), nil
 	}
-	usedEncKey := processPassphrase(encKey)
-	bKey := usedEncKey
-	bIV := iv
-
-	block, err := aes.NewCipher(bKey)
+	plaintext, err := decryptAES256CBC(cipherTextDecoded, encKey, iv)
 	if err != nil {
-		log.Error(err)
 		return err, nil
 	}
-
-	mode := cipher.NewCBCDecrypter(block, bIV)
-	mode.CryptBlocks([]byte(cipherTextDecoded), []byte(cipherTextDecoded))
-	return nil, PKCS5Trimming(cipherTextDecoded)
+	return nil, plaintext
 }
 
 func PKCS5Padding(ciphertext []byte, blockSize int) []byte {
@@ -134,7 +151,34 @@ func PKCS5Padding(ciphertext []byte, blockSize int) []byte {
 	return append(ciphertext, padtext...)
 }
 
+// PKCS5Trimming 去除填充，填充不合法时返回nil
+//
+// Deprecated: 使用PKCS7Unpadding，可以区分填充错误
 func PKCS5Trimming(encrypt []byte) []byte {
-	padding := encrypt[len(encrypt)-1]
-	return encrypt[:len(encrypt)-int(padding)]
+	res, err := PKCS7Unpadding(encrypt, aes.BlockSize)
+	if err != nil {
+		return nil
+	}
+	return res
+}
+
+// PKCS7Unpadding 校验并去除填充，所有填充字节都必须等于填充长度
+// 校验过程不依赖填充内容提前返回，避免通过耗时差异推测明文
+func PKCS7Unpadding(data []byte, blockSize int) ([]byte, error) {
+	length := len(data)
+	if length == 0 || length%blockSize != 0 {
+		return nil, ErrInvalidPadding
+	}
+	padding := int(data[length-1])
+	good := subtle.ConstantTimeLessOrEq(1, padding) & subtle.ConstantTimeLessOrEq(padding, blockSize)
+	for i := 1; i <= blockSize; i++ {
+		// 只检查最后padding个字节
+		inPadding := subtle.ConstantTimeLessOrEq(i, padding)
+		match := subtle.ConstantTimeByteEq(data[length-i], byte(padding))
+		good &= match | (inPadding ^ 1)
+	}
+	if good != 1 {
+		return nil, ErrInvalidPadding
+	}
+	return data[:length-padding], nil
 }
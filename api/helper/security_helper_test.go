@@ -1,9 +1,12 @@
 package helper
 
 import (
+	"bytes"
 	"encoding/base64"
+	"errors"
 	"github.com/bytedance/sonic"
 	log "github.com/sirupsen/logrus"
+	"strings"
 	"testing"
 	"time"
 )
@@ -80,3 +83,123 @@ func TestEncryptData3(t *testing.T) {
 	base64.StdEncoding.Encode(cipherBytesBase64, encryptedData)
 	t.Logf("%s", string(cipherBytesBase64))
 }
+
+// encryptWebhookData 按webhook的格式加密：base64(iv + base64(密文))
+func encryptWebhookData(t testing.TB, plaintext, key, iv string) string {
+	err, encrypted := Aes256CBCEncode(plaintext, []byte(key), []byte(iv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(append([]byte(iv), encrypted...))
+}
+
+func TestDecryptDataInvalid(t *testing.T) {
+	key, iv := "sfjlfvx98sdlsdfsdfsdfD)9DJ&sdf", "9051dbfc59d6af1d"
+	valid := encryptWebhookData(t, `{"s":0}`, key, iv)
+	err, plain := DecryptData(valid, key)
+	if err != nil || string(plain) != `{"s":0}` {
+		t.Fatalf("decrypt valid data: %v %s", err, plain)
+	}
+
+	cases := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"not base64", "!!!", ErrInvalidBase64},
+		{"empty", "", ErrCipherTextTooShort},
+		{"short", base64.StdEncoding.EncodeToString([]byte("short")), ErrCipherTextTooShort},
+		{"iv only", base64.StdEncoding.EncodeToString([]byte(iv)), ErrCipherTextTooShort},
+		{"inner not base64", base64.StdEncoding.EncodeToString([]byte(iv + "!!!!")), ErrInvalidBase64},
+		{"not aligned", base64.StdEncoding.EncodeToString([]byte(iv + base64.StdEncoding.EncodeToString([]byte("12345")))), ErrCipherTextNotAligned},
+		{"wrong key", valid, ErrInvalidPadding},
+	}
+	for _, c := range cases {
+		decryptKey := key
+		if c.name == "wrong key" {
+			decryptKey = "another key"
+		}
+		err, _ := DecryptData(c.data, decryptKey)
+		if !errors.Is(err, c.err) {
+			// 错误的key解密后填充恰好合法的概率很低，但不为0
+			if c.name == "wrong key" && err == nil {
+				continue
+			}
+			t.Fatalf("%s: got %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestPKCS7Unpadding(t *testing.T) {
+	block := bytes.Repeat([]byte("a"), 16)
+	cases := []struct {
+		data []byte
+		want []byte
+		err  error
+	}{
+		{append(bytes.Repeat([]byte("a"), 12), 4, 4, 4, 4), bytes.Repeat([]byte("a"), 12), nil},
+		{append(block, bytes.Repeat([]byte{16}, 16)...), block, nil},
+		{append(bytes.Repeat([]byte("a"), 12), 4, 3, 4, 4), nil, ErrInvalidPadding},
+		{append(bytes.Repeat([]byte("a"), 15), 0), nil, ErrInvalidPadding},
+		{append(bytes.Repeat([]byte("a"), 15), 17), nil, ErrInvalidPadding},
+		{[]byte{1, 1, 1}, nil, ErrInvalidPadding},
+		{nil, nil, ErrInvalidPadding},
+	}
+	for i, c := range cases {
+		res, err := PKCS7Unpadding(c.data, 16)
+		if !errors.Is(err, c.err) || !bytes.Equal(res, c.want) {
+			t.Fatalf("case %d: got %v %v", i, res, err)
+		}
+	}
+	if PKCS5Trimming([]byte{1, 2, 3}) != nil {
+		t.Fatal("expect nil for invalid padding")
+	}
+}
+
+func FuzzDecryptData(f *testing.F) {
+	key, iv := "sfjlfvx98sdlsdfsdfsdfD)9DJ&sdf", "9051dbfc59d6af1d"
+	f.Add(encryptWebhookData(f, `{"s":0,"d":{"type":255}}`, key, iv), key)
+	f.Add(encryptWebhookData(f, "", key, iv), key)
+	f.Add("", key)
+	f.Add("AAAA", "")
+	f.Add(base64.StdEncoding.EncodeToString([]byte(iv+"AAAA")), key)
+	f.Fuzz(func(t *testing.T, data string, key string) {
+		err, plain := DecryptData(data, key)
+		if err != nil && plain != nil {
+			t.Fatalf("plaintext returned with error %v", err)
+		}
+		if err == nil {
+			// 解密成功时，重新加密后可以得到同样的明文
+			raw, _ := base64.StdEncoding.DecodeString(data)
+			reencrypted := encryptWebhookData(t, string(plain), key, string(raw[:16]))
+			if err, again := DecryptData(reencrypted, key); err != nil || !bytes.Equal(again, plain) {
+				t.Fatalf("round trip: %v", err)
+			}
+		}
+	})
+}
+
+func TestEncryptWebhookPayload(t *testing.T) {
+	key := "sfjlfvx98sdlsdfsdfsdfD)9DJ&sdf"
+	for _, plain := range []string{"", `{"s":0,"d":{"type":255,"challenge":"c"}}`, strings.Repeat("x", 16), strings.Repeat("中文", 100)} {
+		err, payload := EncryptWebhookPayload([]byte(plain), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypted, err := sonic.Get(payload, "encrypt")
+		if err != nil {
+			t.Fatalf("payload %s: %v", payload, err)
+		}
+		data, _ := encrypted.String()
+		err, res := DecryptData(data, key)
+		if err != nil || string(res) != plain {
+			t.Fatalf("round trip %q: %q %v", plain, res, err)
+		}
+	}
+	// 每次使用随机的iv
+	_, a := EncryptData([]byte("same"), key)
+	_, b := EncryptData([]byte("same"), key)
+	if a == b {
+		t.Fatal("iv should be random")
+	}
+}
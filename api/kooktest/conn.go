@@ -0,0 +1,238 @@
+package kooktest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/bytedance/sonic"
+	"github.com/gorilla/websocket"
+	"github.com/kaiheila/golang-bot/api/base/event"
+	"github.com/kaiheila/golang-bot/api/helper/compress"
+	"github.com/kaiheila/golang-bot/api/helper/logger"
+)
+
+// outFrame 服务端发送的frame，v1 header时sn同时写在header中
+type outFrame struct {
+	SignalType int32       `json:"s"`
+	Data       interface{} `json:"d,omitempty"`
+	SN         int64       `json:"sn,omitempty"`
+}
+
+// Conn 一个websocket连接，压缩方式和header版本取自网关参数
+type Conn struct {
+	SessionId string
+	// Query 连接网关时的参数，resume时带有sn、sessionId和resume=1
+	Query url.Values
+	// Resumed 连接时带有已知的sessionId，没有重新分配session
+	Resumed bool
+
+	server        *Server
+	ws            *websocket.Conn
+	compressType  compress.CompressType
+	headerVersion int
+	compressor    compress.CompressorInterface
+	decompressor  compress.DecompressorInterface
+	writeLock     sync.Mutex
+	lock          sync.Mutex
+	received      []*event.FrameMap
+	closed        bool
+	done          chan struct{}
+}
+
+func (s *Server) serveGateway(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	compressType, err := parseCompress(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	headerVersion, _ := strconv.Atoi(query.Get("header-version"))
+	c := &Conn{Query: query, server: s, compressType: compressType, headerVersion: headerVersion, done: make(chan struct{})}
+	if compressType != compress.CompressTypeNone {
+		if c.compressor, err = compress.GetCompressorWithDict(compressType, query.Get("dict-version")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.decompressor = compress.GetDecompressor(compressType)
+	}
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c.ws = ws
+
+	s.lock.Lock()
+	sessionId := query.Get("sessionId")
+	if query.Get("resume") == "1" && s.sessions[sessionId] {
+		c.SessionId, c.Resumed = sessionId, true
+	} else {
+		s.seq++
+		c.SessionId = fmt.Sprintf("kooktest-session-%d", s.seq)
+		s.sessions[c.SessionId] = true
+	}
+	s.conns[c] = struct{}{}
+	s.lock.Unlock()
+
+	if err = c.Send(event.SIG_HELLO, map[string]interface{}{"code": 0, "session_id": c.SessionId}); err != nil {
+		c.Close()
+		return
+	}
+	if c.Resumed {
+		sn, _ := strconv.ParseInt(query.Get("sn"), 10, 64)
+		c.resend(s.eventsAfter(sn))
+	}
+	s.connCh <- c
+	go c.readLoop()
+}
+
+// Send 发送一个signal，按连接的压缩方式和header版本编码
+func (c *Conn) Send(signalType int32, data interface{}) error {
+	return c.send(outFrame{SignalType: signalType, Data: data})
+}
+
+// SendReconnect 发送RECONNECT后断开连接
+func (c *Conn) SendReconnect(code int, msg string) error {
+	err := c.Send(event.SIG_RECONNECT, map[string]interface{}{"code": code, "err": msg})
+	c.Close()
+	return err
+}
+
+func (c *Conn) sendEvent(sn int64, data interface{}) error {
+	return c.send(outFrame{SignalType: event.SIG_EVENT, Data: data, SN: sn})
+}
+
+func (c *Conn) send(frame outFrame) error {
+	payload, err := sonic.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	// 流式压缩需要按发送的顺序压缩，所以压缩也在写锁内
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	messageType := websocket.TextMessage
+	if c.compressor != nil {
+		if payload, err = c.compressor.Compress(payload); err != nil {
+			return err
+		}
+		messageType = websocket.BinaryMessage
+	}
+	if c.headerVersion > 0 {
+		sig := event.NewBaseSignal(int(frame.SignalType), c.headerVersion, frame.SN > 0)
+		sig.SN = frame.SN
+		sig.IncludeLength = true
+		sig.WithPayload(payload)
+		if payload, err = sig.Encode(); err != nil {
+			return err
+		}
+		messageType = websocket.BinaryMessage
+	}
+	return c.ws.WriteMessage(messageType, payload)
+}
+
+func (c *Conn) resend(events []storedEvent) {
+	for _, e := range events {
+		if err := c.sendEvent(e.sn, e.data); err != nil {
+			logger.Default().Warn("kooktest resend event", "err", err, "sn", e.sn)
+			return
+		}
+	}
+}
+
+// Received 返回客户端发送的signal
+func (c *Conn) Received() []*event.FrameMap {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	res := make([]*event.FrameMap, len(c.received))
+	copy(res, c.received)
+	return res
+}
+
+// Done 连接断开后关闭
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close 直接断开连接，不发送close消息
+func (c *Conn) Close() {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return
+	}
+	c.closed = true
+	c.lock.Unlock()
+	c.ws.Close()
+	c.server.lock.Lock()
+	delete(c.server.conns, c)
+	c.server.lock.Unlock()
+}
+
+func (c *Conn) readLoop() {
+	defer close(c.done)
+	defer c.Close()
+	for {
+		messageType, data, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		frame, err := c.decode(messageType, data)
+		if err != nil {
+			logger.Default().Warn("kooktest decode client signal", "err", err)
+			continue
+		}
+		c.lock.Lock()
+		c.received = append(c.received, frame)
+		c.lock.Unlock()
+		c.handle(frame)
+	}
+}
+
+// decode 二进制消息可能带有header，payload不是json时按连接的压缩方式解压
+func (c *Conn) decode(messageType int, data []byte) (*event.FrameMap, error) {
+	if messageType == websocket.BinaryMessage && c.headerVersion > 0 {
+		sig, err := event.Decode(data, c.headerVersion)
+		if err != nil {
+			return nil, err
+		}
+		data = sig.Payload
+	}
+	if len(data) > 0 && data[0] != '{' {
+		if c.decompressor == nil {
+			return nil, errors.New("compressed signal without compress")
+		}
+		var err error
+		if data, err = c.decompressor.Decompress(data); err != nil {
+			return nil, err
+		}
+	}
+	lazy, err := event.NewLazyFrame(data)
+	if err != nil {
+		return nil, err
+	}
+	return lazy.FrameMap(true)
+}
+
+func (c *Conn) handle(frame *event.FrameMap) {
+	var err error
+	switch frame.SignalType {
+	case event.SIG_PING:
+		if !c.server.isDropPong() {
+			err = c.Send(event.SIG_PONG, nil)
+		}
+	case event.SIG_RESUME:
+		c.resend(c.server.eventsAfter(frame.SerialNumber))
+		err = c.Send(event.SIG_RESUME_ACK, map[string]interface{}{"session_id": c.SessionId})
+	case event.SIG_NACK:
+		var nack event.NAckData
+		if err = frame.DecodeData(&nack); err == nil {
+			c.resend(c.server.eventsOf(nack.SnList))
+		}
+	}
+	if err != nil {
+		logger.Default().Warn("kooktest handle client signal", "err", err, "s", frame.SignalType)
+	}
+}
@@ -0,0 +1,325 @@
+// Package kooktest 进程内的KOOK服务端，用于在测试中代替线上的网关和REST接口
+package kooktest
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/gorilla/websocket"
+	"github.com/kaiheila/golang-bot/api/helper/compress"
+	"github.com/kaiheila/golang-bot/api/helper/logger"
+)
+
+const (
+	GatewayIndexPath = "/v3/gateway/index"
+	GatewayPath      = "/gateway"
+	// apiPrefix 线上的BaseUrl带有/api，两种写法都可以访问
+	apiPrefix = "/api"
+)
+
+var ErrConnTimeout = errors.New("wait websocket connection timeout")
+
+// Call 一次REST请求
+type Call struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+}
+
+// Result KOOK接口的返回格式
+type Result struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data"`
+}
+
+type storedEvent struct {
+	sn   int64
+	data interface{}
+}
+
+// Server 基于httptest的KOOK服务端，提供/v3/gateway/index、websocket网关，并记录其它REST请求
+type Server struct {
+	*httptest.Server
+	// Token 不为空时校验请求头Authorization: Bot <Token>
+	Token string
+
+	upgrader websocket.Upgrader
+	lock     sync.Mutex
+	sn       int64
+	history  []storedEvent
+	conns    map[*Conn]struct{}
+	sessions map[string]bool
+	calls    []Call
+	gateways []url.Values
+	handlers map[string]http.HandlerFunc
+	dropPong bool
+	connCh   chan *Conn
+	seq      int64
+}
+
+// NewServer 创建并启动服务端，用完后调用Close
+func NewServer() *Server {
+	s := &Server{
+		conns:    make(map[*Conn]struct{}),
+		sessions: make(map[string]bool),
+		handlers: make(map[string]http.HandlerFunc),
+		connCh:   make(chan *Conn, 64),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// BaseUrl 返回传给NewWebSocketSession或NewApiHelper的BaseUrl
+func (s *Server) BaseUrl() string {
+	return s.URL + apiPrefix
+}
+
+// Handle 设置path的处理函数，没有设置的REST接口返回code为0的空结果
+func (s *Server) Handle(path string, handler http.HandlerFunc) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.handlers[path] = handler
+}
+
+// HandleResult path返回固定的结果
+func (s *Server) HandleResult(path string, result Result) {
+	s.Handle(path, func(w http.ResponseWriter, r *http.Request) {
+		writeResult(w, http.StatusOK, result)
+	})
+}
+
+// Calls 返回记录的REST请求，不包括获取网关和websocket连接
+func (s *Server) Calls() []Call {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	calls := make([]Call, len(s.calls))
+	copy(calls, s.calls)
+	return calls
+}
+
+// CallsTo 返回请求path的记录
+func (s *Server) CallsTo(path string) []Call {
+	res := make([]Call, 0)
+	for _, call := range s.Calls() {
+		if call.Path == path {
+			res = append(res, call)
+		}
+	}
+	return res
+}
+
+// GatewayRequests 返回每次获取网关时的参数
+func (s *Server) GatewayRequests() []url.Values {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make([]url.Values, len(s.gateways))
+	copy(res, s.gateways)
+	return res
+}
+
+// WaitConn 等待下一个发送了HELLO的websocket连接
+func (s *Server) WaitConn(timeout time.Duration) (*Conn, error) {
+	select {
+	case c := <-s.connCh:
+		return c, nil
+	case <-time.After(timeout):
+		return nil, ErrConnTimeout
+	}
+}
+
+// Conns 返回当前的websocket连接
+func (s *Server) Conns() []*Conn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make([]*Conn, 0, len(s.conns))
+	for c := range s.conns {
+		res = append(res, c)
+	}
+	return res
+}
+
+// SendEvent 分配下一个sn，记录事件用于resume/nack重发，并发送给所有连接
+func (s *Server) SendEvent(data interface{}) int64 {
+	s.lock.Lock()
+	s.sn++
+	sn := s.sn
+	s.history = append(s.history, storedEvent{sn: sn, data: data})
+	s.lock.Unlock()
+	for _, c := range s.Conns() {
+		if err := c.sendEvent(sn, data); err != nil {
+			logger.Default().Warn("kooktest send event", "err", err, "sn", sn)
+		}
+	}
+	return sn
+}
+
+// SkipSN 为每个事件分配sn但不发送，客户端收到后续事件时sn不连续，被跳过的事件可以通过nack或resume补发
+func (s *Server) SkipSN(events ...interface{}) []int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sns := make([]int64, 0, len(events))
+	for _, data := range events {
+		s.sn++
+		s.history = append(s.history, storedEvent{sn: s.sn, data: data})
+		sns = append(sns, s.sn)
+	}
+	return sns
+}
+
+// MaxSN 返回最后分配的sn
+func (s *Server) MaxSN() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sn
+}
+
+// SetDropPong 为true时收到ping不回复pong
+func (s *Server) SetDropPong(drop bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.dropPong = drop
+}
+
+func (s *Server) isDropPong() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dropPong
+}
+
+// CloseConns 直接断开所有连接，不发送close消息
+func (s *Server) CloseConns() {
+	for _, c := range s.Conns() {
+		c.Close()
+	}
+}
+
+// SendReconnect 发送RECONNECT并断开所有连接，客户端需要重新获取网关
+func (s *Server) SendReconnect(code int, msg string) {
+	for _, c := range s.Conns() {
+		c.SendReconnect(code, msg)
+	}
+}
+
+// Close 断开所有连接并关闭服务端
+func (s *Server) Close() {
+	s.CloseConns()
+	s.Server.Close()
+}
+
+// eventsAfter 返回sn之后的事件
+func (s *Server) eventsAfter(sn int64) []storedEvent {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make([]storedEvent, 0)
+	for _, e := range s.history {
+		if e.sn > sn {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// eventsOf 返回sns对应的事件
+func (s *Server) eventsOf(sns []int64) []storedEvent {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	want := make(map[int64]bool, len(sns))
+	for _, sn := range sns {
+		want[sn] = true
+	}
+	res := make([]storedEvent, 0, len(sns))
+	for _, e := range s.history {
+		if want[e.sn] {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	if path == GatewayPath {
+		s.serveGateway(w, r)
+		return
+	}
+	if s.Token != "" && r.Header.Get("Authorization") != "Bot "+s.Token {
+		writeResult(w, http.StatusUnauthorized, Result{Code: 401, Message: "你的用户凭证不正确"})
+		return
+	}
+	if path == GatewayIndexPath {
+		s.serveGatewayIndex(w, r)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.lock.Lock()
+	s.calls = append(s.calls, Call{Method: r.Method, Path: path, Query: r.URL.Query(), Header: r.Header.Clone(), Body: body})
+	handler := s.handlers[path]
+	s.lock.Unlock()
+	if handler != nil {
+		handler(w, r)
+		return
+	}
+	writeResult(w, http.StatusOK, Result{Code: 0, Message: "操作成功", Data: map[string]interface{}{}})
+}
+
+// serveGatewayIndex 返回的网关地址带有协商的压缩和header参数，客户端连接时原样带回
+func (s *Server) serveGatewayIndex(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	s.lock.Lock()
+	s.gateways = append(s.gateways, query)
+	s.lock.Unlock()
+	if _, err := parseCompress(query); err != nil {
+		writeResult(w, http.StatusOK, Result{Code: 40000, Message: err.Error()})
+		return
+	}
+	params := url.Values{}
+	for _, key := range []string{"compress", "compress-type", "dict-version", "header-version"} {
+		if v := query.Get(key); v != "" {
+			params.Set(key, v)
+		}
+	}
+	params.Set("token", s.Token)
+	gateway := "ws" + strings.TrimPrefix(s.URL, "http") + GatewayPath + "?" + params.Encode()
+	writeResult(w, http.StatusOK, Result{Code: 0, Message: "操作成功", Data: map[string]string{"url": gateway}})
+}
+
+// parseCompress 按网关参数返回压缩类型，compress=1且没有compress-type时为zlib
+func parseCompress(query url.Values) (compress.CompressType, error) {
+	if query.Get("compress") != "1" {
+		return compress.CompressTypeNone, nil
+	}
+	name := query.Get("compress-type")
+	if name == "" {
+		return compress.CompressTypeZlibPerMessage, nil
+	}
+	t := compress.ParseCompressType(true, name)
+	if compress.GetCompressTypeName(t) != name {
+		return compress.CompressTypeNone, errors.New("unsupported compress-type " + name)
+	}
+	return t, nil
+}
+
+func writeResult(w http.ResponseWriter, status int, result Result) {
+	data, err := sonic.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -0,0 +1,259 @@
+package kooktest
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gookit/event"
+	"github.com/kaiheila/golang-bot/api/base"
+	event2 "github.com/kaiheila/golang-bot/api/base/event"
+	"github.com/kaiheila/golang-bot/api/helper"
+	"github.com/kaiheila/golang-bot/api/helper/compress"
+)
+
+const waitTimeout = 5 * time.Second
+
+func testPolicy() *base.ReconnectPolicy {
+	policy := base.DefaultReconnectPolicy()
+	for state, param := range policy.States {
+		param.StartDelay = 0
+		param.FirstDelay = 10 * time.Millisecond
+		param.MaxDelay = 50 * time.Millisecond
+		policy.States[state] = param
+	}
+	policy.HeartbeatInterval = 200 * time.Millisecond
+	policy.PongTimeout = 100 * time.Millisecond
+	policy.PongCheckDelay = 10 * time.Millisecond
+	policy.CloseWait = 10 * time.Millisecond
+	return policy
+}
+
+type testClient struct {
+	session *base.WebSocketSession
+	states  chan string
+	frames  chan *event2.FrameMap
+}
+
+func newTestClient(t *testing.T, srv *Server, channelType string, compressType compress.CompressType, dictVersion string, headerVersion int) *testClient {
+	compressed := 0
+	if compressType != compress.CompressTypeNone {
+		compressed = 1
+	}
+	c := &testClient{states: make(chan string, 64), frames: make(chan *event2.FrameMap, 64)}
+	c.session = base.NewWebSocketSession(srv.Token, srv.BaseUrl(), filepath.Join(t.TempDir(), "session.pid"), "", compressed, compressType, dictVersion, headerVersion, base.WithReconnectPolicy(testPolicy()))
+	c.session.EventSyncHandle = true
+	c.session.OnStateChange(func(from, to base.State, reason error) {
+		c.states <- to.Name
+	})
+	c.session.On(channelType+"_9", event.ListenerFunc(func(e event.Event) error {
+		c.frames <- e.Get(base.EventDataFrameKey).(*event2.FrameMap)
+		return nil
+	}))
+	t.Cleanup(c.session.Stop)
+	return c
+}
+
+func (c *testClient) waitState(t *testing.T, state string) {
+	t.Helper()
+	timeout := time.After(waitTimeout)
+	for {
+		select {
+		case s := <-c.states:
+			if s == state {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("wait state %s timeout", state)
+		}
+	}
+}
+
+func (c *testClient) waitFrame(t *testing.T) *event2.FrameMap {
+	t.Helper()
+	select {
+	case f := <-c.frames:
+		return f
+	case <-time.After(waitTimeout):
+		t.Fatal("wait frame timeout")
+		return nil
+	}
+}
+
+func textEvent(channelType, content string) map[string]interface{} {
+	return map[string]interface{}{"channel_type": channelType, "type": 9, "content": content, "msg_id": content}
+}
+
+func TestGatewayProtocols(t *testing.T) {
+	cases := []struct {
+		compressType  compress.CompressType
+		dictVersion   string
+		headerVersion int
+	}{
+		{compress.CompressTypeNone, "", 0},
+		{compress.CompressTypeNone, "", 1},
+		{compress.CompressTypeZlibPerMessage, "", 0},
+		{compress.CompressTypeZlibStream, "", 1},
+		{compress.CompressTypeZstdPerMessage, "1", 1},
+		{compress.CompressTypeZstdStream, "2", 1},
+	}
+	for i, c := range cases {
+		name := fmt.Sprintf("%s/v%d", compress.GetCompressTypeName(c.compressType), c.headerVersion)
+		t.Run(name, func(t *testing.T) {
+			srv := NewServer()
+			srv.Token = "test-token"
+			defer srv.Close()
+			channelType := fmt.Sprintf("KOOKTEST%d", i)
+			client := newTestClient(t, srv, channelType, c.compressType, c.dictVersion, c.headerVersion)
+			client.session.StateSession.Start()
+			client.waitState(t, base.StatusConnected)
+			conn, err := srv.WaitConn(waitTimeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if client.session.SessionId != conn.SessionId {
+				t.Fatalf("session id %q, want %q", client.session.SessionId, conn.SessionId)
+			}
+
+			sn := srv.SendEvent(textEvent(channelType, "hello"))
+			f := client.waitFrame(t)
+			if f.SerialNumber != sn {
+				t.Fatalf("sn %d, want %d", f.SerialNumber, sn)
+			}
+
+			// 跳过的sn通过nack补发
+			skipped := srv.SkipSN(textEvent(channelType, "skipped1"), textEvent(channelType, "skipped2"))
+			srv.SendEvent(textEvent(channelType, "after"))
+			client.waitFrame(t)
+			if err = client.session.NAck(skipped); err != nil {
+				t.Fatal(err)
+			}
+			for range skipped {
+				if f = client.waitFrame(t); f.SerialNumber != skipped[0] && f.SerialNumber != skipped[1] {
+					t.Fatalf("unexpected sn %d", f.SerialNumber)
+				}
+			}
+
+			// 心跳
+			deadline := time.Now().Add(waitTimeout)
+			for client.session.RTTStats().Count == 0 && time.Now().Before(deadline) {
+				time.Sleep(20 * time.Millisecond)
+			}
+			if client.session.RTTStats().Count == 0 {
+				t.Fatal("no pong received")
+			}
+			hasPing := false
+			for _, f := range conn.Received() {
+				hasPing = hasPing || f.SignalType == event2.SIG_PING
+			}
+			if !hasPing {
+				t.Fatalf("no ping received: %v", conn.Received())
+			}
+		})
+	}
+}
+
+func TestDropPongResume(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	client := newTestClient(t, srv, "KOOKTESTRESUME", compress.CompressTypeZlibStream, "", 1)
+	client.session.StateSession.Start()
+	client.waitState(t, base.StatusConnected)
+	if _, err := srv.WaitConn(waitTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.SetDropPong(true)
+	client.waitState(t, base.StatusRetry)
+	srv.SetDropPong(false)
+	client.waitState(t, base.StatusConnected)
+	if h := client.session.Health(); h.LastRecovery != base.RecoveryResume {
+		t.Fatalf("last recovery %v", h.LastRecovery)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	client := newTestClient(t, srv, "KOOKTESTRECONNECT", compress.CompressTypeZstdPerMessage, "", 1)
+	client.session.StateSession.Start()
+	client.waitState(t, base.StatusConnected)
+	first, err := srv.WaitConn(waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// RECONNECT后session失效，客户端重新获取网关并建立新的session
+	srv.SendReconnect(41008, "missing sn")
+	client.waitState(t, base.StatusInit)
+	client.waitState(t, base.StatusConnected)
+	conn, err := srv.WaitConn(waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.Resumed || conn.SessionId == first.SessionId || len(srv.GatewayRequests()) != 2 {
+		t.Fatalf("resumed %v session %s gateway requests %d", conn.Resumed, conn.SessionId, len(srv.GatewayRequests()))
+	}
+	sn := srv.SendEvent(textEvent("KOOKTESTRECONNECT", "after"))
+	if f := client.waitFrame(t); f.SerialNumber != sn {
+		t.Fatalf("sn %d, want %d", f.SerialNumber, sn)
+	}
+}
+
+func TestCloseConnResume(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	client := newTestClient(t, srv, "KOOKTESTCLOSE", compress.CompressTypeNone, "", 0)
+	client.session.StateSession.Start()
+	client.waitState(t, base.StatusConnected)
+	first, err := srv.WaitConn(waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SendEvent(textEvent("KOOKTESTCLOSE", "before"))
+	client.waitFrame(t)
+
+	// 连接断开期间的事件，在带resume参数重新连接后补发
+	srv.CloseConns()
+	<-first.Done()
+	sn := srv.SendEvent(textEvent("KOOKTESTCLOSE", "offline"))
+	conn, err := srv.WaitConn(3 * waitTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conn.Resumed || conn.SessionId != first.SessionId || conn.Query.Get("sn") != "1" {
+		t.Fatalf("resumed %v session %s query %v", conn.Resumed, conn.SessionId, conn.Query)
+	}
+	if f := client.waitFrame(t); f.SerialNumber != sn {
+		t.Fatalf("sn %d, want %d", f.SerialNumber, sn)
+	}
+}
+
+func TestRestCalls(t *testing.T) {
+	srv := NewServer()
+	srv.Token = "test-token"
+	defer srv.Close()
+	srv.HandleResult("/v3/message/view", Result{Code: 0, Data: map[string]string{"id": "m1"}})
+
+	resp, err := helper.NewApiHelper("/v3/message/create", "test-token", srv.BaseUrl(), "", "").SetBody([]byte(`{"content":"hi"}`)).Post()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != `{"code":0,"message":"操作成功","data":{}}` {
+		t.Fatalf("resp %s", resp)
+	}
+	resp, err = helper.NewApiHelper("/v3/message/view", "test-token", srv.BaseUrl(), "", "").Get()
+	if err != nil || string(resp) != `{"code":0,"message":"","data":{"id":"m1"}}` {
+		t.Fatalf("resp %s %v", resp, err)
+	}
+	calls := srv.CallsTo("/v3/message/create")
+	if len(calls) != 1 || calls[0].Method != "POST" || string(calls[0].Body) != `{"content":"hi"}` {
+		t.Fatalf("calls %+v", calls)
+	}
+
+	resp, _ = helper.NewApiHelper("/v3/message/create", "wrong", srv.BaseUrl(), "", "").Post()
+	if len(srv.CallsTo("/v3/message/create")) != 1 {
+		t.Fatalf("unauthorized call recorded: %s", resp)
+	}
+}
@@ -0,0 +1,82 @@
+// Package metrics SDK的运行指标接口，默认不采集，prom包提供Prometheus实现
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// 解码失败的类型，用于Metrics.FrameError
+const (
+	ErrorKindDecode          = "decode"
+	ErrorKindDecompress      = "decompress"
+	ErrorKindDecompressLimit = "decompress_limit"
+	ErrorKindFrame           = "frame"
+	ErrorKindProcess         = "process"
+)
+
+// Metrics 运行指标，实现需要可以并发调用
+type Metrics interface {
+	// FrameReceived 收到并解析成功的frame，signalType为s
+	FrameReceived(signalType int32)
+	// FrameError 数据无法解码、解压或者不是合法的frame，kind为ErrorKind*
+	FrameError(kind string)
+	// HandlerDone 事件handler处理完成，eventName为channel_type_type
+	HandlerDone(eventName string, d time.Duration, err error)
+	// Reconnect 重新建立连接，reason为原因的简短名称
+	Reconnect(reason string)
+	// Resume 心跳异常后在原连接上resume成功
+	Resume(reason string)
+	// HeartbeatRTT 一次心跳的往返时间
+	HeartbeatRTT(d time.Duration)
+	// StateChanged 状态机进入state
+	StateChanged(state string)
+	// APIRequest 一次REST请求，status为http状态码，请求没有发出或者没有响应时为0
+	APIRequest(endpoint string, status int, d time.Duration)
+	// RateLimitWait 请求前因为限速而等待
+	RateLimitWait(endpoint string, d time.Duration)
+}
+
+var defaultMetrics atomic.Pointer[Metrics]
+
+func init() {
+	SetDefault(nil)
+}
+
+// Default 返回没有单独设置Metrics时使用的实现，默认不采集
+func Default() Metrics {
+	return *defaultMetrics.Load()
+}
+
+// SetDefault 替换默认实现，m为nil时不采集
+func SetDefault(m Metrics) {
+	if m == nil {
+		m = Nop()
+	}
+	defaultMetrics.Store(&m)
+}
+
+// OrDefault m为nil时返回Default()
+func OrDefault(m Metrics) Metrics {
+	if m == nil {
+		return Default()
+	}
+	return m
+}
+
+type nopMetrics struct{}
+
+// Nop 不采集任何指标
+func Nop() Metrics {
+	return nopMetrics{}
+}
+
+func (nopMetrics) FrameReceived(int32)                      {}
+func (nopMetrics) FrameError(string)                        {}
+func (nopMetrics) HandlerDone(string, time.Duration, error) {}
+func (nopMetrics) Reconnect(string)                         {}
+func (nopMetrics) Resume(string)                            {}
+func (nopMetrics) HeartbeatRTT(time.Duration)               {}
+func (nopMetrics) StateChanged(string)                      {}
+func (nopMetrics) APIRequest(string, int, time.Duration)    {}
+func (nopMetrics) RateLimitWait(string, time.Duration)      {}
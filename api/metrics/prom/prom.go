@@ -0,0 +1,136 @@
+// Package prom metrics.Metrics的Prometheus实现
+package prom
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kaiheila/golang-bot/api/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultNamespace NewMetrics的namespace为空时使用
+const DefaultNamespace = "kook_bot"
+
+// Metrics 实现了metrics.Metrics和prometheus.Collector，注册到Registerer后即可导出
+type Metrics struct {
+	framesReceived  *prometheus.CounterVec
+	frameErrors     *prometheus.CounterVec
+	handlerDuration *prometheus.HistogramVec
+	handlerErrors   *prometheus.CounterVec
+	reconnects      *prometheus.CounterVec
+	resumes         *prometheus.CounterVec
+	heartbeatRTT    prometheus.Histogram
+	state           *prometheus.GaugeVec
+	apiDuration     *prometheus.HistogramVec
+	rateLimitWait   *prometheus.HistogramVec
+
+	stateLock sync.Mutex
+	lastState string
+}
+
+var _ metrics.Metrics = (*Metrics)(nil)
+var _ prometheus.Collector = (*Metrics)(nil)
+
+func NewMetrics(namespace string) *Metrics {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	return &Metrics{
+		framesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "frames_received_total", Help: "Frames received by signal type.",
+		}, []string{"signal_type"}),
+		frameErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "frame_errors_total", Help: "Received data dropped by decode, decompress or frame errors.",
+		}, []string{"kind"}),
+		handlerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Name: "handler_duration_seconds", Help: "Event handler latency by event name.", Buckets: prometheus.DefBuckets,
+		}, []string{"event"}),
+		handlerErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "handler_errors_total", Help: "Event handler errors by event name.",
+		}, []string{"event"}),
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "reconnects_total", Help: "Websocket reconnects by reason.",
+		}, []string{"reason"}),
+		resumes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "resumes_total", Help: "Successful resumes by reason.",
+		}, []string{"reason"}),
+		heartbeatRTT: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace, Name: "heartbeat_rtt_seconds", Help: "Heartbeat ping/pong round trip time.",
+			Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}),
+		state: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace, Name: "session_state", Help: "1 for the current session state, 0 otherwise.",
+		}, []string{"state"}),
+		apiDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Name: "api_request_duration_seconds", Help: "REST API latency by endpoint and http status, status 0 means no response.", Buckets: prometheus.DefBuckets,
+		}, []string{"endpoint", "status"}),
+		rateLimitWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Name: "api_rate_limit_wait_seconds", Help: "Time spent waiting for rate limit reset before a request.", Buckets: []float64{.1, .5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"endpoint"}),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.framesReceived, m.frameErrors, m.handlerDuration, m.handlerErrors, m.reconnects,
+		m.resumes, m.heartbeatRTT, m.state, m.apiDuration, m.rateLimitWait}
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+func (m *Metrics) FrameReceived(signalType int32) {
+	m.framesReceived.WithLabelValues(strconv.Itoa(int(signalType))).Inc()
+}
+
+func (m *Metrics) FrameError(kind string) {
+	m.frameErrors.WithLabelValues(kind).Inc()
+}
+
+func (m *Metrics) HandlerDone(eventName string, d time.Duration, err error) {
+	m.handlerDuration.WithLabelValues(eventName).Observe(d.Seconds())
+	if err != nil {
+		m.handlerErrors.WithLabelValues(eventName).Inc()
+	}
+}
+
+func (m *Metrics) Reconnect(reason string) {
+	m.reconnects.WithLabelValues(reason).Inc()
+}
+
+func (m *Metrics) Resume(reason string) {
+	m.resumes.WithLabelValues(reason).Inc()
+}
+
+func (m *Metrics) HeartbeatRTT(d time.Duration) {
+	m.heartbeatRTT.Observe(d.Seconds())
+}
+
+// StateChanged 当前状态为1，之前的状态置为0
+func (m *Metrics) StateChanged(state string) {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	if m.lastState != "" && m.lastState != state {
+		m.state.WithLabelValues(m.lastState).Set(0)
+	}
+	m.state.WithLabelValues(state).Set(1)
+	m.lastState = state
+}
+
+func (m *Metrics) APIRequest(endpoint string, status int, d time.Duration) {
+	m.apiDuration.WithLabelValues(endpoint, strconv.Itoa(status)).Observe(d.Seconds())
+}
+
+func (m *Metrics) RateLimitWait(endpoint string, d time.Duration) {
+	m.rateLimitWait.WithLabelValues(endpoint).Observe(d.Seconds())
+}
@@ -0,0 +1,77 @@
+package prom
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func gather(t *testing.T, reg *prometheus.Registry) map[string][]*dto.Metric {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make(map[string][]*dto.Metric)
+	for _, f := range families {
+		res[f.GetName()] = f.GetMetric()
+	}
+	return res
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics("")
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(m)
+
+	m.FrameReceived(0)
+	m.FrameReceived(0)
+	m.FrameError("decompress")
+	m.HandlerDone("GROUP_9", 10*time.Millisecond, nil)
+	m.HandlerDone("GROUP_9", 20*time.Millisecond, errors.New("fail"))
+	m.Reconnect("heartbeat_timeout")
+	m.Resume("rtt_spike")
+	m.HeartbeatRTT(30 * time.Millisecond)
+	m.StateChanged("connected")
+	m.StateChanged("retry")
+	m.APIRequest("/v3/message/create", 200, 50*time.Millisecond)
+	m.RateLimitWait("/v3/message/create", time.Second)
+
+	got := gather(t, reg)
+	if v := got["kook_bot_frames_received_total"]; len(v) != 1 || v[0].GetCounter().GetValue() != 2 || labelValue(v[0], "signal_type") != "0" {
+		t.Fatalf("frames received %v", v)
+	}
+	if v := got["kook_bot_handler_duration_seconds"]; len(v) != 1 || v[0].GetHistogram().GetSampleCount() != 2 {
+		t.Fatalf("handler duration %v", v)
+	}
+	if v := got["kook_bot_handler_errors_total"]; len(v) != 1 || v[0].GetCounter().GetValue() != 1 {
+		t.Fatalf("handler errors %v", v)
+	}
+	states := make(map[string]float64)
+	for _, s := range got["kook_bot_session_state"] {
+		states[labelValue(s, "state")] = s.GetGauge().GetValue()
+	}
+	if states["connected"] != 0 || states["retry"] != 1 {
+		t.Fatalf("states %v", states)
+	}
+	if v := got["kook_bot_api_request_duration_seconds"]; len(v) != 1 || labelValue(v[0], "status") != "200" {
+		t.Fatalf("api requests %v", v)
+	}
+	for _, name := range []string{"kook_bot_frame_errors_total", "kook_bot_reconnects_total", "kook_bot_resumes_total", "kook_bot_heartbeat_rtt_seconds", "kook_bot_api_rate_limit_wait_seconds"} {
+		if len(got[name]) != 1 {
+			t.Fatalf("%s not collected", name)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+// Package dict 内置的zstd字典包，zip中的每个 <version>.dict 对应网关参数dict-version
+package dict
+
+import "embed"
+
+// DefaultZip 默认使用的字典包
+const DefaultZip = "zstd_v1.zip"
+
+//go:embed *.zip
+var FS embed.FS
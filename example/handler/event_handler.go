@@ -46,12 +46,8 @@ func (gteh *GroupTextEventHandler) Handle(e event.Event) error {
 			return errors.New("data has no frame field")
 		}
 		frame := e.Data()[base.EventDataFrameKey].(*event2.FrameMap)
-		data, err := sonic.Marshal(frame.Data)
-		if err != nil {
-			return err
-		}
 		msgEvent := &event2.MessageKMarkdownEvent{}
-		err = sonic.Unmarshal(data, msgEvent)
+		err := frame.DecodeData(msgEvent)
 		gteh.MsgNum.Add(1)
 		log.Infof("MsgNum:%d, Received json event:%+v", gteh.MsgNum.Load(), msgEvent)
 		if err != nil {
@@ -71,7 +67,8 @@ func (gteh *GroupTextEventHandler) Handle(e event.Event) error {
 			gteh.Session.NAck(isns)
 			return nil
 		}
-		client := helper.NewApiHelper("/v3/message/create", gteh.Token, gteh.BaseUrl, "", "")
+		// 传入事件的context，REST请求的span会挂在事件的span下
+		client := helper.NewApiHelper("/v3/message/create", gteh.Token, gteh.BaseUrl, "", "").SetContext(base.EventContext(e))
 		if msgEvent.Author.Bot {
 			log.Info("bot message")
 			return nil
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+
+	"github.com/kaiheila/golang-bot/api/base"
+	"github.com/kaiheila/golang-bot/example/handler"
+	log "github.com/sirupsen/logrus"
+)
+
+// 把session.Recorder录制的数据回放给handler，用于离线复现线上的事件流
+// go run ./example/replay -file ./events.jsonl -speed 10
+func main() {
+	file := flag.String("file", "./events.jsonl", "录制文件，轮转出的.1、.2等文件会按顺序一起回放")
+	speed := flag.Float64("speed", 1, "回放速度倍数，<=0时不等待")
+	webhook := flag.Bool("webhook", false, "回放webhook的录制")
+	encryptKey := flag.String("encrypt-key", "", "webhook的EncryptKey")
+	verifyToken := flag.String("verify-token", "", "webhook的VerifyToken")
+	flag.Parse()
+	log.SetFormatter(&log.TextFormatter{})
+	log.SetLevel(log.InfoLevel)
+
+	r, err := base.OpenRecording(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+	session := &base.Session{}
+	if *webhook {
+		// webhook的录制需要先解密
+		session = &base.NewWebhookSession(*encryptKey, *verifyToken, 0).Session
+	}
+	session.On(base.EventReceiveFrame, &handler.ReceiveFrameHandler{})
+	session.On("GROUP*", &handler.GroupEventHandler{})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	stats, err := session.Replay(ctx, r, base.ReplayOptions{Speed: *speed, OnRecord: func(rec *base.Record, err error) {
+		if err != nil {
+			log.WithError(err).WithField("sn", rec.SN).WithField("time", rec.Time).Warn("replay record failed")
+		}
+	}})
+	log.WithField("records", stats.Records).WithField("errors", stats.Errors).Info("replay finished")
+	if err != nil {
+		log.Fatal(err)
+	}
+}